@@ -13,7 +13,12 @@ func Boot(m *kvm.Machine, kernel io.ReaderAt, args []string, trace bool) error {
 	if err != nil {
 		return err
 	}
+	return Run(m, trace)
+}
 
+// Run runs every vCPU of a machine that is ready to run, such as one created
+// by kvm.RestoreMachine, until the machine stops.
+func Run(m *kvm.Machine, trace bool) error {
 	var wg sync.WaitGroup
 
 	for i := 0; i < m.NCPU(); i++ {
@@ -2,11 +2,13 @@ package main
 
 import (
 	"bytes"
+	crand "crypto/rand"
 	_ "embed"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"strconv"
@@ -16,12 +18,18 @@ import (
 
 	"github.com/zyedidia/revisor"
 	"github.com/zyedidia/revisor/kvm"
+	"github.com/zyedidia/revisor/usernet"
 )
 
 //go:embed rekernel.elf
 var rekernel []byte
 
-func registerSignals(c *revisor.Container, m *kvm.Machine) {
+// poisonPattern fills guest memory with -poison
+const poisonPattern = 0xdeadbeefdeadbeef
+
+// registerSignals forwards signals to the guest, except for SIGUSR2 which
+// calls usr2 instead if it is not nil.
+func registerSignals(c *revisor.Container, m *kvm.Machine, usr2 func()) {
 	sigc := make(chan os.Signal, 1)
 
 	signal.Notify(sigc,
@@ -56,6 +64,10 @@ func registerSignals(c *revisor.Container, m *kvm.Machine) {
 	go func() {
 		for {
 			s := <-sigc
+			if s == syscall.SIGUSR2 && usr2 != nil {
+				usr2()
+				continue
+			}
 			err := c.Signal(m, s)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error handling signal %v: %v", s, err)
@@ -64,6 +76,114 @@ func registerSignals(c *revisor.Container, m *kvm.Machine) {
 	}()
 }
 
+// snapshotter returns a function that writes a snapshot of m to path, or
+// with incremental, writes deltas to path.1, path.2, ... after the first.
+func snapshotter(m *kvm.Machine, path string, incremental bool) func() {
+	// number of deltas written after the full snapshot
+	deltas := -1
+	return func() {
+		file := path
+		delta := incremental && deltas >= 0
+		if delta {
+			file = fmt.Sprintf("%s.%d", path, deltas+1)
+		}
+		if err := writeSnapshot(m, file, delta); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing snapshot: %v\n", err)
+			return
+		}
+		deltas++
+	}
+}
+
+func writeSnapshot(m *kvm.Machine, path string, delta bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if delta {
+		err = m.SnapshotDelta(f)
+	} else {
+		err = m.Snapshot(f)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// migrationAddr splits an address given as unix:path or host:port into a
+// network and an address.
+func migrationAddr(addr string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+func migrate(m *kvm.Machine, addr string) error {
+	network, address := migrationAddr(addr)
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return m.MigrateTo(conn)
+}
+
+// acceptMigration waits for a single incoming migration on addr.
+func acceptMigration(addr string, c *revisor.Container) (*kvm.Machine, error) {
+	network, address := migrationAddr(addr)
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := l.Accept()
+	l.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return kvm.AcceptMigration(conn, c)
+}
+
+// parseAffinity parses a comma-separated list of host CPUs, one per vCPU in
+// order. Each entry is a single host CPU or a range such as 4-7.
+func parseAffinity(spec string) ([][]int, error) {
+	var sets [][]int
+	for _, entry := range strings.Split(spec, ",") {
+		lo, hi, isRange := strings.Cut(entry, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU affinity %q", entry)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("invalid CPU affinity %q", entry)
+			}
+		}
+		var set []int
+		for h := first; h <= last; h++ {
+			set = append(set, h)
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+func parseHugepages(mode string) (kvm.Hugepages, error) {
+	switch mode {
+	case "":
+		return kvm.HugepagesNone, nil
+	case "thp":
+		return kvm.HugepagesTransparent, nil
+	case "hugetlb":
+		return kvm.HugepagesHugetlb, nil
+	}
+	return 0, fmt.Errorf("unknown huge page mode %q", mode)
+}
+
 func parseMem(mem string) (int64, error) {
 	num := bytes.Buffer{}
 	mod := 'B'
@@ -93,11 +213,210 @@ func parseMem(mem string) (int64, error) {
 	}
 }
 
+func openSerial(serial string) (io.Reader, io.Writer, error) {
+	switch serial {
+	case "stdio":
+		return os.Stdin, os.Stdout, nil
+	default:
+		f, err := os.Create(serial)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, f, nil
+	}
+}
+
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// openPort opens a console port given as name=path or name=unix:path.
+func openPort(spec string) (kvm.ConsolePort, error) {
+	name, path, ok := strings.Cut(spec, "=")
+	if !ok {
+		return kvm.ConsolePort{}, fmt.Errorf("invalid console port %q: expected name=path", spec)
+	}
+	if sock, ok := strings.CutPrefix(path, "unix:"); ok {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return kvm.ConsolePort{}, err
+		}
+		return kvm.ConsolePort{Name: name, Conn: conn}, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return kvm.ConsolePort{}, err
+	}
+	return kvm.ConsolePort{Name: name, Conn: f}, nil
+}
+
+// openNet creates the network backend selected by -net, optionally
+// recording traffic to a pcap file. hostPorts is the comma-separated list of
+// host loopback ports the user backend forwards the gateway address to.
+func openNet(mode, pcap, hostPorts string) (kvm.NetBackend, error) {
+	var ports []uint16
+	if hostPorts != "" {
+		for _, p := range strings.Split(hostPorts, ",") {
+			port, err := strconv.ParseUint(p, 10, 16)
+			if err != nil || port == 0 {
+				return nil, fmt.Errorf("invalid host port %q", p)
+			}
+			ports = append(ports, uint16(port))
+		}
+	}
+	var backend kvm.NetBackend
+	switch mode {
+	case "user":
+		backend = usernet.New(ports)
+	case "loopback":
+		backend = kvm.NewLoopbackNet()
+	case "":
+		// only record frames sent by the guest
+	default:
+		return nil, fmt.Errorf("invalid network backend %q", mode)
+	}
+	if pcap == "" {
+		return backend, nil
+	}
+	f, err := os.Create(pcap)
+	if err != nil {
+		return nil, err
+	}
+	return kvm.NewPcapNet(f, backend)
+}
+
+// proxy copies data in both directions between a and b until both sides
+// have finished sending.
+func proxy(a, b net.Conn) {
+	type closeWriter interface {
+		CloseWrite() error
+	}
+	done := make(chan struct{})
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// vsockListen listens on a Unix socket given as path=port and forwards each
+// connection to the guest port.
+func vsockListen(v *kvm.VirtioVsock, spec string) error {
+	path, portStr, ok := strings.Cut(spec, "=")
+	if !ok {
+		return fmt.Errorf("invalid vsock listener %q: expected path=port", spec)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 32)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				guest, err := v.Dial(uint32(port))
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					conn.Close()
+					return
+				}
+				proxy(conn, guest)
+			}()
+		}
+	}()
+	return nil
+}
+
+// vsockConnect accepts guest connections to a host port given as port=path
+// and forwards them to the Unix socket at path.
+func vsockConnect(v *kvm.VirtioVsock, spec string) error {
+	portStr, path, ok := strings.Cut(spec, "=")
+	if !ok {
+		return fmt.Errorf("invalid vsock connection %q: expected port=path", spec)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 32)
+	if err != nil {
+		return err
+	}
+	l, err := v.Listen(uint32(port))
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			guest, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, err := net.Dial("unix", path)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					guest.Close()
+					return
+				}
+				proxy(conn, guest)
+			}()
+		}
+	}()
+	return nil
+}
+
 func main() {
 	trace := flag.Bool("trace", false, "show instruction trace")
 	kernel := flag.String("kernel", "rekernel", "guest kernel")
 	dir := flag.String("dir", ".", "directory to make available to the guest")
 	mem := flag.String("mem", "2G", "maximum memory available to the guest")
+	memStats := flag.Bool("mem-stats", false, "print how much host memory guest RAM used on exit")
+	initialMem := flag.String("initial-mem", "", "memory the guest starts with, if less than -mem; the guest can request more up to -mem")
+	poison := flag.Bool("poison", false, "fill guest memory with a poison pattern before booting, to catch reads of uninitialized memory")
+	poisonFreed := flag.Bool("poison-freed", false, "with -poison, also poison memory the guest releases")
+	showRAM := flag.Bool("show-ram-fd", false, "print the /proc path of the memfd backing guest memory, for inspecting it from other processes")
+	hugepages := flag.String("hugepages", "", "back guest memory with transparent huge pages ('thp') or with the hugetlbfs pool ('hugetlb')")
+	cpus := flag.Int("cpus", 1, "number of vCPUs; CPU 0 boots and the others wait to be started by the guest")
+	affinity := flag.String("cpu-affinity", "", "pin vCPUs to host CPUs, as a comma-separated list with one host CPU or range (e.g. 4-7) per vCPU")
+	serial := flag.String("serial", "", "attach a serial console connected to 'stdio' or to an output file")
+	console := flag.Bool("console", false, "attach a virtio console connected to stdio")
+	netMode := flag.String("net", "", "attach a virtio network device with a 'user' (NAT) or 'loopback' backend")
+	netHostPorts := flag.String("net-host-ports", "", "comma-separated list of host loopback ports that the guest can connect to at the gateway address with -net user")
+	netPcap := flag.String("net-pcap", "", "record network traffic to a pcap file (implies a network device)")
+	mac := flag.String("mac", "52:54:00:12:34:56", "MAC address of the network device")
+	p9tag := flag.String("9p", "", "export the -dir directories over a virtio-9p device with the given mount tag")
+	rng := flag.Bool("rng", false, "attach a virtio entropy device")
+	seed := flag.String("seed", "", "seed guest randomness for reproducible runs")
+	restore := flag.String("restore", "", "resume the machine saved in a snapshot file instead of booting a kernel, followed by any deltas to apply as a comma-separated list")
+	snapshot := flag.String("snapshot", "", "write a snapshot to the given file when SIGUSR2 is received")
+	incremental := flag.Bool("incremental", false, "with -snapshot, write the snapshots after the first as deltas to file.1, file.2, ...")
+	migrateTo := flag.String("migrate", "", "migrate the machine to a revisor started with -incoming at the given host:port or unix:path when SIGUSR2 is received")
+	incoming := flag.String("incoming", "", "wait for a machine migrated to the given host:port or unix:path instead of booting a kernel")
+	vsockCID := flag.Uint("vsock-cid", 3, "context ID of the guest's virtio socket device")
+	var consolePorts, disks, vsockListens, vsockConnects listFlag
+	flag.Var(&consolePorts, "console-port", "add a virtio console port as name=path or name=unix:path (implies -console)")
+	flag.Var(&disks, "disk", "attach a virtio block device backed by a raw image, append ',ro' for read-only")
+	flag.Var(&vsockListens, "vsock-listen", "forward connections to the Unix socket path to a guest vsock port, as path=port")
+	flag.Var(&vsockConnects, "vsock-connect", "forward guest connections to a host vsock port to a Unix socket, as port=path")
 
 	flag.Parse()
 	args := flag.Args()
@@ -105,14 +424,178 @@ func main() {
 	start := time.Now()
 
 	c := revisor.NewContainer(strings.Split(*dir, ":"))
+	var entropy io.Reader = crand.Reader
+	if *seed != "" {
+		n, err := strconv.ParseUint(*seed, 0, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.SetRand(revisor.NewSeededRand(n))
+		// give the device its own stream so that its output does not depend
+		// on how requests interleave with hypercalls
+		entropy = revisor.NewSeededRand(n + 1)
+	}
 	sz, err := parseMem(*mem)
 	if err != nil {
 		log.Fatal(err)
 	}
-	m, err := kvm.NewMachine("/dev/kvm", 1, sz, c)
+	hp, err := parseHugepages(*hugepages)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *restore != "" && *incoming != "" {
+		log.Fatal("-restore and -incoming cannot be used together")
+	}
+	if *hugepages != "" && (*restore != "" || *incoming != "") {
+		log.Fatal("-hugepages cannot be used with -restore or -incoming")
+	}
+	if *serial == "stdio" && (*console || len(consolePorts) > 0) {
+		log.Fatal("-serial stdio and -console both use stdio and cannot be used together")
+	}
+	if *snapshot != "" && *migrateTo != "" {
+		log.Fatal("-snapshot and -migrate both use SIGUSR2 and cannot be used together")
+	}
+	if *netHostPorts != "" && *netMode != "user" {
+		log.Fatal("-net-host-ports requires -net user")
+	}
+	var m *kvm.Machine
+	if *incoming != "" {
+		if m, err = acceptMigration(*incoming, c); err != nil {
+			log.Fatal(err)
+		}
+		*cpus = m.NCPU()
+	} else if *restore != "" {
+		var layers []io.Reader
+		for _, path := range strings.Split(*restore, ",") {
+			f, err := os.Open(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			layers = append(layers, f)
+		}
+		m, err = kvm.RestoreIncremental(layers[0], layers[1:], c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*cpus = m.NCPU()
+	} else {
+		if m, err = kvm.NewMachineHugepages("/dev/kvm", *cpus, sz, hp, c); err != nil {
+			log.Fatal(err)
+		}
+		if *initialMem != "" {
+			initial, err := parseMem(*initialMem)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := m.SetInitialMemory(uint64(initial)); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *poison {
+			m.PoisonMemory(poisonPattern, *poisonFreed)
+		}
+	}
+	if *showRAM {
+		log.Printf("guest RAM is backed by /proc/%d/fd/%d", os.Getpid(), m.RAMFd())
+	}
+
+	if *affinity != "" {
+		sets, err := parseAffinity(*affinity)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(sets) > *cpus {
+			log.Fatalf("CPU affinity given for %d vCPUs, but there are only %d", len(sets), *cpus)
+		}
+		for cpu, set := range sets {
+			if err := m.SetAffinity(cpu, set...); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if *serial != "" {
+		in, out, err := openSerial(*serial)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := m.AddSerial(in, out); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *console || len(consolePorts) > 0 {
+		var ports []kvm.ConsolePort
+		for _, spec := range consolePorts {
+			port, err := openPort(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ports = append(ports, port)
+		}
+		if _, err := m.AddConsole(os.Stdin, os.Stdout, ports...); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, disk := range disks {
+		path, ro := strings.CutSuffix(disk, ",ro")
+		flags := os.O_RDWR
+		if ro {
+			flags = os.O_RDONLY
+		}
+		f, err := os.OpenFile(path, flags, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := m.AddBlock(f, ro); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *netMode != "" || *netPcap != "" {
+		hwaddr, err := net.ParseMAC(*mac)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend, err := openNet(*netMode, *netPcap, *netHostPorts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := m.AddNet(hwaddr, backend); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *p9tag != "" {
+		if _, err := m.Add9P(*p9tag, revisor.NewP9Server(c)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *rng {
+		if _, err := m.AddRNG(entropy); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(vsockListens) > 0 || len(vsockConnects) > 0 {
+		v, err := m.AddVsock(uint32(*vsockCID))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, spec := range vsockListens {
+			if err := vsockListen(v, spec); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, spec := range vsockConnects {
+			if err := vsockConnect(v, spec); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
 	var kdata io.ReaderAt
 
@@ -128,11 +611,32 @@ func main() {
 		kdata = kfile
 	}
 
-	registerSignals(c, m)
+	var usr2 func()
+	if *snapshot != "" {
+		usr2 = snapshotter(m, *snapshot, *incremental)
+	} else if *migrateTo != "" {
+		usr2 = func() {
+			if err := migrate(m, *migrateTo); err != nil {
+				fmt.Fprintf(os.Stderr, "error migrating: %v\n", err)
+			}
+		}
+	}
+	registerSignals(c, m, usr2)
 
-	err = revisor.Boot(m, kdata, args, *trace)
+	if *restore != "" || *incoming != "" {
+		err = revisor.Run(m, *trace)
+	} else {
+		err = revisor.Boot(m, kdata, args, *trace)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Fprintln(os.Stderr, "time:", time.Since(start))
+	if *memStats {
+		stats, err := m.MemoryStats()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "memory: %d KiB, resident: %d KiB, released by guest: %d KiB\n", stats.Total>>10, stats.Resident>>10, stats.Released>>10)
+	}
 }
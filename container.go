@@ -1,16 +1,26 @@
 package revisor
 
 import (
+	"crypto/rand"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/zyedidia/revisor/kvm"
 )
 
 type Container struct {
-	dirs    []string
-	fdtable map[uint64]*os.File
-	nextfd  uint64
+	dirs []string
+	rand io.Reader
+	ring *hypRing
+
+	// lock protects the file table, which is shared with ring workers, and
+	// the file mappings, indexed by guest-physical address
+	lock     sync.Mutex
+	fdtable  map[uint64]*os.File
+	nextfd   uint64
+	mappings map[uint64]*fileMapping
 }
 
 func NewContainer(dirs []string) *Container {
@@ -28,10 +38,18 @@ func NewContainer(dirs []string) *Container {
 			1: os.Stdout,
 			2: os.Stderr,
 		},
-		nextfd: 3,
+		nextfd:   3,
+		rand:     rand.Reader,
+		mappings: make(map[uint64]*fileMapping),
 	}
 }
 
+// SetRand sets the source of the random bytes returned by the getrandom
+// hypercall. By default it is crypto/rand.
+func (c *Container) SetRand(r io.Reader) {
+	c.rand = r
+}
+
 func (c *Container) Signal(m *kvm.Machine, sig os.Signal) error {
 	return m.InjectIrq(kvm.SignalIRQ, 1)
 }
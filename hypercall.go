@@ -29,15 +29,32 @@ const (
 	hypFstat       = 7
 	hypGetdents64  = 8
 	hypClearSignal = 9
+	hypGetrandom   = 10
+	hypRingSetup   = 11
+	hypRingEnter   = 12
+	hypAsync       = 13
+	hypStartCPU    = 14
+	hypDirtyPages  = 15
+	hypGrowMemory  = 16
+	hypRelease     = 17
+	hypMmap        = 18
+	hypMunmap      = 19
+	hypGuard       = 20
 )
 
 const (
 	errFail = ^uint64(0)
+	// returned by hypAsync when the operation will complete through the ring
+	hypPending = ^uint64(1)
+	// returned by hypAsync when too many operations are in progress
+	hypBusy = ^uint64(2)
 
 	fdMax = 1024 * 1024
 )
 
 func (c *Container) addFile(f *os.File) (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if c.nextfd >= fdMax {
 		return 0, errors.New("reached maximum number of file descriptors")
 	}
@@ -47,6 +64,21 @@ func (c *Container) addFile(f *os.File) (uint64, error) {
 	return fd, nil
 }
 
+func (c *Container) file(fd uint64) (*os.File, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	f, ok := c.fdtable[fd]
+	return f, ok
+}
+
+func (c *Container) removeFile(fd uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.fdtable[fd]
+	delete(c.fdtable, fd)
+	return ok
+}
+
 func (c *Container) CanAccess(path string) bool {
 	for _, dir := range c.dirs {
 		if strings.HasPrefix(path, dir) {
@@ -81,40 +113,136 @@ var (
 	ErrUnknownHypercall = errors.New("unknown hypercall")
 )
 
+// hypPtrArgs lists the arguments of each hypercall that are guest virtual
+// addresses.
+var hypPtrArgs = map[uint64][]int{
+	hypWrite:      {1},
+	hypOpen:       {0},
+	hypRead:       {1},
+	hypTime:       {0, 1},
+	hypFstat:      {1},
+	hypGetdents64: {1},
+	hypGetrandom:  {0},
+	hypDirtyPages: {0},
+	hypMmap:       {1},
+}
+
 func (c *Container) Hypercall(m *kvm.Machine, cpu int, num, a0, a1, a2, a3, a4, a5 uint64) (uint64, error) {
+	switch num {
+	case hypExit:
+		return 0, ErrExit
+	case hypClearSignal:
+		if !signalIRQ(a0) {
+			return errFail, nil
+		}
+		m.InjectIrq(uint32(a0), 0)
+		return 0, nil
+	case hypRingSetup:
+		return c.ringSetup(m, m.VtoP(cpu, a0), a1, a2)
+	case hypRingEnter:
+		return c.ringEnter(m, cpu)
+	case hypAsync:
+		return c.async(m, cpu, a0)
+	case hypStartCPU:
+		// the new CPU starts without paging
+		if err := m.StartCPU(int(a0), m.VtoP(cpu, a1), a2); err != nil {
+			return errFail, nil
+		}
+		return 0, nil
+	case hypGrowMemory:
+		size, err := m.GrowMemory(a0)
+		if err != nil {
+			return errFail, nil
+		}
+		return size, nil
+	case hypRelease:
+		// the range is guest-physical
+		if err := m.ReleaseMemory(a0, a1); err != nil {
+			return errFail, nil
+		}
+		return 0, nil
+	case hypGuard:
+		// a guest-physical range, unguarded if a2 is 0
+		var err error
+		if a2 != 0 {
+			err = m.Guard(cpu, a0, a1)
+		} else {
+			err = m.Unguard(cpu, a0)
+		}
+		if err != nil {
+			return errFail, nil
+		}
+		return 0, nil
+	}
+
+	args := [6]uint64{a0, a1, a2, a3, a4, a5}
+	for _, i := range hypPtrArgs[num] {
+		args[i] = m.VtoP(cpu, args[i])
+	}
+	ret, err := c.hostcall(m, num, args)
+	if errors.Is(err, ErrUnknownHypercall) {
+		return 0, fmt.Errorf("%w: %d (pc=%x)", ErrUnknownHypercall, num, m.GetPc(cpu))
+	}
+	return ret, err
+}
+
+// signalIRQ reports whether the guest may have the host raise and lower irq,
+// which must not be wired to an emulated device.
+func signalIRQ(irq uint64) bool {
+	return irq >= kvm.SignalIRQ && irq < kvm.SignalIRQ+kvm.SignalIRQs
+}
+
+// hostcall performs a hypercall whose pointer arguments have already been
+// translated to guest physical addresses. It does not depend on the calling
+// vCPU, so it may run on any goroutine.
+func (c *Container) hostcall(m *kvm.Machine, num uint64, args [6]uint64) (uint64, error) {
+	a0, a1, a2 := args[0], args[1], args[2]
 	switch num {
 	case hypTime:
+		sec, err := m.PhysSlice(a0, 8)
+		if err != nil {
+			return errFail, nil
+		}
+		nsec, err := m.PhysSlice(a1, 8)
+		if err != nil {
+			return errFail, nil
+		}
 		now := time.Now()
-		a0 := m.VtoP(cpu, a0)
-		a1 := m.VtoP(cpu, a1)
-		binary.LittleEndian.PutUint64(m.Slice(a0, a0+8), uint64(now.Unix()))
-		binary.LittleEndian.PutUint64(m.Slice(a1, a1+8), uint64(now.Nanosecond()))
+		binary.LittleEndian.PutUint64(sec, uint64(now.Unix()))
+		binary.LittleEndian.PutUint64(nsec, uint64(now.Nanosecond()))
 		return 0, nil
 	case hypGetdents64:
 		fd := a0
-		dirp := m.VtoP(cpu, a1)
+		dirp := a1
 		count := a2
-		f, ok := c.fdtable[fd]
+		f, ok := c.file(fd)
 		if !ok {
 			return errFail, nil
 		}
-		n, err := syscall.ReadDirent(int(f.Fd()), m.Slice(dirp, dirp+count))
+		buf, err := m.PhysSlice(dirp, count)
+		if err != nil {
+			return errFail, nil
+		}
+		n, err := syscall.ReadDirent(int(f.Fd()), buf)
 		if err != nil {
 			return errFail, nil
 		}
 		return uint64(n), nil
 	case hypFstat:
 		fd := a0
-		ptr := m.VtoP(cpu, a1)
-		f, ok := c.fdtable[fd]
+		ptr := a1
+		f, ok := c.file(fd)
 		if !ok {
 			return errFail, nil
 		}
+		slice, err := m.PhysSlice(ptr, uint64(unsafe.Sizeof(stat{})))
+		if err != nil {
+			return errFail, nil
+		}
 		info, err := f.Stat()
 		if err != nil {
 			return errFail, nil
 		}
-		slice := m.Slice(ptr, ptr+uint64(unsafe.Sizeof(stat{})))
 		sys := info.Sys().(*syscall.Stat_t)
 		st := stat{
 			size:      uint64(info.Size()),
@@ -132,12 +260,16 @@ func (c *Container) Hypercall(m *kvm.Machine, cpu int, num, a0, a1, a2, a3, a4,
 		return 0, nil
 	case hypWrite:
 		fd := a0
-		ptr := m.VtoP(cpu, a1)
+		ptr := a1
 		size := a2
-		if f, ok := c.fdtable[fd]; !ok {
+		if f, ok := c.file(fd); !ok {
 			return errFail, nil
 		} else {
-			fmt.Fprint(f, string(m.Slice(ptr, ptr+size)))
+			buf, err := m.PhysSlice(ptr, size)
+			if err != nil {
+				return errFail, nil
+			}
+			fmt.Fprint(f, string(buf))
 			return size, nil
 		}
 	case hypLseek:
@@ -145,7 +277,7 @@ func (c *Container) Hypercall(m *kvm.Machine, cpu int, num, a0, a1, a2, a3, a4,
 		off := int64(a1)
 		whence := int(a2)
 
-		if f, ok := c.fdtable[fd]; !ok {
+		if f, ok := c.file(fd); !ok {
 			return errFail, nil
 		} else {
 			n, err := f.Seek(off, whence)
@@ -155,7 +287,10 @@ func (c *Container) Hypercall(m *kvm.Machine, cpu int, num, a0, a1, a2, a3, a4,
 			return uint64(n), nil
 		}
 	case hypOpen:
-		name := cstring(m.SliceEnd(m.VtoP(cpu, a0)))
+		name := cstring(m.SliceEnd(a0))
+		if name == "" {
+			return errFail, nil
+		}
 		flags := a1
 		mode := a2
 
@@ -180,12 +315,16 @@ func (c *Container) Hypercall(m *kvm.Machine, cpu int, num, a0, a1, a2, a3, a4,
 		return fd, nil
 	case hypRead:
 		fd := a0
-		ptr := m.VtoP(cpu, a1)
+		ptr := a1
 		size := a2
-		if f, ok := c.fdtable[fd]; !ok {
+		if f, ok := c.file(fd); !ok {
 			return errFail, nil
 		} else {
-			n, err := f.Read(m.Slice(ptr, ptr+size))
+			buf, err := m.PhysSlice(ptr, size)
+			if err != nil {
+				return errFail, nil
+			}
+			n, err := f.Read(buf)
 			if errors.Is(err, io.EOF) {
 				return 0, nil
 			} else if err != nil {
@@ -195,19 +334,62 @@ func (c *Container) Hypercall(m *kvm.Machine, cpu int, num, a0, a1, a2, a3, a4,
 		}
 	case hypClose:
 		fd := a0
-		if _, ok := c.fdtable[fd]; !ok {
+		if !c.removeFile(fd) {
 			return errFail, nil
-		} else {
-			delete(c.fdtable, fd)
-			return 0, nil
 		}
-	case hypExit:
-		return 0, ErrExit
-	case hypClearSignal:
-		m.InjectIrq(uint32(a0), 0)
 		return 0, nil
+	case hypDirtyPages:
+		// the first call enables dirty logging; a zero size queries the
+		// size of the bitmap
+		ptr := a0
+		size := a1
+		if err := m.EnableDirtyLogging(); err != nil {
+			return errFail, nil
+		}
+		n := m.DirtyBitmapSize()
+		if size == 0 {
+			return n, nil
+		}
+		if size < n {
+			return errFail, nil
+		}
+		buf, err := m.PhysSlice(ptr, n)
+		if err != nil {
+			return errFail, nil
+		}
+		bitmap, err := m.DirtyPages()
+		if err != nil {
+			return errFail, nil
+		}
+		for i, w := range bitmap {
+			binary.LittleEndian.PutUint64(buf[8*i:], w)
+		}
+		return n, nil
+	case hypMmap:
+		// the arguments are pa, size, offset and flags
+		fd := a0
+		var margs [4]uint64
+		buf, err := m.PhysSlice(a1, uint64(len(margs)*8))
+		if err != nil {
+			return errFail, nil
+		}
+		for i := range margs {
+			margs[i] = binary.LittleEndian.Uint64(buf[8*i:])
+		}
+		return c.mmap(m, fd, margs[0], margs[1], int64(margs[2]), margs[3]), nil
+	case hypMunmap:
+		return c.munmap(m, a0), nil
+	case hypGetrandom:
+		buf, err := m.PhysSlice(a0, a1)
+		if err != nil {
+			return errFail, nil
+		}
+		if _, err := io.ReadFull(c.rand, buf); err != nil {
+			return errFail, nil
+		}
+		return a1, nil
 	}
-	return 0, fmt.Errorf("%w: %d (pc=%x)", ErrUnknownHypercall, num, m.GetPc(cpu))
+	return 0, ErrUnknownHypercall
 }
 
 func cstring(data []byte) string {
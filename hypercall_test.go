@@ -0,0 +1,62 @@
+package revisor
+
+import (
+	"os"
+	"testing"
+
+	"github.com/zyedidia/revisor/kvm"
+)
+
+func mustOpen(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestHypercallUnpluggedPointer(t *testing.T) {
+	c := NewContainer(nil)
+	m, err := kvm.NewMachine("/dev/kvm", 1, 16<<20, c)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer m.Close()
+	if err := m.SetInitialMemory(1); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := c.addFile(mustOpen(t, "."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := c.addFile(mustOpen(t, "hypercall_test.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ram = 0x40000000
+	// the first byte of RAM the guest does not have, and the last it has
+	end := ram + m.Memory()
+	tests := []struct {
+		name string
+		num  uint64
+		args [6]uint64
+	}{
+		{"time", hypTime, [6]uint64{end, ram}},
+		{"time nsec", hypTime, [6]uint64{ram, end}},
+		{"fstat", hypFstat, [6]uint64{file, end - 8}},
+		{"read", hypRead, [6]uint64{file, end - 8, 64}},
+		{"write", hypWrite, [6]uint64{1, end - 8, 64}},
+		{"getdents64", hypGetdents64, [6]uint64{dir, end - 8, 4096}},
+		{"open", hypOpen, [6]uint64{end}},
+		{"dirty pages", hypDirtyPages, [6]uint64{end, 1 << 20}},
+		{"mmap", hypMmap, [6]uint64{file, end - 8}},
+	}
+	for _, tt := range tests {
+		a := tt.args
+		if ret, err := c.Hypercall(m, 0, tt.num, a[0], a[1], a[2], a[3], a[4], a[5]); ret != errFail || err != nil {
+			t.Errorf("%s returned %#x, %v, want a failure", tt.name, ret, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package kvm
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// cpuSet is a Linux cpu_set_t for up to 1024 host CPUs.
+type cpuSet [16]uint64
+
+func (s *cpuSet) set(cpu int) error {
+	if cpu < 0 || cpu >= len(s)*64 {
+		return fmt.Errorf("invalid host CPU %d", cpu)
+	}
+	s[cpu/64] |= 1 << (cpu % 64)
+	return nil
+}
+
+func schedGetaffinity(tid int, s *cpuSet) error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, uintptr(tid), unsafe.Sizeof(*s), uintptr(unsafe.Pointer(s)))
+	if errno != 0 {
+		return fmt.Errorf("sched_getaffinity: %w", errno)
+	}
+	return nil
+}
+
+func schedSetaffinity(tid int, s *cpuSet) error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid), unsafe.Sizeof(*s), uintptr(unsafe.Pointer(s)))
+	if errno != 0 {
+		return fmt.Errorf("sched_setaffinity: %w", errno)
+	}
+	return nil
+}
+
+// SetAffinity pins the thread running a vCPU to the given host CPUs. With no
+// host CPUs the vCPU is unpinned from then on. It may be called before or
+// while the vCPU runs; a running vCPU is moved immediately.
+func (m *Machine) SetAffinity(cpu int, hostCPUs ...int) error {
+	if cpu < 0 || cpu >= len(m.runs) {
+		return fmt.Errorf("invalid CPU %d", cpu)
+	}
+	var s *cpuSet
+	if len(hostCPUs) > 0 {
+		s = new(cpuSet)
+		for _, h := range hostCPUs {
+			if err := s.set(h); err != nil {
+				return err
+			}
+		}
+	}
+
+	m.affinityLock.Lock()
+	defer m.affinityLock.Unlock()
+	m.affinity[cpu] = s
+	tid := int(m.tids[cpu].Load())
+	if tid == 0 {
+		return nil
+	}
+	if s == nil {
+		// unpinned threads may run wherever the process may
+		s = new(cpuSet)
+		if err := schedGetaffinity(syscall.Getpid(), s); err != nil {
+			return err
+		}
+	}
+	return schedSetaffinity(tid, s)
+}
+
+// pin records the calling thread as the thread of a vCPU and applies the
+// vCPU's affinity to it. The thread must be locked to its goroutine. The
+// returned function undoes both, restoring the thread's original affinity
+// before it is released back to the runtime.
+func (m *Machine) pin(cpu int) (func(), error) {
+	var orig cpuSet
+	if err := schedGetaffinity(0, &orig); err != nil {
+		return nil, err
+	}
+
+	m.affinityLock.Lock()
+	defer m.affinityLock.Unlock()
+	if s := m.affinity[cpu]; s != nil {
+		if err := schedSetaffinity(0, s); err != nil {
+			return nil, err
+		}
+	}
+	m.tids[cpu].Store(int32(syscall.Gettid()))
+	return func() {
+		m.affinityLock.Lock()
+		defer m.affinityLock.Unlock()
+		m.tids[cpu].Store(0)
+		schedSetaffinity(0, &orig)
+	}, nil
+}
@@ -0,0 +1,128 @@
+package kvm
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// allowedCPUs returns the host CPUs the process may run on.
+func allowedCPUs(t *testing.T) (cpuSet, []int) {
+	t.Helper()
+	var s cpuSet
+	if err := schedGetaffinity(syscall.Getpid(), &s); err != nil {
+		t.Fatal(err)
+	}
+	var cpus []int
+	for i := 0; i < len(s)*64; i++ {
+		if s[i/64]&(1<<(i%64)) != 0 {
+			cpus = append(cpus, i)
+		}
+	}
+	return s, cpus
+}
+
+func threadAffinity(t *testing.T, tid int) cpuSet {
+	t.Helper()
+	var s cpuSet
+	if err := schedGetaffinity(tid, &s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSetAffinityInvalid(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	if err := m.SetAffinity(1, 0); err == nil {
+		t.Error("pinned a vCPU that does not exist")
+	}
+	for _, h := range []int{-1, 1024} {
+		if err := m.SetAffinity(0, h); err == nil {
+			t.Errorf("pinned a vCPU to host CPU %d", h)
+		}
+	}
+	if m.affinity[0] != nil {
+		t.Error("failed SetAffinity changed the affinity")
+	}
+}
+
+func TestSetAffinityRunning(t *testing.T) {
+	m, err := NewMachine("/dev/kvm", 2, 16<<20, nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer m.Close()
+	all, cpus := allowedCPUs(t)
+	last := cpus[len(cpus)-1]
+	var want cpuSet
+	want.set(last)
+
+	if err := m.SetAffinity(1, last); err != nil {
+		t.Fatal(err)
+	}
+	// CPU 1 is pinned as soon as its thread starts, while it waits to be
+	// started by the guest
+	done := make(chan error)
+	go func() { done <- m.RunInfiniteLoop(1, false) }()
+	var tid int
+	for tid == 0 {
+		time.Sleep(time.Millisecond)
+		tid = int(m.tids[1].Load())
+	}
+	if got := threadAffinity(t, tid); got != want {
+		t.Errorf("vCPU thread affinity %x, want %x", got[0], want[0])
+	}
+
+	// a running vCPU is moved immediately
+	if err := m.SetAffinity(1, cpus[0]); err != nil {
+		t.Fatal(err)
+	}
+	want = cpuSet{}
+	want.set(cpus[0])
+	if got := threadAffinity(t, tid); got != want {
+		t.Errorf("vCPU thread affinity %x after moving it, want %x", got[0], want[0])
+	}
+	if err := m.SetAffinity(1); err != nil {
+		t.Fatal(err)
+	}
+	if got := threadAffinity(t, tid); got != all {
+		t.Errorf("vCPU thread affinity %x after unpinning it, want %x", got[0], all[0])
+	}
+
+	m.Stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if m.tids[1].Load() != 0 {
+		t.Error("stopped vCPU still has a thread")
+	}
+}
+
+func TestPinRestoresAffinity(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	_, cpus := allowedCPUs(t)
+	if err := m.SetAffinity(0, cpus[0]); err != nil {
+		t.Fatal(err)
+	}
+	var want cpuSet
+	want.set(cpus[0])
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig := threadAffinity(t, 0)
+	unpin, err := m.pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := threadAffinity(t, 0); got != want {
+		t.Errorf("pinned thread affinity %x, want %x", got[0], want[0])
+	}
+	if int(m.tids[0].Load()) != syscall.Gettid() {
+		t.Error("pinned thread not recorded as the vCPU's thread")
+	}
+	unpin()
+	if got := threadAffinity(t, 0); got != orig {
+		t.Errorf("thread affinity %x after unpinning, want %x", got[0], orig[0])
+	}
+}
@@ -0,0 +1,93 @@
+package kvm
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/tysonmote/gommap"
+)
+
+// MemoryStats describes how much host memory guest RAM uses.
+type MemoryStats struct {
+	// RAM the guest has
+	Total uint64
+	// RAM resident in host memory
+	Resident uint64
+	// RAM the guest reported free with ReleaseMemory and has not used since
+	Released uint64
+}
+
+// ReleaseMemory discards the whole pages of guest RAM in the guest-physical
+// range [pa, pa+n), which the guest reports as free, so that they no longer
+// use host memory. With the hugetlbfs pool, only whole huge pages are
+// discarded. Released pages read as zero when the guest uses them again, or
+// as they were when the machine was forked if it has been, unless released
+// memory is poisoned by PoisonMemory.
+func (m *Machine) ReleaseMemory(pa, n uint64) error {
+	// the RAM may not be unplugged while it is discarded
+	m.memLock.RLock()
+	defer m.memLock.RUnlock()
+	if pa < physRamBase || pa+n < pa || pa+n-physRamBase > m.vm.plugged {
+		return fmt.Errorf("guest physical range [%#x, %#x) is not RAM", pa, pa+n)
+	}
+	align := m.vm.pagesize
+	start := (pa - physRamBase + align - 1) / align * align
+	end := (pa + n - physRamBase) / align * align
+	if start >= end {
+		return nil
+	}
+
+	// MADV_DONTNEED would only unmap the pages of the shared memfd, which
+	// keeps them, so they are removed from it instead. Pages of a private
+	// mapping are copies that MADV_DONTNEED frees.
+	advice := gommap.MADV_REMOVE
+	if m.vm.private {
+		advice = gommap.MADV_DONTNEED
+	}
+	if err := gommap.MMap(m.vm.mem[start:end]).Advise(advice); err != nil {
+		return fmt.Errorf("madvise: %w", err)
+	}
+	if m.poisoning && m.poisonFreed {
+		poisonRAM(m.vm.mem[start:end], m.poison)
+	}
+	m.markDirty(start, end-start)
+
+	m.releaseLock.Lock()
+	defer m.releaseLock.Unlock()
+	if m.released == nil {
+		m.released = make([]uint64, m.DirtyBitmapSize()/8)
+	}
+	pagesize := uint64(os.Getpagesize())
+	for page := start / pagesize; page < end/pagesize; page++ {
+		m.released[page/64] |= 1 << (page % 64)
+	}
+	return nil
+}
+
+// MemoryStats returns the host memory used by guest RAM. Released pages that
+// have become resident again are no longer counted as released.
+func (m *Machine) MemoryStats() (MemoryStats, error) {
+	plugged := m.Memory()
+	resident, err := gommap.MMap(m.vm.mem[:plugged]).IsResident()
+	if err != nil {
+		return MemoryStats{}, fmt.Errorf("mincore: %w", err)
+	}
+	pagesize := uint64(os.Getpagesize())
+	stats := MemoryStats{Total: plugged}
+
+	m.releaseLock.Lock()
+	defer m.releaseLock.Unlock()
+	for page, r := range resident {
+		bit := uint64(1) << (page % 64)
+		switch {
+		case r:
+			stats.Resident += pagesize
+			if m.released != nil {
+				m.released[page/64] &^= bit
+			}
+		case m.released != nil && m.released[page/64]&bit != 0:
+			stats.Released += pagesize
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,99 @@
+package kvm
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// fillRAM fills [pa, pa+n) with b and returns it.
+func fillRAM(m *Machine, pa, n uint64, b byte) []byte {
+	mem := m.Slice(pa, pa+n)
+	for i := range mem {
+		mem[i] = b
+	}
+	return mem
+}
+
+// testRelease releases [pa+1, pa+n-1) of RAM filled with ones and checks
+// that the pages of the given size within it read as zero and the rest of
+// the range is kept.
+func testRelease(t *testing.T, m *Machine, pa, n, pagesize uint64) {
+	t.Helper()
+	mem := fillRAM(m, pa, n, 1)
+	if err := m.ReleaseMemory(pa+1, n-2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mem[pagesize:n-pagesize], make([]byte, n-2*pagesize)) {
+		t.Error("released pages do not read as zero")
+	}
+	if !bytes.Equal(mem[:pagesize], bytes.Repeat([]byte{1}, int(pagesize))) ||
+		!bytes.Equal(mem[n-pagesize:], bytes.Repeat([]byte{1}, int(pagesize))) {
+		t.Error("pages partly in the released range changed")
+	}
+}
+
+func TestReleaseMemory(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	pagesize := uint64(os.Getpagesize())
+	testRelease(t, m, physRamBase+0x10_0000, 8*pagesize, pagesize)
+
+	// the pages read back are in use again, unlike these
+	fillRAM(m, physRamBase+0x20_0000, 4*pagesize, 1)
+	if err := m.ReleaseMemory(physRamBase+0x20_0000, 4*pagesize); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := m.MemoryStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Released != 4*pagesize {
+		t.Errorf("%d bytes released, want %d", stats.Released, 4*pagesize)
+	}
+
+	if err := m.ReleaseMemory(physRamBase+m.Memory()-pagesize, 2*pagesize); err == nil {
+		t.Error("released memory past the end of RAM")
+	}
+}
+
+func TestReleaseMemoryForked(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	const pa = physRamBase + 0x10_0000
+	pagesize := uint64(os.Getpagesize())
+	fillRAM(m, pa, pagesize, 2)
+	child, err := m.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+
+	// released pages of a fork read as they were when it was forked
+	mem := fillRAM(child, pa, pagesize, 3)
+	if err := child.ReleaseMemory(pa, pagesize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mem, bytes.Repeat([]byte{2}, int(pagesize))) {
+		t.Error("released page of a fork does not read as it was when forked")
+	}
+}
+
+func TestReleaseMemoryHugetlb(t *testing.T) {
+	m, err := NewMachineHugepages("/dev/kvm", 1, 16<<20, HugepagesHugetlb, nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer m.Close()
+	huge := m.vm.pagesize
+	if huge <= uint64(os.Getpagesize()) {
+		t.Fatalf("hugetlb RAM has pages of %d bytes", huge)
+	}
+	// a range within a single huge page is not released
+	mem := fillRAM(m, physRamBase, huge, 1)
+	if err := m.ReleaseMemory(physRamBase+1, huge-1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mem, bytes.Repeat([]byte{1}, int(huge))) {
+		t.Error("released part of a huge page")
+	}
+	testRelease(t, m, physRamBase, 4*huge, huge)
+}
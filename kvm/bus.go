@@ -0,0 +1,228 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// Device is an emulated device attached to the MMIO or port I/O bus of a
+// machine. Offsets are relative to the start of the range that the device is
+// registered at, and the length of data is the access size.
+type Device interface {
+	Read(offset uint64, data []byte) error
+	Write(offset uint64, data []byte) error
+}
+
+type busRange struct {
+	base uint64
+	size uint64
+	dev  Device
+}
+
+func (r busRange) contains(addr uint64) bool {
+	return addr >= r.base && addr-r.base < r.size
+}
+
+func (r busRange) overlaps(base, size uint64) bool {
+	return base < r.base+r.size && r.base < base+size
+}
+
+// bus maps address ranges to devices. Ranges are kept sorted by base address.
+type bus struct {
+	lock   sync.RWMutex
+	ranges []busRange
+}
+
+func (b *bus) insert(base, size uint64, dev Device) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, r := range b.ranges {
+		if r.overlaps(base, size) {
+			return fmt.Errorf("%w: [%#x, %#x) and [%#x, %#x)", ErrDeviceOverlap, base, base+size, r.base, r.base+r.size)
+		}
+	}
+
+	i := sort.Search(len(b.ranges), func(i int) bool {
+		return b.ranges[i].base >= base
+	})
+	b.ranges = append(b.ranges, busRange{})
+	copy(b.ranges[i+1:], b.ranges[i:])
+	b.ranges[i] = busRange{
+		base: base,
+		size: size,
+		dev:  dev,
+	}
+	return nil
+}
+
+func (b *bus) overlaps(base, size uint64) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, r := range b.ranges {
+		if r.overlaps(base, size) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *bus) find(addr uint64) (busRange, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	i := sort.Search(len(b.ranges), func(i int) bool {
+		return b.ranges[i].base > addr
+	})
+	if i == 0 || !b.ranges[i-1].contains(addr) {
+		return busRange{}, false
+	}
+	return b.ranges[i-1], true
+}
+
+// access performs a read or write at addr. It returns false if no device is
+// mapped at addr.
+func (b *bus) access(addr uint64, data []byte, write bool) (bool, error) {
+	r, ok := b.find(addr)
+	if !ok {
+		return false, nil
+	}
+	if write {
+		return true, r.dev.Write(addr-r.base, data)
+	}
+	return true, r.dev.Read(addr-r.base, data)
+}
+
+// ErrDeviceOverlap is returned when a device is registered at a range that is
+// already in use.
+var ErrDeviceOverlap = errors.New("device range overlaps an existing mapping")
+
+// RegisterMMIO attaches dev to the guest-physical range [base, base+size).
+// The range must not overlap guest memory, a memory region, the in-kernel
+// interrupt controller, or another device.
+func (m *Machine) RegisterMMIO(base, size uint64, dev Device) error {
+	if size == 0 || base+size < base {
+		return fmt.Errorf("invalid MMIO range %#x+%#x", base, size)
+	}
+	for _, r := range m.reservedMMIO() {
+		if r.overlaps(base, size) {
+			return fmt.Errorf("%w: [%#x, %#x) and reserved [%#x, %#x)", ErrDeviceOverlap, base, base+size, r.base, r.base+r.size)
+		}
+	}
+	m.memLock.RLock()
+	defer m.memLock.RUnlock()
+	if m.regionOverlaps(base, size) {
+		return fmt.Errorf("%w: [%#x, %#x) and a memory region", ErrDeviceOverlap, base, base+size)
+	}
+	return m.mmio.insert(base, size, dev)
+}
+
+// RegisterPIO attaches dev to the I/O ports [port, port+count). Port I/O only
+// exists on amd64, but devices may still be registered on other
+// architectures.
+func (m *Machine) RegisterPIO(port, count uint16, dev Device) error {
+	if count == 0 || uint32(port)+uint32(count) > 1<<16 {
+		return fmt.Errorf("invalid port range %#x+%#x", port, count)
+	}
+	return m.pio.insert(uint64(port), uint64(count), dev)
+}
+
+// UnhandledAccessError reports a guest MMIO or port I/O access to an address
+// that no device is registered at. Reads of such addresses return all ones.
+type UnhandledAccessError struct {
+	CPU   int
+	Port  bool
+	Addr  uint64
+	Size  int
+	Write bool
+	Pc    uint64
+}
+
+func (e *UnhandledAccessError) Error() string {
+	space := "MMIO"
+	if e.Port {
+		space = "port I/O"
+	}
+	dir := "read"
+	if e.Write {
+		dir = "write"
+	}
+	return fmt.Sprintf("CPU %d: unhandled %s %s of %d bytes at %#x (pc=%#x)", e.CPU, space, dir, e.Size, e.Addr, e.Pc)
+}
+
+const (
+	exitIOIn  = 0
+	exitIOOut = 1
+)
+
+// isHypercall reports whether an MMIO exit is a write to the hypercall
+// doorbell in the sys page.
+func (m *Machine) isHypercall(mmio *exitMMIO) bool {
+	return mmio.IsWrite != 0 && mmio.PhysAddr >= physSysBase && mmio.PhysAddr-physSysBase < uint64(len(m.vm.sys))
+}
+
+func (m *Machine) handleMMIO(cpu int) error {
+	mmio := m.runs[cpu].mmio()
+	data := mmio.Data[:min(int(mmio.Len), len(mmio.Data))]
+	write := mmio.IsWrite != 0
+
+	ok, err := m.mmio.access(mmio.PhysAddr, data, write)
+	if !ok {
+		if !write {
+			fill(data, 0xff)
+		}
+		return &UnhandledAccessError{
+			CPU:   cpu,
+			Addr:  mmio.PhysAddr,
+			Size:  len(data),
+			Write: write,
+			Pc:    m.GetPc(cpu),
+		}
+	}
+	return err
+}
+
+func (m *Machine) handleIO(cpu int) error {
+	pio := m.runs[cpu].io()
+	size := uint64(pio.Size)
+	buf := m.runData(cpu, pio.DataOffset, size*uint64(pio.Count))
+	write := pio.Direction == exitIOOut
+
+	// String instructions (rep ins/outs) access the same port count times.
+	for i := uint64(0); i < uint64(pio.Count); i++ {
+		data := buf[i*size : (i+1)*size]
+		ok, err := m.pio.access(uint64(pio.Port), data, write)
+		if !ok {
+			if !write {
+				fill(buf, 0xff)
+			}
+			return &UnhandledAccessError{
+				CPU:   cpu,
+				Port:  true,
+				Addr:  uint64(pio.Port),
+				Size:  int(size),
+				Write: write,
+				Pc:    m.GetPc(cpu),
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runData returns a slice of the vcpu's kvm_run mapping at off.
+func (m *Machine) runData(cpu int, off, n uint64) []byte {
+	return unsafe.Slice((*byte)(unsafe.Add(unsafe.Pointer(m.runs[cpu]), off)), n)
+}
+
+func fill(b []byte, v byte) {
+	for i := range b {
+		b[i] = v
+	}
+}
@@ -0,0 +1,73 @@
+package kvm
+
+import (
+	"errors"
+	"testing"
+)
+
+type testDevice struct {
+	reads, writes []uint64
+}
+
+func (d *testDevice) Read(offset uint64, data []byte) error {
+	d.reads = append(d.reads, offset)
+	data[0] = 0x42
+	return nil
+}
+
+func (d *testDevice) Write(offset uint64, data []byte) error {
+	d.writes = append(d.writes, offset)
+	return nil
+}
+
+func TestRegisterMMIOOverlap(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	const base = 0x1000_0000
+	if err := m.RegisterMMIO(base, 0x1000, &testDevice{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		base, size uint64
+	}{
+		{base, 0x1000},
+		{base - 0x10, 0x20},
+		{base + 0xff0, 0x100},
+		{base - 0x1000, 0x3000},
+		// guest RAM
+		{physRamBase, 0x1000},
+	} {
+		if err := m.RegisterMMIO(tt.base, tt.size, &testDevice{}); !errors.Is(err, ErrDeviceOverlap) {
+			t.Errorf("registering [%#x, %#x): got %v, want %v", tt.base, tt.base+tt.size, err, ErrDeviceOverlap)
+		}
+	}
+	if err := m.RegisterMMIO(base+0x1000, 0x1000, &testDevice{}); err != nil {
+		t.Errorf("adjacent range: %v", err)
+	}
+	if err := m.RegisterMMIO(^uint64(0)-0x10, 0x20, &testDevice{}); err == nil {
+		t.Error("registered a range that wraps around")
+	}
+}
+
+func TestBusAccess(t *testing.T) {
+	var b bus
+	d1, d2 := &testDevice{}, &testDevice{}
+	if err := b.insert(0x2000, 0x100, d2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.insert(0x1000, 0x100, d1); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4)
+	if ok, _ := b.access(0x1010, data, false); !ok || data[0] != 0x42 {
+		t.Errorf("read: ok=%v data=%x", ok, data)
+	}
+	if ok, _ := b.access(0x20ff, data, true); !ok {
+		t.Error("write to the last byte of a device not dispatched")
+	}
+	if ok, _ := b.access(0x2100, data, true); ok {
+		t.Error("write past a device dispatched")
+	}
+	if len(d1.reads) != 1 || d1.reads[0] != 0x10 || len(d2.writes) != 1 || d2.writes[0] != 0xff {
+		t.Errorf("device offsets: reads %x, writes %x", d1.reads, d2.writes)
+	}
+}
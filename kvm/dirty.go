@@ -0,0 +1,171 @@
+package kvm
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"unsafe"
+)
+
+const kvmMemLogDirtyPages = 1 << 0
+
+type dirtyLog struct {
+	slot   uint32
+	_      uint32
+	bitmap uint64
+}
+
+// EnableDirtyLogging starts tracking the pages of guest RAM written by the
+// vCPUs, and by the host through Slice, PhysSlice or ranges passed to
+// MarkDirty. Enabling it again has no effect.
+func (m *Machine) EnableDirtyLogging() error {
+	m.dirtyLock.Lock()
+	defer m.dirtyLock.Unlock()
+	if m.dirtyLogging {
+		return nil
+	}
+	m.hostDirty = make([]atomic.Uint64, m.DirtyBitmapSize()/8)
+	m.guestDirty = make([]uint64, m.DirtyBitmapSize()/8)
+	m.trackHost.Store(true)
+	m.memLock.Lock()
+	err := m.vm.setRAMFlags(kvmMemLogDirtyPages)
+	m.memLock.Unlock()
+	if err != nil {
+		m.trackHost.Store(false)
+		return err
+	}
+	m.dirtyLogging = true
+	return nil
+}
+
+// DirtyLogging reports whether dirty logging is enabled.
+func (m *Machine) DirtyLogging() bool {
+	m.dirtyLock.Lock()
+	defer m.dirtyLock.Unlock()
+	return m.dirtyLogging
+}
+
+// DirtyPages returns a bitmap of the guest RAM pages written since dirty
+// logging was enabled or since the previous call. Bit i of word i/64 is set
+// if the page at guest-physical address RAM base + i*page size was written.
+// Snapshots and migrations track dirty pages separately and do not change
+// the result.
+func (m *Machine) DirtyPages() ([]uint64, error) {
+	m.dirtyLock.Lock()
+	defer m.dirtyLock.Unlock()
+	if !m.dirtyLogging {
+		return nil, fmt.Errorf("dirty logging is not enabled")
+	}
+	if err := m.fetchDirty(); err != nil {
+		return nil, err
+	}
+	return takeDirty(&m.guestDirty), nil
+}
+
+// fetchDirty collects and clears the pages dirtied by the vCPUs and the
+// host, and adds them to the bitmap of each consumer: the pages pending for
+// DirtyPages, for the next delta snapshot and for the next round of a
+// migration. Must be called with dirtyLock held.
+func (m *Machine) fetchDirty() error {
+	m.memLock.RLock()
+	defer m.memLock.RUnlock()
+	bitmap := make([]uint64, m.DirtyBitmapSize()/8)
+	for _, s := range m.vm.ramSlots {
+		if err := m.vm.slotDirty(s, bitmap); err != nil {
+			return err
+		}
+	}
+	for i := range bitmap {
+		bitmap[i] |= m.hostDirty[i].Swap(0)
+	}
+	for _, dirty := range [...][]uint64{m.guestDirty, m.snapDirty, m.migrateDirty} {
+		for i := range dirty {
+			dirty[i] |= bitmap[i]
+		}
+	}
+	return nil
+}
+
+// takeDirty returns the bitmap of a consumer and gives it an empty one.
+func takeDirty(dirty *[]uint64) []uint64 {
+	bitmap := *dirty
+	*dirty = make([]uint64, len(bitmap))
+	return bitmap
+}
+
+// slotDirty collects and clears the dirty log of a RAM slot, setting the
+// bits of its pages in bitmap. Read-only slots have no dirty log.
+func (vm *vm) slotDirty(s ramSlot, bitmap []uint64) error {
+	if s.readonly {
+		return nil
+	}
+	pagesize := uint64(os.Getpagesize())
+	first, npages := s.off/pagesize, s.size/pagesize
+	// KVM writes whole words of the bitmap, so a slot that does not cover
+	// whole words, such as one split by a guard, is read into its own bitmap
+	// to keep the bits of its neighbours
+	direct := first%64 == 0 && npages%64 == 0
+	words := bitmap[first/64:]
+	if !direct {
+		words = make([]uint64, (npages+63)/64)
+	}
+	log := dirtyLog{
+		slot:   s.slot,
+		bitmap: uint64(uintptr(unsafe.Pointer(&words[0]))),
+	}
+	_, err := Ioctl(vm.fd, IIOW(kvmGetDirtyLog, unsafe.Sizeof(log)), uintptr(unsafe.Pointer(&log)))
+	if err != nil {
+		return fmt.Errorf("KVM_GET_DIRTY_LOG: %w", err)
+	}
+	if !direct {
+		for i := uint64(0); i < npages; i++ {
+			if words[i/64]&(1<<(i%64)) != 0 {
+				page := first + i
+				bitmap[page/64] |= 1 << (page % 64)
+			}
+		}
+	}
+	return nil
+}
+
+// MarkDirty records that the host wrote the guest-physical range [pa, pa+n)
+// through memory obtained earlier, so that dirty logging sees the write.
+// Writes through the slices returned by Slice and PhysSlice are recorded
+// when the slice is obtained.
+func (m *Machine) MarkDirty(pa, n uint64) {
+	m.markDirty(pa-physRamBase, n)
+}
+
+// markDirty marks the pages of RAM in [off, off+n) if dirty logging is
+// enabled. It also records that RAM no longer matches a template frozen by
+// Fork.
+func (m *Machine) markDirty(off, n uint64) {
+	if n == 0 {
+		return
+	}
+	if !m.ramChanged.Load() {
+		m.ramChanged.Store(true)
+	}
+	if !m.trackHost.Load() {
+		return
+	}
+	pagesize := uint64(os.Getpagesize())
+	last := min((off+n-1)/pagesize, uint64(len(m.vm.mem))/pagesize-1)
+	for page := off / pagesize; page <= last; page++ {
+		word := &m.hostDirty[page/64]
+		bit := uint64(1) << (page % 64)
+		for {
+			old := word.Load()
+			if old&bit != 0 || word.CompareAndSwap(old, old|bit) {
+				break
+			}
+		}
+	}
+}
+
+// DirtyBitmapSize returns the size in bytes of the bitmaps returned by
+// DirtyPages.
+func (m *Machine) DirtyBitmapSize() uint64 {
+	npages := uint64(len(m.vm.mem) / os.Getpagesize())
+	return (npages + 63) / 64 * 8
+}
@@ -0,0 +1,16 @@
+package kvm
+
+import "testing"
+
+func TestDirtyPagesGuestWrite(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	const pa = physRamBase + 0x20_0000
+	code := []byte{
+		0xc6, 0x05, 0, 0, 0x20, 0x40, 1, // mov byte [pa], 1
+	}
+	testDirtyConsumers(t, m, pa, func() {
+		if err := runCode(t, m, append(code, doneCode...)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package kvm
+
+import (
+	"os"
+	"testing"
+)
+
+// dirtyPage reports whether bitmap has the page at guest-physical address pa.
+func dirtyPage(bitmap []uint64, pa uint64) bool {
+	page := (pa - physRamBase) / uint64(os.Getpagesize())
+	return bitmap[page/64]&(1<<(page%64)) != 0
+}
+
+// testDirtyConsumers checks that a page written by write is seen both by
+// DirtyPages and by the next delta snapshot.
+func testDirtyConsumers(t *testing.T, m *Machine, pa uint64, write func()) {
+	t.Helper()
+	if err := m.Snapshot(discard{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.EnableDirtyLogging(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.DirtyPages(); err != nil {
+		t.Fatal(err)
+	}
+	write()
+
+	dirty, err := m.DirtyPages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dirtyPage(dirty, pa) {
+		t.Error("DirtyPages does not have the written page")
+	}
+	if dirty, _ := m.DirtyPages(); dirtyPage(dirty, pa) {
+		t.Error("DirtyPages has the written page again")
+	}
+	// DirtyPages does not take the page from the snapshot
+	m.dirtyLock.Lock()
+	err = m.fetchDirty()
+	pending := dirtyPage(m.snapDirty, pa)
+	m.dirtyLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pending {
+		t.Error("the next delta snapshot does not have the written page")
+	}
+}
+
+type discard struct{}
+
+func (discard) Write(b []byte) (int, error) { return len(b), nil }
+
+func TestDirtyPagesHostWrite(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	const pa = physRamBase + 0x5000
+	testDirtyConsumers(t, m, pa, func() {
+		m.Slice(pa, pa+1)[0] = 1
+	})
+}
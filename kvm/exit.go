@@ -0,0 +1,240 @@
+package kvm
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Exit payloads stored in the RunData.Data union. The layouts follow the
+// anonymous union in struct kvm_run (linux/kvm.h).
+
+type exitFailEntry struct {
+	HardwareEntryFailureReason uint64
+	CPU                        uint32
+}
+
+type exitException struct {
+	Exception uint32
+	ErrorCode uint32
+}
+
+type exitIO struct {
+	Direction  uint8
+	Size       uint8
+	Port       uint16
+	Count      uint32
+	DataOffset uint64
+}
+
+type exitMMIO struct {
+	PhysAddr uint64
+	Data     [8]uint8
+	Len      uint32
+	IsWrite  uint8
+}
+
+type exitInternal struct {
+	Suberror uint32
+	Ndata    uint32
+	Data     [16]uint64
+}
+
+type exitSystemEvent struct {
+	Type  uint32
+	Ndata uint32
+	Data  [16]uint64
+}
+
+func (r *RunData) failEntry() *exitFailEntry {
+	return (*exitFailEntry)(unsafe.Pointer(&r.Data[0]))
+}
+
+func (r *RunData) exception() *exitException {
+	return (*exitException)(unsafe.Pointer(&r.Data[0]))
+}
+
+func (r *RunData) io() *exitIO {
+	return (*exitIO)(unsafe.Pointer(&r.Data[0]))
+}
+
+func (r *RunData) mmio() *exitMMIO {
+	return (*exitMMIO)(unsafe.Pointer(&r.Data[0]))
+}
+
+func (r *RunData) internal() *exitInternal {
+	return (*exitInternal)(unsafe.Pointer(&r.Data[0]))
+}
+
+func (r *RunData) systemEvent() *exitSystemEvent {
+	return (*exitSystemEvent)(unsafe.Pointer(&r.Data[0]))
+}
+
+const (
+	internalErrorEmulation            = 1
+	internalErrorSimulEx              = 2
+	internalErrorDeliveryEv           = 3
+	internalErrorUnexpectedExitReason = 4
+)
+
+func internalErrorString(suberror uint32) string {
+	switch suberror {
+	case internalErrorEmulation:
+		return "instruction emulation failed"
+	case internalErrorSimulEx:
+		return "exception raised while handling an exception"
+	case internalErrorDeliveryEv:
+		return "exit while delivering an event"
+	case internalErrorUnexpectedExitReason:
+		return "unexpected hardware exit reason"
+	}
+	return fmt.Sprintf("suberror %d", suberror)
+}
+
+const (
+	systemEventShutdown = 1
+	systemEventReset    = 2
+	systemEventCrash    = 3
+)
+
+func systemEventString(typ uint32) string {
+	switch typ {
+	case systemEventShutdown:
+		return "shutdown"
+	case systemEventReset:
+		return "reset"
+	case systemEventCrash:
+		return "crash"
+	}
+	return fmt.Sprintf("event %d", typ)
+}
+
+// ShutdownError is returned when the guest shuts down the vCPU, which on
+// amd64 is usually the result of a triple fault.
+type ShutdownError struct {
+	CPU  int
+	Regs string
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("CPU %d: shutdown (triple fault?)\n%s", e.CPU, e.Regs)
+}
+
+// FailEntryError is returned when the hardware refuses to enter the guest.
+type FailEntryError struct {
+	CPU     int
+	Reason  uint64
+	HostCPU uint32
+	Regs    string
+}
+
+func (e *FailEntryError) Error() string {
+	return fmt.Sprintf("CPU %d: entry failed on host CPU %d: %s (%#x)\n%s", e.CPU, e.HostCPU, failEntryString(e.Reason), e.Reason, e.Regs)
+}
+
+// InternalError is returned when KVM cannot handle an exit by itself, for
+// example when it fails to emulate an instruction.
+type InternalError struct {
+	CPU      int
+	Suberror uint32
+	Data     []uint64
+	Regs     string
+}
+
+func (e *InternalError) Error() string {
+	return fmt.Sprintf("CPU %d: internal error: %s (data=%#x)\n%s", e.CPU, internalErrorString(e.Suberror), e.Data, e.Regs)
+}
+
+// ExceptionError is returned when the guest raises an exception that is
+// reflected to userspace.
+type ExceptionError struct {
+	CPU       int
+	Exception uint32
+	ErrorCode uint32
+	Regs      string
+}
+
+func (e *ExceptionError) Error() string {
+	return fmt.Sprintf("CPU %d: exception %d (error code %#x)\n%s", e.CPU, e.Exception, e.ErrorCode, e.Regs)
+}
+
+// SystemEventError is returned when the guest requests a system-level event
+// such as a PSCI SYSTEM_OFF or SYSTEM_RESET.
+type SystemEventError struct {
+	CPU  int
+	Type uint32
+	Data []uint64
+	Regs string
+}
+
+func (e *SystemEventError) Error() string {
+	return fmt.Sprintf("CPU %d: system event: %s (data=%#x)\n%s", e.CPU, systemEventString(e.Type), e.Data, e.Regs)
+}
+
+// UnexpectedExitError is returned for exit reasons that the machine does not
+// handle. It wraps ErrUnexpectedExitReason.
+type UnexpectedExitError struct {
+	CPU    int
+	Reason ExitType
+	Regs   string
+}
+
+func (e *UnexpectedExitError) Error() string {
+	return fmt.Sprintf("CPU %d: %v: %v\n%s", e.CPU, ErrUnexpectedExitReason, e.Reason, e.Regs)
+}
+
+func (e *UnexpectedExitError) Unwrap() error {
+	return ErrUnexpectedExitReason
+}
+
+// exitError decodes the payload of a fatal exit into a typed error.
+func (m *Machine) exitError(cpu int, exit ExitType) error {
+	run := m.runs[cpu]
+	regs := m.dumpRegs(cpu)
+
+	switch exit {
+	case ExitShutdown:
+		return &ShutdownError{
+			CPU:  cpu,
+			Regs: regs,
+		}
+	case ExitFailEntry:
+		fe := run.failEntry()
+		return &FailEntryError{
+			CPU:     cpu,
+			Reason:  fe.HardwareEntryFailureReason,
+			HostCPU: fe.CPU,
+			Regs:    regs,
+		}
+	case ExitInternalError:
+		ie := run.internal()
+		n := min(int(ie.Ndata), len(ie.Data))
+		return &InternalError{
+			CPU:      cpu,
+			Suberror: ie.Suberror,
+			Data:     append([]uint64(nil), ie.Data[:n]...),
+			Regs:     regs,
+		}
+	case ExitException:
+		ex := run.exception()
+		return &ExceptionError{
+			CPU:       cpu,
+			Exception: ex.Exception,
+			ErrorCode: ex.ErrorCode,
+			Regs:      regs,
+		}
+	case ExitSystemEvent:
+		se := run.systemEvent()
+		n := min(int(se.Ndata), len(se.Data))
+		return &SystemEventError{
+			CPU:  cpu,
+			Type: se.Type,
+			Data: append([]uint64(nil), se.Data[:n]...),
+			Regs: regs,
+		}
+	}
+	return &UnexpectedExitError{
+		CPU:    cpu,
+		Reason: exit,
+		Regs:   regs,
+	}
+}
@@ -0,0 +1,26 @@
+package kvm
+
+import "fmt"
+
+const (
+	vmxExitInvalidGuestState = 33
+	vmxExitMSRLoadFail       = 34
+	vmxExitMachineCheck      = 41
+
+	svmExitErr = ^uint64(0)
+)
+
+func failEntryString(reason uint64) string {
+	if reason == svmExitErr {
+		return "invalid VMCB state"
+	}
+	switch reason & 0xffff {
+	case vmxExitInvalidGuestState:
+		return "invalid guest state"
+	case vmxExitMSRLoadFail:
+		return "MSR loading failed"
+	case vmxExitMachineCheck:
+		return "machine-check event"
+	}
+	return fmt.Sprintf("exit reason %d", reason&0xffff)
+}
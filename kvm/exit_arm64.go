@@ -0,0 +1,14 @@
+package kvm
+
+import "fmt"
+
+const (
+	failEntryCPUUnsupported = 1 << 0
+)
+
+func failEntryString(reason uint64) string {
+	if reason&failEntryCPUUnsupported != 0 {
+		return "vCPU run on unsupported host CPU"
+	}
+	return fmt.Sprintf("reason %#x", reason)
+}
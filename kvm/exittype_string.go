@@ -24,11 +24,13 @@ func _() {
 	_ = x[ExitDCR-15]
 	_ = x[ExitNMI-16]
 	_ = x[ExitInternalError-17]
+	_ = x[ExitSystemEvent-24]
 }
 
 const (
 	_ExitType_name_0 = "ExitUnknownExitExceptionExitIOExitHypercallExitDebugExitHltExitMMIOExitIRQWindowOpenExitShutdownExitFailEntryExitIntrExitSetTPRExitTPRAccess"
 	_ExitType_name_1 = "ExitDCRExitNMIExitInternalError"
+	_ExitType_name_2 = "ExitSystemEvent"
 )
 
 var (
@@ -43,6 +45,8 @@ func (i ExitType) String() string {
 	case 15 <= i && i <= 17:
 		i -= 15
 		return _ExitType_name_1[_ExitType_index_1[i]:_ExitType_index_1[i+1]]
+	case i == 24:
+		return _ExitType_name_2
 	default:
 		return "ExitType(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
@@ -0,0 +1,182 @@
+package kvm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/tysonmote/gommap"
+)
+
+// Forker is implemented by hypercall handlers that must be duplicated for a
+// forked machine, for example to give it its own file table.
+type Forker interface {
+	Fork(child *Machine) (HypercallHandler, error)
+}
+
+// Fork creates a copy of the machine that shares its RAM copy-on-write. The
+// child has the same vCPU and interrupt controller state and guards, and is
+// ready to run with StartVCPU. Its hypercall handler is duplicated if it
+// implements Forker and shared otherwise. Devices are not copied, and a
+// machine with memory regions cannot be forked.
+//
+// The first fork, and the first fork after the parent has run again or the
+// host has written to its RAM, freeze the parent's RAM as a template; later
+// forks only create the new VM. Freezing RAM that already maps a template
+// copies all of RAM, so it takes time proportional to the size of RAM
+// rather than to the amount written since the previous fork.
+func (m *Machine) Fork() (*Machine, error) {
+	m.Pause()
+	defer m.Resume()
+
+	m.memLock.RLock()
+	regions := len(m.regions)
+	m.memLock.RUnlock()
+	if regions > 0 {
+		return nil, errors.New("cannot fork a machine with memory regions")
+	}
+	if err := m.freezeRAM(); err != nil {
+		return nil, err
+	}
+
+	kvmfd, err := syscall.Dup(int(m.kvmfd))
+	if err != nil {
+		return nil, err
+	}
+	devkvm := os.NewFile(uintptr(kvmfd), m.devkvm.Name())
+	memfd, err := syscall.Dup(m.vm.memfd)
+	if err != nil {
+		devkvm.Close()
+		return nil, err
+	}
+	vm, err := newVM(devkvm.Fd(), memfd, int64(len(m.vm.mem)), gommap.MAP_PRIVATE, m.vm.hugepages)
+	if err != nil {
+		syscall.Close(memfd)
+		devkvm.Close()
+		return nil, err
+	}
+	child, err := newMachine(devkvm, vm, len(m.runs), m.handler)
+	if err != nil {
+		return nil, err
+	}
+	m.memLock.RLock()
+	plugged, layout := m.vm.plugged, append([]ramSlot(nil), m.vm.ramSlots...)
+	child.poison, child.poisoning, child.poisonFreed = m.poison, m.poisoning, m.poisonFreed
+	m.memLock.RUnlock()
+	if err := child.vm.resetRAM(plugged); err != nil {
+		child.Close()
+		return nil, err
+	}
+	// guards split RAM into several slots
+	if len(layout) > 1 {
+		child.dirtyLock.Lock()
+		child.memLock.Lock()
+		err := child.replaceRAMSlots(0, len(child.vm.ramSlots), layout)
+		child.memLock.Unlock()
+		child.dirtyLock.Unlock()
+		if err != nil {
+			child.Close()
+			return nil, err
+		}
+	}
+	if err := m.copyState(child); err != nil {
+		child.Close()
+		return nil, err
+	}
+	if f, ok := m.handler.(Forker); ok {
+		h, err := f.Fork(child)
+		if err != nil {
+			child.Close()
+			return nil, err
+		}
+		child.handler = h
+	}
+	return child, nil
+}
+
+// copyState copies the vCPU and interrupt controller state of a paused
+// machine to another machine with the same number of vCPUs.
+func (m *Machine) copyState(child *Machine) error {
+	var buf bytes.Buffer
+	for cpu := range m.runs {
+		if err := m.saveVCPUState(cpu, &buf); err != nil {
+			return fmt.Errorf("CPU %d: %w", cpu, err)
+		}
+		if err := child.restoreVCPUState(cpu, &buf); err != nil {
+			return fmt.Errorf("CPU %d: %w", cpu, err)
+		}
+		if m.started[cpu].Load() {
+			child.started[cpu].Store(true)
+			close(child.start[cpu])
+		}
+	}
+	if err := m.saveVMState(&buf); err != nil {
+		return err
+	}
+	return child.restoreVMState(&buf)
+}
+
+// freezeRAM makes the memfd hold the current contents of RAM and maps RAM
+// privately, so that the memfd no longer changes and can be shared with
+// children. If RAM already maps a template but has diverged from it, the
+// non-zero pages are copied to a new template.
+func (m *Machine) freezeRAM() error {
+	if m.vm.private && !m.ramChanged.Load() {
+		return nil
+	}
+	memfd := m.vm.memfd
+	if m.vm.private {
+		var err error
+		if memfd, err = m.copyRAM(); err != nil {
+			return err
+		}
+	}
+	mem := m.vm.mem
+	_, err := gommap.MapAt(uintptr(unsafe.Pointer(&mem[0])), uintptr(memfd), 0, int64(len(mem)), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_PRIVATE|gommap.MAP_FIXED)
+	if err != nil {
+		if memfd != m.vm.memfd {
+			syscall.Close(memfd)
+		}
+		return fmt.Errorf("mmap: %w", err)
+	}
+	// the new mapping does not keep the advice given for the old one
+	if err := adviseRAM(mem, m.vm.hugepages); err != nil {
+		return err
+	}
+	if memfd != m.vm.memfd {
+		syscall.Close(m.vm.memfd)
+		m.vm.memfd = memfd
+	}
+	m.vm.private = true
+	m.ramChanged.Store(false)
+	return nil
+}
+
+// copyRAM returns a new memfd holding the contents of RAM. Zero pages are
+// left as holes, so every page of RAM is read. The memfd is written through
+// a mapping because hugetlbfs does not support write.
+func (m *Machine) copyRAM() (int, error) {
+	mem := m.vm.mem
+	memfd, err := memfdCreate("revisor-ram", int64(len(mem)), m.vm.hugepages)
+	if err != nil {
+		return -1, err
+	}
+	dst, err := gommap.MapAt(0, uintptr(memfd), 0, int64(len(mem)), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		syscall.Close(memfd)
+		return -1, fmt.Errorf("mmap: %w", err)
+	}
+	defer dst.UnsafeUnmap()
+	pagesize := os.Getpagesize()
+	zero := make([]byte, pagesize)
+	for off := 0; off < len(mem); off += pagesize {
+		page := mem[off : off+pagesize]
+		if !bytes.Equal(page, zero) {
+			copy(dst[off:], page)
+		}
+	}
+	return memfd, nil
+}
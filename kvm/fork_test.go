@@ -0,0 +1,120 @@
+package kvm
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestForkCopiesRAM(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	const pa = physRamBase + 0x10000
+	copy(m.Slice(pa, pa+5), "first")
+
+	child, err := m.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if got := string(child.Slice(pa, pa+5)); got != "first" {
+		t.Errorf("child sees %q, want the parent's RAM", got)
+	}
+
+	// writes on either side are private
+	copy(child.Slice(pa, pa+5), "child")
+	if got := string(m.Slice(pa, pa+5)); got != "first" {
+		t.Errorf("parent sees %q after the child wrote to RAM", got)
+	}
+	copy(m.Slice(pa, pa+5), "again")
+	if got := string(child.Slice(pa, pa+5)); got != "child" {
+		t.Errorf("child sees %q after the parent wrote to RAM", got)
+	}
+
+	// a later fork sees what the parent wrote since the first one
+	second, err := m.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if got := string(second.Slice(pa, pa+5)); got != "again" {
+		t.Errorf("second child sees %q, want the parent's RAM", got)
+	}
+}
+
+func TestForkCopiesGuards(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	const pa = physRamBase + 0x10000
+	if err := m.Guard(-1, pa, 0x2000); err != nil {
+		t.Fatal(err)
+	}
+	child, err := m.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+
+	layout := func(m *Machine) string {
+		var s string
+		for _, slot := range m.vm.ramSlots {
+			s += fmt.Sprintf("%#x+%#x:%v ", slot.off, slot.size, slot.readonly)
+		}
+		return s
+	}
+	if got, want := layout(child), layout(m); got != want {
+		t.Errorf("child RAM slots %s, want %s", got, want)
+	}
+	// the guards are independent
+	if err := child.Unguard(-1, pa); err != nil {
+		t.Fatal(err)
+	}
+	if len(child.vm.ramSlots) != 1 || len(m.vm.ramSlots) != 3 {
+		t.Errorf("unguarding the child left %d slots in it and %d in the parent", len(child.vm.ramSlots), len(m.vm.ramSlots))
+	}
+}
+
+func TestForkRefusesRegions(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	r, err := m.AddRegion(physRamBase+m.MaxMemory(), 0x1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child, err := m.Fork(); err == nil {
+		child.Close()
+		t.Fatal("forked a machine with a memory region")
+	}
+	if err := m.RemoveRegion(r); err != nil {
+		t.Fatal(err)
+	}
+	child, err := m.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child.Close()
+}
+
+// BenchmarkFork measures forking a machine that wrote to its RAM since the
+// previous fork, which copies RAM to a new template.
+func BenchmarkFork(b *testing.B) {
+	for _, size := range []int64{16 << 20, 256 << 20} {
+		b.Run(fmt.Sprintf("%dM", size>>20), func(b *testing.B) {
+			m, err := NewMachine("/dev/kvm", 1, size, nil)
+			if err != nil {
+				b.Skip(err)
+			}
+			defer m.Close()
+			// half of RAM is in use
+			fill := bytes.Repeat([]byte{1}, int(size/2))
+			copy(m.Slice(physRamBase, physRamBase+uint64(len(fill))), fill)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.Slice(physRamBase, physRamBase+1)[0]++
+				child, err := m.Fork()
+				if err != nil {
+					b.Fatal(err)
+				}
+				child.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// GuardError is returned when a vCPU writes to guarded memory. The write is
+// not performed and the vCPU stops.
+type GuardError struct {
+	CPU  int
+	Addr uint64
+	Data []byte
+	Regs string
+}
+
+func (e *GuardError) Error() string {
+	return fmt.Sprintf("CPU %d: write of %d bytes to guarded memory at %#x (data=% x)\n%s", e.CPU, len(e.Data), e.Addr, e.Data, e.Regs)
+}
+
+// Guard makes the whole pages of guest RAM that the guest-physical range
+// [pa, pa+n) touches read-only, so that a vCPU that writes to them stops
+// with a GuardError. Writes by the host are not checked. The range may not
+// overlap another guard. Guards are copied by Fork but not kept in
+// snapshots.
+//
+// The other vCPUs are paused while RAM is remapped. cpu is the vCPU whose
+// hypercall handler calls Guard, or -1 when it is not called from a
+// hypercall handler.
+func (m *Machine) Guard(cpu int, pa, n uint64) error {
+	start, end, err := m.guardRange(pa, n)
+	if err != nil {
+		return err
+	}
+	if err := m.pauseOthers(cpu); err != nil {
+		return err
+	}
+	defer m.resumeOthers(cpu)
+	m.dirtyLock.Lock()
+	defer m.dirtyLock.Unlock()
+	m.memLock.Lock()
+	defer m.memLock.Unlock()
+
+	if end > m.vm.plugged {
+		return fmt.Errorf("guest physical range [%#x, %#x) is not RAM", pa, pa+n)
+	}
+	// the slots that the guard splits
+	slots := m.vm.ramSlots
+	i := 0
+	for slots[i].off+slots[i].size <= start {
+		i++
+	}
+	j := i
+	for j < len(slots) && slots[j].off < end {
+		if slots[j].readonly {
+			return fmt.Errorf("guest physical range [%#x, %#x) overlaps a guard", pa, pa+n)
+		}
+		j++
+	}
+	var split []ramSlot
+	if first := slots[i]; first.off < start {
+		split = append(split, ramSlot{off: first.off, size: start - first.off})
+	}
+	split = append(split, ramSlot{off: start, size: end - start, readonly: true})
+	if last := slots[j-1]; last.off+last.size > end {
+		split = append(split, ramSlot{off: end, size: last.off + last.size - end})
+	}
+	return m.replaceRAMSlots(i, j, split)
+}
+
+// Unguard removes the guard starting at the page containing the
+// guest-physical address pa. cpu is as for Guard.
+func (m *Machine) Unguard(cpu int, pa uint64) error {
+	start, _, err := m.guardRange(pa, 1)
+	if err != nil {
+		return err
+	}
+	if err := m.pauseOthers(cpu); err != nil {
+		return err
+	}
+	defer m.resumeOthers(cpu)
+	m.dirtyLock.Lock()
+	defer m.dirtyLock.Unlock()
+	m.memLock.Lock()
+	defer m.memLock.Unlock()
+
+	slots := m.vm.ramSlots
+	k := 0
+	for k < len(slots) && !(slots[k].readonly && slots[k].off == start) {
+		k++
+	}
+	if k == len(slots) {
+		return fmt.Errorf("no guard at %#x", pa)
+	}
+	// merge the guarded RAM with the RAM around it
+	i, j := k, k+1
+	if i > 0 && !slots[i-1].readonly {
+		i--
+	}
+	if j < len(slots) && !slots[j].readonly {
+		j++
+	}
+	merged := ramSlot{off: slots[i].off, size: slots[j-1].off + slots[j-1].size - slots[i].off}
+	return m.replaceRAMSlots(i, j, []ramSlot{merged})
+}
+
+// guardRange returns the offsets into RAM of the pages that [pa, pa+n)
+// touches.
+func (m *Machine) guardRange(pa, n uint64) (uint64, uint64, error) {
+	pagesize := uint64(os.Getpagesize())
+	if pa < physRamBase || n == 0 || pa+n < pa || pa+n-physRamBase > m.MaxMemory() {
+		return 0, 0, fmt.Errorf("guest physical range [%#x, %#x) is not RAM", pa, pa+n)
+	}
+	start := (pa - physRamBase) / pagesize * pagesize
+	end := (pa + n - physRamBase + pagesize - 1) / pagesize * pagesize
+	return start, end, nil
+}
+
+// replaceRAMSlots replaces the RAM slots [i, j) with slots covering the same
+// RAM. The pages that the old slots logged as dirty are kept as written by
+// the host. If remapping fails, the old slots are mapped again. Must be
+// called with dirtyLock and memLock held and the vCPUs paused, since the RAM
+// is missing while it is remapped.
+func (m *Machine) replaceRAMSlots(i, j int, slots []ramSlot) error {
+	vm := m.vm
+	old := vm.ramSlots[i:j]
+	if m.dirtyLogging {
+		pagesize := uint64(os.Getpagesize())
+		bitmap := make([]uint64, m.DirtyBitmapSize()/8)
+		for _, s := range old {
+			if err := vm.slotDirty(s, bitmap); err != nil {
+				return err
+			}
+			for page := s.off / pagesize; page < (s.off+s.size)/pagesize; page++ {
+				if bitmap[page/64]&(1<<(page%64)) != 0 {
+					m.markDirty(page*pagesize, pagesize)
+				}
+			}
+		}
+	}
+
+	// the old slots keep their numbers until the new ones are mapped
+	ramSlots := make([]ramSlot, 0, len(vm.ramSlots)-len(old)+len(slots))
+	ramSlots = append(ramSlots, vm.ramSlots[:i]...)
+	for _, s := range slots {
+		s.slot = vm.allocSlot()
+		ramSlots = append(ramSlots, s)
+	}
+	ramSlots = append(ramSlots, vm.ramSlots[j:]...)
+	added := ramSlots[i : i+len(slots)]
+
+	removed, mapped := 0, 0
+	err := func() error {
+		for ; removed < len(old); removed++ {
+			s := old[removed]
+			if err := vm.setRAMSlot(ramSlot{slot: s.slot, off: s.off}, 0); err != nil {
+				return err
+			}
+		}
+		for ; mapped < len(added); mapped++ {
+			if err := vm.setRAMSlot(added[mapped], vm.ramFlags); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		for _, s := range added[:mapped] {
+			vm.setRAMSlot(ramSlot{slot: s.slot, off: s.off}, 0)
+		}
+		for _, s := range old[:removed] {
+			vm.setRAMSlot(s, vm.ramFlags)
+		}
+		for _, s := range added {
+			delete(vm.slots, s.slot)
+		}
+		return err
+	}
+	for _, s := range old {
+		delete(vm.slots, s.slot)
+	}
+	vm.ramSlots = ramSlots
+	return nil
+}
+
+// pauseOthers pauses the vCPUs other than cpu, or all of them if cpu is -1.
+// A hypercall handler cannot wait for a concurrent Pause, which waits for
+// the handler to return, so it fails instead.
+func (m *Machine) pauseOthers(cpu int) error {
+	if cpu < 0 {
+		m.Pause()
+		return nil
+	}
+	if !m.pauseMu.TryLock() {
+		return errors.New("the machine is being paused")
+	}
+	m.pauseVCPUs(cpu)
+	return nil
+}
+
+func (m *Machine) resumeOthers(cpu int) {
+	if cpu < 0 {
+		m.Resume()
+		return
+	}
+	m.resumeVCPUs(cpu)
+	m.pauseMu.Unlock()
+}
+
+// checkGuard returns a GuardError if an MMIO exit is a write to guarded
+// memory.
+func (m *Machine) checkGuard(cpu int) error {
+	mmio := m.runs[cpu].mmio()
+	if mmio.IsWrite == 0 || mmio.PhysAddr < physRamBase || mmio.PhysAddr-physRamBase >= m.MaxMemory() {
+		return nil
+	}
+	off := mmio.PhysAddr - physRamBase
+	m.memLock.RLock()
+	guarded := false
+	for _, s := range m.vm.ramSlots {
+		if s.readonly && off >= s.off && off < s.off+s.size {
+			guarded = true
+		}
+	}
+	m.memLock.RUnlock()
+	if !guarded {
+		return nil
+	}
+	data := mmio.Data[:min(int(mmio.Len), len(mmio.Data))]
+	return &GuardError{
+		CPU:  cpu,
+		Addr: mmio.PhysAddr,
+		Data: append([]byte(nil), data...),
+		Regs: m.dumpRegs(cpu),
+	}
+}
@@ -0,0 +1,40 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestGuardWrite(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	const pa = physRamBase + 0x20_0000
+	code := []byte{
+		0xc7, 0x05, 0, 0, 0x20, 0x40, 0xef, 0xbe, 0xad, 0xde, // mov dword [pa], 0xdeadbeef
+	}
+	code = append(code, doneCode...)
+	if err := m.Guard(-1, pa, 4); err != nil {
+		t.Fatal(err)
+	}
+	var gerr *GuardError
+	if err := runCode(t, m, code); !errors.As(err, &gerr) {
+		t.Fatalf("guarded write returned %v, want a GuardError", err)
+	}
+	if gerr.Addr != pa || !bytes.Equal(gerr.Data, []byte{0xef, 0xbe, 0xad, 0xde}) {
+		t.Errorf("GuardError for a write of % x at %#x", gerr.Data, gerr.Addr)
+	}
+	if v := binary.LittleEndian.Uint32(m.Slice(pa, pa+4)); v != 0 {
+		t.Errorf("guarded memory was written: %#x", v)
+	}
+
+	if err := m.Unguard(-1, pa); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCode(t, m, code); err != nil {
+		t.Fatal(err)
+	}
+	if v := binary.LittleEndian.Uint32(m.Slice(pa, pa+4)); v != 0xdeadbeef {
+		t.Errorf("unguarded memory holds %#x", v)
+	}
+}
@@ -0,0 +1,66 @@
+package kvm
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGuardOverlap(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	pagesize := uint64(os.Getpagesize())
+	const pa = physRamBase + 0x20_0000
+	if err := m.Guard(-1, pa, 2*pagesize); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]ramSlot(nil), m.vm.ramSlots...)
+	for _, r := range [][2]uint64{
+		{pa, 1},
+		{pa + pagesize, 2 * pagesize},
+		{pa - pagesize, pagesize + 1},
+		{pa - pagesize, 4 * pagesize},
+	} {
+		if err := m.Guard(-1, r[0], r[1]); err == nil {
+			t.Errorf("guarded [%#x, %#x), which overlaps a guard", r[0], r[0]+r[1])
+		}
+	}
+	if len(m.vm.ramSlots) != len(want) {
+		t.Fatalf("rejected guards changed the RAM slots to %+v, want %+v", m.vm.ramSlots, want)
+	}
+	for i := range want {
+		if m.vm.ramSlots[i] != want[i] {
+			t.Fatalf("rejected guards changed the RAM slots to %+v, want %+v", m.vm.ramSlots, want)
+		}
+	}
+	// guards may touch
+	if err := m.Guard(-1, pa+2*pagesize, pagesize); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnguardMerges(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	pagesize := uint64(os.Getpagesize())
+	before := append([]ramSlot(nil), m.vm.ramSlots...)
+	const pa = physRamBase + 0x20_0000
+	for _, g := range []uint64{pa, pa + pagesize, pa + 4*pagesize, physRamBase} {
+		if err := m.Guard(-1, g, pagesize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, g := range []uint64{pa + pagesize, physRamBase, pa + 4*pagesize, pa} {
+		if err := m.Unguard(-1, g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.vm.ramSlots) != len(before) {
+		t.Fatalf("RAM slots %+v after removing the guards, want %d", m.vm.ramSlots, len(before))
+	}
+	for i, s := range m.vm.ramSlots {
+		if s.readonly || s.off != before[i].off || s.size != before[i].size {
+			t.Errorf("RAM slot %+v after removing the guards, want %+v", s, before[i])
+		}
+	}
+	if err := m.Unguard(-1, pa); err == nil {
+		t.Error("removed a guard that does not exist")
+	}
+}
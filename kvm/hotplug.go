@@ -0,0 +1,68 @@
+package kvm
+
+import (
+	"fmt"
+	"os"
+)
+
+// memoryBlock returns the granularity at which RAM is added to the guest.
+// Blocks span a multiple of 64 pages so that the dirty log of each RAM slot
+// starts at a word of the machine's bitmap.
+func memoryBlock() uint64 {
+	return max(2<<20, 64*uint64(os.Getpagesize()))
+}
+
+// Memory returns the amount of RAM the guest has, starting at the base of
+// RAM.
+func (m *Machine) Memory() uint64 {
+	m.memLock.RLock()
+	defer m.memLock.RUnlock()
+	return m.vm.plugged
+}
+
+// MaxMemory returns the memory size the machine was created with, up to
+// which its RAM can grow.
+func (m *Machine) MaxMemory() uint64 {
+	return uint64(len(m.vm.mem))
+}
+
+// SetInitialMemory gives the guest only the first size bytes of RAM, rounded
+// up to a whole number of blocks, so that it can start small and grow with
+// GrowMemory. It must be called before the kernel is loaded.
+func (m *Machine) SetInitialMemory(size uint64) error {
+	block := memoryBlock()
+	size = (size + block - 1) / block * block
+	if size == 0 || size > m.MaxMemory() {
+		return fmt.Errorf("initial memory of %d bytes is not between 1 and %d bytes", size, m.MaxMemory())
+	}
+	m.memLock.Lock()
+	defer m.memLock.Unlock()
+	return m.vm.resetRAM(size)
+}
+
+// GrowMemory adds at least n bytes of RAM, rounded up to a whole number of
+// blocks, after the RAM the guest already has, but never more than the memory
+// size the machine was created with. It returns the new amount of RAM. The
+// guest is not told about the new memory, which reads as zero unless RAM is
+// poisoned.
+func (m *Machine) GrowMemory(n uint64) (uint64, error) {
+	m.memLock.Lock()
+	defer m.memLock.Unlock()
+	limit := uint64(len(m.vm.mem))
+	if n == 0 || m.vm.plugged == limit {
+		return 0, fmt.Errorf("cannot grow %d bytes of RAM by %d bytes, the limit is %d bytes", m.vm.plugged, n, limit)
+	}
+	block := memoryBlock()
+	// n is limited before rounding up, which could overflow
+	room := limit - m.vm.plugged
+	size := min((min(n, room)+block-1)/block*block, room)
+	off := m.vm.plugged
+	if err := m.vm.plugRAM(size); err != nil {
+		return 0, err
+	}
+	if m.poisoning {
+		poisonRAM(m.vm.mem[off:off+size], m.poison)
+		m.markDirty(off, size)
+	}
+	return m.vm.plugged, nil
+}
@@ -0,0 +1,54 @@
+package kvm
+
+import "testing"
+
+func TestGrowMemoryHuge(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	if err := m.SetInitialMemory(memoryBlock()); err != nil {
+		t.Fatal(err)
+	}
+	// rounding up a size near 2^64 must not wrap to 0
+	size, err := m.GrowMemory(^uint64(0) - 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != m.MaxMemory() || m.Memory() != m.MaxMemory() {
+		t.Errorf("grew to %d bytes, want %d", size, m.MaxMemory())
+	}
+	if _, err := m.GrowMemory(1); err == nil {
+		t.Error("grew beyond the memory size")
+	}
+}
+
+func TestSliceUnplugged(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	block := memoryBlock()
+	if err := m.SetInitialMemory(block); err != nil {
+		t.Fatal(err)
+	}
+	end := physRamBase + block
+	if _, err := m.PhysSlice(end-8, 16); err == nil {
+		t.Error("PhysSlice returned unplugged RAM")
+	}
+	if b := m.SliceEnd(end - 8); len(b) != 8 {
+		t.Errorf("SliceEnd returned %d bytes, want the 8 before the end of RAM", len(b))
+	}
+	if b := m.SliceEnd(end); b != nil {
+		t.Errorf("SliceEnd returned %d bytes of unplugged RAM", len(b))
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Slice returned unplugged RAM")
+			}
+		}()
+		m.Slice(end, end+8)
+	}()
+
+	if _, err := m.GrowMemory(block); err != nil {
+		t.Fatal(err)
+	}
+	if b := m.Slice(end, end+8); len(b) != 8 {
+		t.Errorf("Slice returned %d bytes of plugged RAM", len(b))
+	}
+}
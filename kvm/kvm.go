@@ -64,8 +64,9 @@ const (
 	kvmX86SetupMCE           = 0x9C
 	kvmX86GetMCECapSupported = 0x9D
 
-	kvmGetOneReg = 0xAB
-	kvmSetOneReg = 0xAC
+	kvmGetOneReg  = 0xAB
+	kvmSetOneReg  = 0xAC
+	kvmGetRegList = 0xB0
 
 	kvmGetPIT2 = 0x9F
 	kvmSetPIT2 = 0xA0
@@ -79,6 +80,9 @@ const (
 	kvmSetTSCKHz = 0xA2
 	kvmGetTSCKHz = 0xA3
 
+	kvmGetXSAVE = 0xA4
+	kvmSetXSAVE = 0xA5
+
 	kvmGetXCRS = 0xA6
 	kvmSetXCRS = 0xA7
 
@@ -115,6 +119,7 @@ const (
 	ExitDCR           ExitType = 15
 	ExitNMI           ExitType = 16
 	ExitInternalError ExitType = 17
+	ExitSystemEvent   ExitType = 24
 )
 
 const (
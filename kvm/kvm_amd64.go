@@ -53,7 +53,12 @@ const (
 	kernBase     = 0xffff_8000_0000_0000
 	kernTextBase = 0xffff_ffff_8000_0000
 
-	SignalIRQ = 1
+	sysMemfdCreate = 319
+
+	// IOAPIC pins 1-3 are not wired to an emulated device, so the host may
+	// raise them to signal the guest; pin 1 signals a host signal.
+	SignalIRQ  = 1
+	SignalIRQs = 3
 )
 
 // SetIdentityMapAddr sets the address of a 4k-sized-page for a vm.
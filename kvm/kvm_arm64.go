@@ -12,6 +12,7 @@ const (
 	kvmArmVcpuInit        = 0xAE
 	kvmArmPreferredTarget = 0xAF
 	kvmArmVCPUFinalize    = 0xC2
+	kvmArmVCPUPowerOff    = 0
 	kvmArmVCPUPSCI0_2     = 2
 	kvmArmVCPUPMUV3       = 2
 	kvmArmSetDeviceAddr   = 0xAB
@@ -22,7 +23,13 @@ const (
 
 	kernBase = 0xffff_0000_0000_0000
 
-	SignalIRQ = 16
+	sysMemfdCreate = 279
+
+	// PPIs 16-22 are below the ones the architected timers and PMU use, so
+	// the host may raise them to signal the guest; PPI 16 signals a host
+	// signal.
+	SignalIRQ  = 16
+	SignalIRQs = 7
 )
 
 func ka2pa(ka uint64) uint64 {
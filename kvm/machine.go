@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 )
@@ -19,24 +20,95 @@ type HypercallHandler interface {
 }
 
 type Machine struct {
+	devkvm  *os.File
 	kvmfd   uintptr
+	runSize int
 	irqfd   uintptr
 	vm      *vm
 	runs    []*RunData
 	handler HypercallHandler
+	mmio    bus
+	pio     bus
+	virtio  []*virtioMMIO
+
+	// thread IDs of the running vCPUs, used to kick them out of the guest
+	tids []atomic.Int32
+	// start[cpu] is closed when an application processor is started
+	start    []chan struct{}
+	started  []atomic.Bool
+	stopc    chan struct{}
+	stopOnce sync.Once
+
+	// runLocks are held by vCPU threads while they run and by Pause while
+	// the machine is paused
+	runLocks  []sync.Mutex
+	pauseMu   sync.Mutex
+	pauseLock sync.Mutex
+	pauseCond *sync.Cond
+	pausing   atomic.Bool
+
+	// ramChanged is cleared when RAM is frozen as a template by Fork and set
+	// when the vCPUs run again or the host writes to RAM
+	ramChanged atomic.Bool
+
+	dirtyLogging bool
+	dirtyLock    sync.Mutex
+	// pages written by the host, tracked while dirty logging is enabled
+	hostDirty []atomic.Uint64
+	trackHost atomic.Bool
+	// pages dirtied since the last call to DirtyPages
+	guestDirty []uint64
+	// pages dirtied since the last snapshot, nil if there is none to take
+	// deltas against, and the ID of that snapshot
+	snapDirty []uint64
+	snapID    uint64
+	// pages dirtied since the last round of a migration, nil if none is in
+	// progress
+	migrateDirty []uint64
+
+	// pages released by the guest that it has not used since they were last
+	// checked by MemoryStats
+	released    []uint64
+	releaseLock sync.Mutex
+
+	// memLock protects the RAM slots, the regions and the poison settings
+	memLock sync.RWMutex
+	regions []*Region
+
+	// pattern that new and, if poisonFreed is set, released RAM is filled
+	// with when poisoning is set
+	poison      uint64
+	poisoning   bool
+	poisonFreed bool
+
+	// host CPUs that each vCPU thread is pinned to, nil if unpinned
+	affinity     []*cpuSet
+	affinityLock sync.Mutex
 }
 
 func NewMachine(kvmPath string, ncpus int, memSize int64, handler HypercallHandler) (*Machine, error) {
+	return NewMachineHugepages(kvmPath, ncpus, memSize, HugepagesNone, handler)
+}
+
+// NewMachineHugepages is like NewMachine but backs guest RAM with huge pages
+// as selected by hugepages.
+func NewMachineHugepages(kvmPath string, ncpus int, memSize int64, hugepages Hugepages, handler HypercallHandler) (*Machine, error) {
 	devkvm, err := os.OpenFile(kvmPath, os.O_RDWR, 0o644)
 	if err != nil {
 		return nil, err
 	}
-	kvmfd := devkvm.Fd()
-	vm, err := NewVM(kvmfd, int64(memSize))
+	vm, err := NewVM(devkvm.Fd(), int64(memSize), hugepages)
 	if err != nil {
+		devkvm.Close()
 		return nil, err
 	}
+	return newMachine(devkvm, vm, ncpus, handler)
+}
 
+// newMachine creates the vCPUs and interrupt controller of a machine around
+// a VM.
+func newMachine(devkvm *os.File, vm *vm, ncpus int, handler HypercallHandler) (*Machine, error) {
+	kvmfd := devkvm.Fd()
 	if err := vm.init(); err != nil {
 		return nil, err
 	}
@@ -47,11 +119,25 @@ func NewMachine(kvmPath string, ncpus int, memSize int64, handler HypercallHandl
 	}
 
 	m := &Machine{
+		devkvm:  devkvm,
 		kvmfd:   kvmfd,
+		runSize: int(mmapSize),
 		vm:      vm,
 		runs:    make([]*RunData, ncpus),
 		handler: handler,
+		tids:    make([]atomic.Int32, ncpus),
+		start:   make([]chan struct{}, ncpus),
+		started: make([]atomic.Bool, ncpus),
+		stopc:   make(chan struct{}),
+
+		runLocks: make([]sync.Mutex, ncpus),
+
+		affinity: make([]*cpuSet, ncpus),
+	}
+	for cpu := range m.start {
+		m.start[cpu] = make(chan struct{})
 	}
+	m.pauseCond = sync.NewCond(&m.pauseLock)
 
 	err = m.createIrqController()
 	if err != nil {
@@ -88,11 +174,29 @@ func NewMachine(kvmPath string, ncpus int, memSize int64, handler HypercallHandl
 		return nil, err
 	}
 
-	// TODO: poison memory
-
 	return m, nil
 }
 
+// Close releases the VM, its vCPUs and its memory. The vCPUs must not be
+// running. Devices attached to the machine are not closed.
+func (m *Machine) Close() error {
+	for cpu, vcpu := range m.vm.vcpus {
+		syscall.Munmap(unsafe.Slice((*byte)(unsafe.Pointer(m.runs[cpu])), m.runSize))
+		syscall.Close(int(vcpu.fd))
+	}
+	if m.irqfd != 0 {
+		syscall.Close(int(m.irqfd))
+	}
+	for _, r := range m.regions {
+		r.mem.UnsafeUnmap()
+	}
+	m.vm.mem.UnsafeUnmap()
+	m.vm.sys.UnsafeUnmap()
+	syscall.Close(m.vm.memfd)
+	syscall.Close(int(m.vm.fd))
+	return m.devkvm.Close()
+}
+
 func (m *Machine) LoadKernel(kernel io.ReaderAt, args []string) error {
 	e, err := elf.NewFile(kernel)
 	if err != nil {
@@ -137,8 +241,12 @@ func (m *Machine) LoadKernel(kernel io.ReaderAt, args []string) error {
 	return nil
 }
 
+// StartVCPU runs a vCPU on its own goroutine. CPU 0 starts at the kernel
+// entry point; other CPUs wait until they are started by StartCPU or, on
+// arm64, by a PSCI CPU_ON call. When the vCPU exits, the whole machine is
+// stopped.
 func (m *Machine) StartVCPU(cpu int, trace bool, wg *sync.WaitGroup) {
-	m.SingleStep(trace)
+	m.vm.vcpus[cpu].SingleStep(trace)
 
 	go func(cpu int) {
 		var err error
@@ -156,10 +264,11 @@ func (m *Machine) StartVCPU(cpu int, trace bool, wg *sync.WaitGroup) {
 			} else {
 				fmt.Printf("%#x:%s\n", pc, s)
 			}
-			m.SingleStep(trace)
+			m.vm.vcpus[cpu].SingleStep(trace)
 		}
 
 		fmt.Fprintf(os.Stderr, "CPU %d exited (err=%v)\n", cpu, err)
+		m.Stop()
 		wg.Done()
 	}(cpu)
 }
@@ -184,20 +293,45 @@ func (m *Machine) RunInfiniteLoop(cpu int, trace bool) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	for {
+	unpin, err := m.pin(cpu)
+	if err != nil {
+		return err
+	}
+	defer unpin()
+
+	if err := m.waitStart(cpu); err != nil {
+		if errors.Is(err, errStopped) {
+			return nil
+		}
+		return err
+	}
+
+	m.runLocks[cpu].Lock()
+	defer m.runLocks[cpu].Unlock()
+	// clear kicks that arrived while the vCPU was not running; a stop is
+	// still seen by the loop condition
+	m.runs[cpu].ImmediateExit = 0
+	m.ramChanged.Store(true)
+
+	for !m.stopped() {
+		if m.pausing.Load() {
+			m.park(cpu)
+			continue
+		}
 		isContinue, err := m.RunOnce(cpu)
 		if isContinue {
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%v\n", err)
 			}
 
-			m.SingleStep(trace)
+			m.vm.vcpus[cpu].SingleStep(trace)
 
 			continue
 		}
 
 		return err
 	}
+	return nil
 }
 
 var (
@@ -216,6 +350,9 @@ func (m *Machine) RunOnce(cpu int) (bool, error) {
 
 	vcpu := m.vm.vcpus[cpu]
 
+	// KVM_RUN interrupted by a kick before entering the guest does not set
+	// the exit reason, which must not be taken for the previous exit again
+	m.runs[cpu].ExitReason = uint32(ExitIntr)
 	err := vcpu.Run()
 	if err != nil {
 		return false, err
@@ -225,12 +362,20 @@ func (m *Machine) RunOnce(cpu int) (bool, error) {
 	switch exit {
 	case ExitHlt:
 		return false, nil
-	case ExitMMIO, ExitIO:
+	case ExitMMIO:
+		if err := m.checkGuard(cpu); err != nil {
+			return false, err
+		}
+		if !m.isHypercall(m.runs[cpu].mmio()) {
+			return true, m.handleMMIO(cpu)
+		}
 		err := m.hypercall(cpu)
 		if err != nil {
 			return false, err
 		}
 		return true, nil
+	case ExitIO:
+		return true, m.handleIO(cpu)
 	case ExitUnknown:
 		return true, nil
 	case ExitIntr:
@@ -240,7 +385,7 @@ func (m *Machine) RunOnce(cpu int) (bool, error) {
 	case ExitDebug:
 		return false, ErrDebug
 	default:
-		return false, fmt.Errorf("%w: %v", ErrUnexpectedExitReason, ExitType(m.runs[cpu].ExitReason).String())
+		return false, m.exitError(cpu, exit)
 	}
 }
 
@@ -268,18 +413,57 @@ func (m *Machine) ReadBytes(cpu int, b []byte, vaddr uint64) (int, error) {
 	return m.ReadAt(b, int64(pa))
 }
 
+// SliceEnd returns the guest RAM from guest-physical address start to the
+// end of the RAM the guest has, or nil if start is not in it. It is meant
+// for reading, so writes through it are not seen by dirty logging.
 func (m *Machine) SliceEnd(start uint64) []byte {
-	return m.vm.mem[start-physRamBase:]
+	m.memLock.RLock()
+	defer m.memLock.RUnlock()
+	if start < physRamBase || start-physRamBase >= m.vm.plugged {
+		return nil
+	}
+	return m.vm.mem[start-physRamBase : m.vm.plugged]
 }
 
+// Slice is like PhysSlice for the guest-physical range [start, end), but
+// panics if the range is not memory. Ranges chosen by the guest should be
+// obtained with PhysSlice instead.
 func (m *Machine) Slice(start, end uint64) []byte {
-	return m.vm.mem[start-physRamBase : end-physRamBase]
+	b, err := m.PhysSlice(start, end-start)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// PhysSlice returns the guest-physical range [pa, pa+n), or an error if the
+// range is not backed by guest RAM or lies outside a single memory region.
+func (m *Machine) PhysSlice(pa, n uint64) ([]byte, error) {
+	m.memLock.RLock()
+	defer m.memLock.RUnlock()
+	if pa < physRamBase || pa+n < pa || pa+n-physRamBase > m.vm.plugged {
+		if b, ok := m.regionSlice(pa, n); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("guest physical range [%#x, %#x) is not memory", pa, pa+n)
+	}
+	m.markDirty(pa-physRamBase, n)
+	return m.vm.mem[pa-physRamBase : pa+n-physRamBase], nil
 }
 
 func (m *Machine) NCPU() int {
 	return len(m.vm.vcpus)
 }
 
+// RAMFd returns the memfd backing guest RAM, which other processes can map
+// through /proc/<pid>/fd to inspect guest memory. Guest-physical address pa
+// is at offset pa - 0x4000_0000. Once the machine has been forked, its RAM
+// is a private copy of the memfd, which holds the RAM at the time of the
+// fork. The fd is owned by the machine and must not be closed.
+func (m *Machine) RAMFd() int {
+	return m.vm.memfd
+}
+
 func showone(indent string, in interface{}) string {
 	var ret string
 
@@ -307,6 +491,20 @@ func show(indent string, l ...interface{}) string {
 	return ret
 }
 
+// irqLine returns a function that sets the level of an interrupt line, for
+// use by emulated devices.
+func (m *Machine) irqLine(irq uint32) func(level bool) {
+	return func(level bool) {
+		var l uint32
+		if level {
+			l = 1
+		}
+		if err := m.InjectIrq(irq, l); err != nil {
+			fmt.Fprintf(os.Stderr, "irq %d: %v\n", irq, err)
+		}
+	}
+}
+
 func (m *Machine) GetPc(cpu int) uint64 {
 	return m.vm.vcpus[cpu].GetPc()
 }
@@ -1,6 +1,7 @@
 package kvm
 
 import (
+	"fmt"
 	"unsafe"
 )
 
@@ -28,6 +29,29 @@ func (m *Machine) init() error {
 	return nil
 }
 
+const (
+	ioapicBase = 0xfec0_0000
+	lapicBase  = 0xfee0_0000
+
+	// virtio-mmio devices use IOAPIC pins 5-23.
+	virtioBase       = 0x0a00_0000
+	virtioIRQBase    = 5
+	virtioMaxDevices = 19
+)
+
+// reservedMMIO returns the guest-physical ranges that devices may not be
+// mapped at.
+func (m *Machine) reservedMMIO() []busRange {
+	return []busRange{
+		{base: physSysBase, size: uint64(len(m.vm.sys))},
+		{base: kvmIdentityMapStart, size: kvmIdentityMapSize},
+		{base: kvmTSSStart, size: 3 * 4096},
+		{base: ioapicBase, size: 4096},
+		{base: lapicBase, size: 4096},
+		{base: physRamBase, size: uint64(len(m.vm.mem))},
+	}
+}
+
 // setTSSAddr sets the Task Segment Selector for a vm.
 func (vm *vm) setTSSAddr(addr uint32) error {
 	_, err := Ioctl(vm.fd, IIO(kvmSetTSSAddr), uintptr(addr))
@@ -35,9 +59,12 @@ func (vm *vm) setTSSAddr(addr uint32) error {
 	return err
 }
 
+// SetupRegs prepares every vCPU to enter the kernel in long mode. The CPU ID
+// is passed in rdx. Only CPU 0 starts at rip; the others are started later
+// with StartCPU.
 func (m *Machine) SetupRegs(rip, argc, argv uint64) error {
-	for _, cpu := range m.vm.vcpus {
-		if err := cpu.initRegs(rip, argc, argv, uint64(len(m.vm.mem))); err != nil {
+	for i, cpu := range m.vm.vcpus {
+		if err := cpu.initRegs(rip, argc, argv, m.Memory(), uint64(i)); err != nil {
 			return err
 		}
 		if err := cpu.initSregs(m.vm.mem); err != nil {
@@ -47,6 +74,67 @@ func (m *Machine) SetupRegs(rip, argc, argv uint64) error {
 	return nil
 }
 
+const (
+	mpStateRunnable = 0
+)
+
+func (vcpu *vcpu) setMPState(state uint32) error {
+	mp := mpState{state: state}
+	_, err := Ioctl(vcpu.fd, IIOW(kvmSetMPState, unsafe.Sizeof(mp)), uintptr(unsafe.Pointer(&mp)))
+	if err != nil {
+		return fmt.Errorf("KVM_SET_MP_STATE: %w", err)
+	}
+	return nil
+}
+
+// StartCPU releases an application processor held at boot. It starts at
+// the physical address entry in the same flat protected mode as the boot
+// CPU, with arg in rdi and its CPU ID in rdx.
+func (m *Machine) StartCPU(cpu int, entry, arg uint64) error {
+	if err := m.checkAP(cpu); err != nil {
+		return err
+	}
+	if !m.started[cpu].CompareAndSwap(false, true) {
+		return fmt.Errorf("CPU %d already started", cpu)
+	}
+
+	// The AP is not in KVM_RUN, so its state can be set from this thread.
+	// Holding its run lock keeps a concurrent snapshot consistent.
+	m.runLocks[cpu].Lock()
+	defer m.runLocks[cpu].Unlock()
+	vcpu := &m.vm.vcpus[cpu]
+	regs, err := vcpu.GetRegs()
+	if err != nil {
+		return err
+	}
+	regs.Rip = entry
+	regs.Rdi = arg
+	regs.Rdx = uint64(cpu)
+	if err := vcpu.SetRegs(regs); err != nil {
+		return err
+	}
+	// APs start in the wait-for-SIPI state with the in-kernel LAPIC.
+	if err := vcpu.setMPState(mpStateRunnable); err != nil {
+		return err
+	}
+	close(m.start[cpu])
+	return nil
+}
+
+// waitStart blocks an application processor until it is started. It
+// returns immediately once the processor has been started.
+func (m *Machine) waitStart(cpu int) error {
+	if cpu == 0 {
+		return nil
+	}
+	select {
+	case <-m.start[cpu]:
+		return nil
+	case <-m.stopc:
+		return errStopped
+	}
+}
+
 func (m *Machine) initCPUID(cpu int) error {
 	cpuid := CPUID{
 		Nent:    100,
@@ -0,0 +1,37 @@
+package kvm
+
+import "testing"
+
+// codeBase is where runCode places guest code.
+const codeBase = physRamBase + 0x10_0000
+
+// doneCode ends code run by runCode by writing to doneCode's port. HLT
+// cannot end it because the in-kernel LAPIC handles HLT without an exit.
+var doneCode = []byte{0xe6, donePort} // out donePort, al
+
+const donePort = 0xf4
+
+// runCode runs 32-bit code on CPU 0 of m, which starts in flat protected
+// mode without paging, until it runs doneCode. Hypercalls are handled by
+// the machine's handler.
+func runCode(t *testing.T, m *Machine, code []byte) error {
+	t.Helper()
+	copy(m.Slice(codeBase, codeBase+uint64(len(code))), code)
+	if err := m.SetupRegs(codeBase, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	// as in RunInfiniteLoop, kicks from pausing the machine before do not
+	// apply to this run
+	m.runs[0].ImmediateExit = 0
+	for {
+		cont, err := m.RunOnce(0)
+		if ExitType(m.runs[0].ExitReason) == ExitIO {
+			if pio := m.runs[0].io(); pio.Port == donePort && pio.Direction == exitIOOut {
+				return nil
+			}
+		}
+		if !cont || err != nil {
+			return err
+		}
+	}
+}
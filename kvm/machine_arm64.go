@@ -24,7 +24,12 @@ func (m *Machine) init() error {
 	if ok, err := CheckExtension(m.kvmfd, CapARMPMUV3); err == nil && ok == 1 {
 		init.features[0] |= (1 << kvmArmVCPUPMUV3)
 	}
-	for _, vcpu := range m.vm.vcpus {
+	for i, vcpu := range m.vm.vcpus {
+		init := init
+		if i != 0 {
+			// secondary CPUs wait for PSCI CPU_ON
+			init.features[0] |= (1 << kvmArmVCPUPowerOff)
+		}
 		_, err = Ioctl(vcpu.fd, IIOW(kvmArmVcpuInit, unsafe.Sizeof(VcpuInit{})), uintptr(unsafe.Pointer(&init)))
 		if err != nil {
 			return fmt.Errorf("KVM_ARM_VCPU_INIT: %w", err)
@@ -33,12 +38,33 @@ func (m *Machine) init() error {
 	return nil
 }
 
+const (
+	// virtio-mmio devices use SPIs 16-47.
+	virtioBase       = 0x0a00_0000
+	virtioIRQBase    = 48
+	virtioMaxDevices = 32
+)
+
+// reservedMMIO returns the guest-physical ranges that devices may not be
+// mapped at.
+func (m *Machine) reservedMMIO() []busRange {
+	return []busRange{
+		{base: physSysBase, size: uint64(len(m.vm.sys))},
+		{base: _GIC_DIST_BASE, size: _GIC_DIST_SIZE},
+		{base: _GIC_REDIST_CPUI_BASE, size: _GIC_REDIST_CPUI_SIZE * uint64(len(m.runs))},
+		{base: physRamBase, size: uint64(len(m.vm.mem))},
+	}
+}
+
+// SetupRegs sets the boot registers of every vCPU, with the CPU ID in x3.
+// Only CPU 0 is powered on; the guest starts the others with PSCI CPU_ON,
+// which resets them to the requested entry point with the context ID in x0.
 func (m *Machine) SetupRegs(pc, argc, argv uint64) error {
-	for _, cpu := range m.vm.vcpus {
+	for i, cpu := range m.vm.vcpus {
 		if err := cpu.SetPc(pc); err != nil {
 			return err
 		}
-		if err := cpu.SetReg(0, uint64(len(m.vm.mem))); err != nil {
+		if err := cpu.SetReg(0, m.Memory()); err != nil {
 			return err
 		}
 		if err := cpu.SetReg(1, argc); err != nil {
@@ -47,10 +73,28 @@ func (m *Machine) SetupRegs(pc, argc, argv uint64) error {
 		if err := cpu.SetReg(2, argv); err != nil {
 			return err
 		}
+		if err := cpu.SetReg(3, uint64(i)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// StartCPU is not supported on arm64, where secondary CPUs are held powered
+// off inside KVM and must be started with PSCI CPU_ON.
+func (m *Machine) StartCPU(cpu int, entry, arg uint64) error {
+	if err := m.checkAP(cpu); err != nil {
+		return err
+	}
+	return fmt.Errorf("CPU %d must be started with PSCI CPU_ON", cpu)
+}
+
+// waitStart returns immediately: KVM blocks powered-off vCPUs in KVM_RUN
+// until they receive CPU_ON.
+func (m *Machine) waitStart(cpu int) error {
+	return nil
+}
+
 func (m *Machine) hypercall(cpu int) error {
 	vcpu := m.vm.vcpus[cpu]
 	r0, err := m.handler.Hypercall(m, cpu, vcpu.GetReg(8), vcpu.GetReg(0), vcpu.GetReg(1), vcpu.GetReg(2), vcpu.GetReg(3), vcpu.GetReg(4), vcpu.GetReg(5))
@@ -0,0 +1,27 @@
+package kvm
+
+import "testing"
+
+// newTestMachine creates a machine with one vCPU, or skips the test if KVM
+// is not available.
+func newTestMachine(t *testing.T, memSize int64) *Machine {
+	t.Helper()
+	m, err := NewMachine("/dev/kvm", 1, memSize, nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestRunOnceKickedBeforeEntry(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	// a kick makes KVM_RUN return before entering the guest, leaving the
+	// previous exit in the run structure
+	m.runs[0].ExitReason = uint32(ExitHlt)
+	m.runs[0].ImmediateExit = 1
+	cont, err := m.RunOnce(0)
+	if !cont || err != nil {
+		t.Fatalf("RunOnce: got %v, %v, want the vCPU to continue", cont, err)
+	}
+}
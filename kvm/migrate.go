@@ -0,0 +1,166 @@
+package kvm
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	// pre-copy ends after migrateRounds rounds or once a round leaves fewer
+	// than migrateStopPages dirty pages, which are then copied while the
+	// machine is paused
+	migrateRounds    = 16
+	migrateStopPages = 256
+
+	// sent by the destination once it has restored the machine
+	migrateAck = 1
+)
+
+// MigrateTo moves the machine to the process that calls AcceptMigration on
+// the other end of conn. Guest RAM is copied while the guest keeps running,
+// followed by rounds that copy the pages dirtied in the meantime. Once few
+// dirty pages remain, the machine is paused for a final copy of them and of
+// the vCPU, VM and handler state, as in Snapshot. When the destination has
+// restored the machine, this machine is stopped; if migration fails, it
+// resumes. Device state is not transferred. MigrateTo must not be called
+// from a hypercall handler.
+func (m *Machine) MigrateTo(conn io.ReadWriter) error {
+	if err := m.EnableDirtyLogging(); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(conn)
+	hdr := m.snapshotHeader(snapshotMigration)
+	if _, err := bw.Write(rawBytes(&hdr)); err != nil {
+		return err
+	}
+
+	// pages written during the first copy are sent again by the next round
+	if err := m.trackMigration(true); err != nil {
+		return err
+	}
+	defer m.trackMigration(false)
+	if err := m.writeRAM(bw); err != nil {
+		return err
+	}
+	for round := 0; round < migrateRounds; round++ {
+		dirty, err := m.migrationDirty()
+		if err != nil {
+			return err
+		}
+		if err := m.writeDirtyRAM(bw, dirty); err != nil {
+			return err
+		}
+		if countPages(dirty) < migrateStopPages {
+			break
+		}
+	}
+
+	m.Pause()
+	if err := m.stopAndCopy(bw, conn); err != nil {
+		m.Resume()
+		return err
+	}
+	m.Stop()
+	m.Resume()
+	return nil
+}
+
+// stopAndCopy sends the rest of a paused machine and waits for the
+// destination to acknowledge it.
+func (m *Machine) stopAndCopy(bw *bufio.Writer, conn io.Reader) error {
+	dirty, err := m.migrationDirty()
+	if err != nil {
+		return err
+	}
+	if err := m.writeDirtyRAM(bw, dirty); err != nil {
+		return err
+	}
+	if err := endRAM(bw); err != nil {
+		return err
+	}
+	if err := m.writeState(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	var ack [1]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		return err
+	}
+	if ack[0] != migrateAck {
+		return errors.New("migration was not acknowledged")
+	}
+	return nil
+}
+
+// trackMigration starts or stops tracking the pages that a migration must
+// send again. Only one migration may be in progress at a time.
+func (m *Machine) trackMigration(on bool) error {
+	m.dirtyLock.Lock()
+	defer m.dirtyLock.Unlock()
+	if !on {
+		m.migrateDirty = nil
+		return nil
+	}
+	if m.migrateDirty != nil {
+		return errors.New("a migration is already in progress")
+	}
+	// pages dirtied before the migration are sent by the first copy
+	if err := m.fetchDirty(); err != nil {
+		return err
+	}
+	m.migrateDirty = make([]uint64, m.DirtyBitmapSize()/8)
+	return nil
+}
+
+// migrationDirty returns the pages dirtied since the migration started
+// tracking them or since the previous call.
+func (m *Machine) migrationDirty() ([]uint64, error) {
+	m.dirtyLock.Lock()
+	defer m.dirtyLock.Unlock()
+	if err := m.fetchDirty(); err != nil {
+		return nil, err
+	}
+	return takeDirty(&m.migrateDirty), nil
+}
+
+// AcceptMigration receives a machine sent by MigrateTo over conn. The
+// handler's state is restored if it implements StateSaver. As with
+// RestoreMachine, the machine is ready to run with StartVCPU and devices must
+// be added again by the caller.
+func AcceptMigration(conn io.ReadWriter, handler HypercallHandler) (*Machine, error) {
+	br := bufio.NewReader(conn)
+	hdr, err := readSnapshotHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.kind != snapshotMigration {
+		return nil, errors.New("not a machine migration")
+	}
+	m, err := NewMachine("/dev/kvm", int(hdr.ncpus), int64(hdr.memSize), handler)
+	if err != nil {
+		return nil, err
+	}
+	started, state, err := m.restoreLayer(br)
+	if err != nil {
+		return nil, closeOnError(m, err)
+	}
+	if err := m.finishRestore(started, state); err != nil {
+		return nil, closeOnError(m, err)
+	}
+	if _, err := conn.Write([]byte{migrateAck}); err != nil {
+		return nil, closeOnError(m, err)
+	}
+	return m, nil
+}
+
+func countPages(bitmap []uint64) int {
+	n := 0
+	for _, w := range bitmap {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
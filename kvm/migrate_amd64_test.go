@@ -0,0 +1,86 @@
+package kvm
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// socketPair returns the two ends of a connected Unix socket.
+func socketPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]net.Conn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conns[i], err = net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conns[i].Close() })
+	}
+	return conns[0], conns[1]
+}
+
+func TestMigrate(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	const pa = physRamBase + 0x20_0000
+	code := []byte{
+		0xc7, 0x05, 0, 0, 0x20, 0x40, 0xef, 0xbe, 0xad, 0xde, // mov dword [pa], 0xdeadbeef
+		0xb8, 0x44, 0x33, 0x22, 0x11, // mov eax, 0x11223344
+	}
+	if err := m.EnableDirtyLogging(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.DirtyPages(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCode(t, m, append(code, doneCode...)); err != nil {
+		t.Fatal(err)
+	}
+
+	src, dst := socketPair(t)
+	done := make(chan error)
+	go func() { done <- m.MigrateTo(src) }()
+	r, err := AcceptMigration(dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Memory() != m.Memory() || !bytes.Equal(r.vm.mem, m.vm.mem) {
+		t.Error("migrated RAM differs")
+	}
+	want, err := m.vm.vcpus[0].GetRegs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	regs, err := r.vm.vcpus[0].GetRegs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *regs != *want || regs.Rax != 0x11223344 {
+		t.Errorf("migrated registers %+v, want %+v", *regs, *want)
+	}
+
+	// the migration does not take the pages the guest has yet to see
+	dirty, err := m.DirtyPages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dirtyPage(dirty, pa) {
+		t.Error("DirtyPages lost a page written before the migration")
+	}
+	if m.migrateDirty != nil {
+		t.Error("dirty pages still tracked for a finished migration")
+	}
+}
@@ -0,0 +1,111 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// LoopbackNet is a NetBackend that sends every frame transmitted by the guest
+// back to it.
+type LoopbackNet struct {
+	recv func([]byte)
+}
+
+func NewLoopbackNet() *LoopbackNet {
+	return &LoopbackNet{}
+}
+
+func (l *LoopbackNet) Attach(recv func([]byte)) {
+	l.recv = recv
+}
+
+func (l *LoopbackNet) Send(frame []byte) error {
+	if l.recv != nil {
+		l.recv(frame)
+	}
+	return nil
+}
+
+func (l *LoopbackNet) Close() error {
+	return nil
+}
+
+const (
+	pcapMagic    = 0xa1b2c3d4
+	pcapSnapLen  = 65535
+	pcapEthernet = 1
+)
+
+// PcapNet is a NetBackend that records all frames in both directions to a
+// pcap capture. If it wraps another backend, frames are passed through to it;
+// otherwise frames sent by the guest are only recorded.
+type PcapNet struct {
+	lock  sync.Mutex
+	w     io.Writer
+	inner NetBackend
+}
+
+// NewPcapNet writes a pcap header to w and returns a backend that records
+// traffic to w. The inner backend may be nil.
+func NewPcapNet(w io.Writer, inner NetBackend) (*PcapNet, error) {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapEthernet)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &PcapNet{
+		w:     w,
+		inner: inner,
+	}, nil
+}
+
+func (p *PcapNet) record(frame []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	n := min(len(frame), pcapSnapLen)
+	var hdr [16]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(n))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(frame)))
+	if _, err := p.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := p.w.Write(frame[:n])
+	return err
+}
+
+func (p *PcapNet) Attach(recv func([]byte)) {
+	if p.inner == nil {
+		return
+	}
+	p.inner.Attach(func(frame []byte) {
+		p.record(frame)
+		recv(frame)
+	})
+}
+
+func (p *PcapNet) Send(frame []byte) error {
+	if err := p.record(frame); err != nil {
+		return err
+	}
+	if p.inner == nil {
+		return nil
+	}
+	return p.inner.Send(frame)
+}
+
+func (p *PcapNet) Close() error {
+	if p.inner == nil {
+		return nil
+	}
+	return p.inner.Close()
+}
@@ -0,0 +1,175 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+const (
+	pl011DR    = 0x000
+	pl011RSR   = 0x004
+	pl011FR    = 0x018
+	pl011IBRD  = 0x024
+	pl011FBRD  = 0x028
+	pl011LCRH  = 0x02c
+	pl011CR    = 0x030
+	pl011IFLS  = 0x034
+	pl011IMSC  = 0x038
+	pl011RIS   = 0x03c
+	pl011MIS   = 0x040
+	pl011ICR   = 0x044
+	pl011DMACR = 0x048
+	pl011ID    = 0xfe0
+
+	pl011FRRXFE = 1 << 4
+	pl011FRTXFE = 1 << 7
+
+	pl011IntRX = 1 << 4
+	pl011IntTX = 1 << 5
+	pl011IntRT = 1 << 6
+
+	pl011Size = 0x1000
+)
+
+// PrimeCell peripheral and cell identification registers at 0xfe0-0xffc.
+var pl011IDs = [8]byte{0x11, 0x10, 0x14, 0x00, 0x0d, 0xf0, 0x05, 0xb1}
+
+// PL011 emulates an ARM PrimeCell UART. Transmitted bytes are written to out,
+// and bytes read from in are made available to the guest.
+type PL011 struct {
+	lock sync.Mutex
+	out  io.Writer
+	rx   []byte
+
+	ibrd, fbrd, lcrh, cr, ifls, imsc, dmacr uint32
+	ris                                     uint32
+
+	irq   func(level bool)
+	level bool
+}
+
+// NewPL011 creates a PL011 UART. If in is non-nil, a goroutine copies its
+// contents into the receive FIFO. The irq function is called whenever the
+// interrupt line changes level and may be nil.
+func NewPL011(in io.Reader, out io.Writer, irq func(level bool)) *PL011 {
+	u := &PL011{
+		out:  out,
+		irq:  irq,
+		cr:   0x300,
+		ifls: 0x12,
+		ris:  pl011IntTX,
+	}
+	if in != nil {
+		go receive(in, u.receive)
+	}
+	return u
+}
+
+func (u *PL011) receive(b []byte) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.rx = append(u.rx, b...)
+	u.ris |= pl011IntRX | pl011IntRT
+	u.update()
+}
+
+// update recomputes the interrupt line. Must be called with the lock held.
+func (u *PL011) update() {
+	level := u.ris&u.imsc != 0
+	if u.irq != nil && level != u.level {
+		u.level = level
+		u.irq(level)
+	}
+}
+
+func (u *PL011) Read(offset uint64, data []byte) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	var v uint32
+	switch {
+	case offset == pl011DR:
+		if len(u.rx) > 0 {
+			v = uint32(u.rx[0])
+			u.rx = u.rx[1:]
+		}
+		if len(u.rx) == 0 {
+			u.ris &^= pl011IntRX | pl011IntRT
+		}
+	case offset == pl011FR:
+		v = pl011FRTXFE
+		if len(u.rx) == 0 {
+			v |= pl011FRRXFE
+		}
+	case offset == pl011IBRD:
+		v = u.ibrd
+	case offset == pl011FBRD:
+		v = u.fbrd
+	case offset == pl011LCRH:
+		v = u.lcrh
+	case offset == pl011CR:
+		v = u.cr
+	case offset == pl011IFLS:
+		v = u.ifls
+	case offset == pl011IMSC:
+		v = u.imsc
+	case offset == pl011RIS:
+		v = u.ris
+	case offset == pl011MIS:
+		v = u.ris & u.imsc
+	case offset == pl011DMACR:
+		v = u.dmacr
+	case offset >= pl011ID && offset < pl011Size:
+		v = uint32(pl011IDs[(offset-pl011ID)/4%8])
+	}
+	putLE(data, uint64(v))
+	u.update()
+	return nil
+}
+
+func (u *PL011) Write(offset uint64, data []byte) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	v := uint32(getLE(data))
+	switch offset {
+	case pl011DR:
+		if u.out != nil {
+			u.out.Write([]byte{byte(v)})
+		}
+		u.ris |= pl011IntTX
+	case pl011IBRD:
+		u.ibrd = v
+	case pl011FBRD:
+		u.fbrd = v
+	case pl011LCRH:
+		u.lcrh = v
+	case pl011CR:
+		u.cr = v
+	case pl011IFLS:
+		u.ifls = v
+	case pl011IMSC:
+		u.imsc = v
+	case pl011ICR:
+		u.ris &^= v
+	case pl011DMACR:
+		u.dmacr = v
+	}
+	u.update()
+	return nil
+}
+
+// putLE stores the low len(data) bytes of v in data in little-endian order.
+func putLE(data []byte, v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	copy(data, buf[:])
+}
+
+// getLE loads a little-endian value of len(data) bytes.
+func getLE(data []byte) uint64 {
+	var buf [8]byte
+	copy(buf[:], data)
+	return binary.LittleEndian.Uint64(buf[:])
+}
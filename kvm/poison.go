@@ -0,0 +1,30 @@
+package kvm
+
+import "encoding/binary"
+
+// PoisonMemory fills guest RAM with repetitions of the 8-byte little-endian
+// pattern, so that reads of memory the guest has not initialized stand out.
+// RAM added later by GrowMemory is poisoned too and, if freed is set, so are
+// the pages the guest releases with ReleaseMemory, which then stay resident.
+// It must be called before the kernel is loaded.
+func (m *Machine) PoisonMemory(pattern uint64, freed bool) {
+	m.memLock.Lock()
+	defer m.memLock.Unlock()
+	m.poison = pattern
+	m.poisoning = true
+	m.poisonFreed = freed
+	poisonRAM(m.vm.mem[:m.vm.plugged], pattern)
+	m.markDirty(0, m.vm.plugged)
+}
+
+// poisonRAM fills mem, which starts at an 8-byte boundary of RAM, with
+// pattern.
+func poisonRAM(mem []byte, pattern uint64) {
+	if len(mem) < 8 {
+		return
+	}
+	binary.LittleEndian.PutUint64(mem, pattern)
+	for n := 8; n < len(mem); n *= 2 {
+		copy(mem[n:], mem[:n])
+	}
+}
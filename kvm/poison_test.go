@@ -0,0 +1,54 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+const testPoison = 0xdeadbeef_f00dcafe
+
+// poisoned reports whether mem holds only the test pattern.
+func poisoned(mem []byte) bool {
+	want := make([]byte, len(mem))
+	poisonRAM(want, testPoison)
+	return bytes.Equal(mem, want)
+}
+
+func TestPoisonFreed(t *testing.T) {
+	for _, freed := range []bool{false, true} {
+		m := newTestMachine(t, 16<<20)
+		block := memoryBlock()
+		if err := m.SetInitialMemory(block); err != nil {
+			t.Fatal(err)
+		}
+		m.PoisonMemory(testPoison, freed)
+		if !poisoned(m.Slice(physRamBase, physRamBase+block)) {
+			t.Fatal("RAM is not poisoned")
+		}
+		if _, err := m.GrowMemory(block); err != nil {
+			t.Fatal(err)
+		}
+		if !poisoned(m.Slice(physRamBase+block, physRamBase+2*block)) {
+			t.Error("grown RAM is not poisoned")
+		}
+
+		pagesize := uint64(os.Getpagesize())
+		const pa = physRamBase + 0x10_0000
+		mem := fillRAM(m, pa, 4*pagesize, 1)
+		if err := m.ReleaseMemory(pa+pagesize, 2*pagesize); err != nil {
+			t.Fatal(err)
+		}
+		released := mem[pagesize : 3*pagesize]
+		if freed && !poisoned(released) {
+			t.Error("freed pages do not read as the poison pattern")
+		}
+		if !freed && !bytes.Equal(released, make([]byte, len(released))) {
+			t.Error("freed pages do not read as zero without poisoning them")
+		}
+		if binary.LittleEndian.Uint64(mem) != 0x0101010101010101 {
+			t.Error("a page next to the freed ones changed")
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package kvm
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/tysonmote/gommap"
+)
+
+// RegionFlags control how a Region is mapped into the guest.
+type RegionFlags uint32
+
+const (
+	// RegionReadOnly makes the region read-only for the guest. Writes to it
+	// exit to the host as MMIO.
+	RegionReadOnly RegionFlags = 1 << iota
+	// RegionPrivate maps the region copy-on-write, so that guest writes do
+	// not change the file it maps.
+	RegionPrivate
+)
+
+// A Region is memory mapped into the guest in addition to RAM, such as a
+// host file. Regions are not saved in snapshots, and a machine with regions
+// cannot be forked.
+type Region struct {
+	slot  uint32
+	pa    uint64
+	mem   gommap.MMap
+	flags RegionFlags
+}
+
+// Addr returns the guest-physical address of the region.
+func (r *Region) Addr() uint64 {
+	return r.pa
+}
+
+func (r *Region) Size() uint64 {
+	return uint64(len(r.mem))
+}
+
+// Bytes returns the host mapping of the region.
+func (r *Region) Bytes() []byte {
+	return r.mem
+}
+
+// AddRegion maps size bytes of zeroed memory at guest-physical address pa.
+// The address and size must be multiples of the page size, and the region
+// must not overlap RAM, another region or a device.
+func (m *Machine) AddRegion(pa, size uint64, flags RegionFlags) (*Region, error) {
+	return m.addRegion(pa, size, -1, 0, flags)
+}
+
+// AddFileRegion maps size bytes of f, starting at offset off, at
+// guest-physical address pa. Guest writes change the file unless the region
+// is read-only or private. The file may be closed once the region is added.
+func (m *Machine) AddFileRegion(pa uint64, f *os.File, off int64, size uint64, flags RegionFlags) (*Region, error) {
+	return m.addRegion(pa, size, int(f.Fd()), off, flags)
+}
+
+func (m *Machine) addRegion(pa, size uint64, fd int, off int64, flags RegionFlags) (*Region, error) {
+	pagesize := uint64(os.Getpagesize())
+	if size == 0 || pa%pagesize != 0 || size%pagesize != 0 || pa+size < pa {
+		return nil, fmt.Errorf("invalid memory region %#x+%#x", pa, size)
+	}
+	prot := gommap.PROT_READ | gommap.PROT_WRITE
+	if flags&RegionReadOnly != 0 {
+		prot = gommap.PROT_READ
+	}
+	mapFlags := gommap.MAP_SHARED
+	if flags&RegionPrivate != 0 {
+		mapFlags = gommap.MAP_PRIVATE
+	}
+	if fd < 0 {
+		mapFlags |= gommap.MAP_ANONYMOUS
+	}
+
+	m.memLock.Lock()
+	defer m.memLock.Unlock()
+	if err := m.checkRegion(pa, size); err != nil {
+		return nil, err
+	}
+	mem, err := gommap.MapAt(0, uintptr(fd), off, int64(size), prot, mapFlags)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+	r := &Region{
+		slot:  m.vm.allocSlot(),
+		pa:    pa,
+		mem:   mem,
+		flags: flags,
+	}
+	var kvmFlags uint32
+	if flags&RegionReadOnly != 0 {
+		kvmFlags = kvmMemReadonly
+	}
+	if err := m.vm.SetUserspaceMemoryRegion(&UserspaceMemoryRegion{
+		Slot:          r.slot,
+		Flags:         kvmFlags,
+		GuestPhysAddr: pa,
+		MemorySize:    size,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))),
+	}); err != nil {
+		delete(m.vm.slots, r.slot)
+		mem.UnsafeUnmap()
+		return nil, fmt.Errorf("KVM_SET_USERSPACE_MEMORY_REGION: %w", err)
+	}
+	m.regions = append(m.regions, r)
+	return r, nil
+}
+
+// checkRegion returns an error if [pa, pa+size) overlaps RAM, another region
+// or a device. Must be called with memLock held.
+func (m *Machine) checkRegion(pa, size uint64) error {
+	for _, r := range m.reservedMMIO() {
+		if r.overlaps(pa, size) {
+			return fmt.Errorf("memory region [%#x, %#x) overlaps reserved [%#x, %#x)", pa, pa+size, r.base, r.base+r.size)
+		}
+	}
+	if m.regionOverlaps(pa, size) {
+		return fmt.Errorf("memory region [%#x, %#x) overlaps another region", pa, pa+size)
+	}
+	if m.mmio.overlaps(pa, size) {
+		return fmt.Errorf("memory region [%#x, %#x) overlaps a device", pa, pa+size)
+	}
+	return nil
+}
+
+// regionOverlaps reports whether [pa, pa+size) overlaps a region. Must be
+// called with memLock held.
+func (m *Machine) regionOverlaps(pa, size uint64) bool {
+	for _, r := range m.regions {
+		if pa < r.pa+r.Size() && r.pa < pa+size {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveRegion unmaps a region from the guest and from the host. The region
+// must no longer be used by the host, for example through a slice returned
+// by PhysSlice.
+func (m *Machine) RemoveRegion(r *Region) error {
+	m.memLock.Lock()
+	defer m.memLock.Unlock()
+	for i, region := range m.regions {
+		if region != r {
+			continue
+		}
+		if err := m.vm.SetUserspaceMemoryRegion(&UserspaceMemoryRegion{
+			Slot: r.slot,
+		}); err != nil {
+			return fmt.Errorf("KVM_SET_USERSPACE_MEMORY_REGION: %w", err)
+		}
+		delete(m.vm.slots, r.slot)
+		m.regions = append(m.regions[:i], m.regions[i+1:]...)
+		return r.mem.UnsafeUnmap()
+	}
+	return fmt.Errorf("memory region at %#x is not mapped", r.pa)
+}
+
+// regionSlice returns the guest-physical range [pa, pa+n) if it lies within
+// a region. Must be called with memLock held.
+func (m *Machine) regionSlice(pa, n uint64) ([]byte, bool) {
+	for _, r := range m.regions {
+		if pa >= r.pa && pa+n <= r.pa+r.Size() {
+			return r.mem[pa-r.pa : pa-r.pa+n], true
+		}
+	}
+	return nil, false
+}
@@ -1,10 +1,11 @@
 package kvm
 
 import (
+	"fmt"
 	"unsafe"
 )
 
-func (vcpu *vcpu) initRegs(rip, argc, argv, memsz uint64) error {
+func (vcpu *vcpu) initRegs(rip, argc, argv, memsz, id uint64) error {
 	regs, err := vcpu.GetRegs()
 	if err != nil {
 		return err
@@ -16,6 +17,7 @@ func (vcpu *vcpu) initRegs(rip, argc, argv, memsz uint64) error {
 	regs.Rdi = memsz
 	regs.Rsi = argc
 	regs.R15 = argv
+	regs.Rdx = id
 
 	if err := vcpu.SetRegs(regs); err != nil {
 		return err
@@ -220,3 +222,18 @@ func (vcpu *vcpu) GetPc() uint64 {
 	r, _ := vcpu.GetRegs()
 	return r.Rip
 }
+
+// dumpRegs formats the general purpose and special registers of a vcpu for
+// diagnostics.
+func (m *Machine) dumpRegs(cpu int) string {
+	vcpu := m.vm.vcpus[cpu]
+	regs, err := vcpu.GetRegs()
+	if err != nil {
+		return fmt.Sprintf("  KVM_GET_REGS: %v\n", err)
+	}
+	sregs, err := vcpu.GetSregs()
+	if err != nil {
+		return fmt.Sprintf("  KVM_GET_SREGS: %v\n", err)
+	}
+	return show("  ", regs, sregs)
+}
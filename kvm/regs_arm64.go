@@ -67,3 +67,22 @@ func (vcpu *vcpu) GetReg(i int) uint64 {
 	id := kvmRegArm64 | kvmRegSizeU64 | kvmRegArmCore | offset
 	return vcpu.getReg(id)
 }
+
+func coreReg(offset uintptr) uintptr {
+	return kvmRegArm64 | kvmRegSizeU64 | kvmRegArmCore | offset/4
+}
+
+// dumpRegs formats the core registers of a vcpu for diagnostics.
+func (m *Machine) dumpRegs(cpu int) string {
+	vcpu := m.vm.vcpus[cpu]
+	var regs UserRegs
+	for i := range regs.Regs {
+		regs.Regs[i] = vcpu.GetReg(i)
+	}
+	regs.Sp = vcpu.getReg(coreReg(unsafe.Offsetof(UserRegs{}.Sp)))
+	regs.Pc = vcpu.getReg(coreReg(unsafe.Offsetof(UserRegs{}.Pc)))
+	regs.PState = vcpu.getReg(coreReg(unsafe.Offsetof(UserRegs{}.PState)))
+	regs.SpEl1 = vcpu.getReg(coreReg(unsafe.Offsetof(UserRegs{}.SpEl1)))
+	regs.ElrEl1 = vcpu.getReg(coreReg(unsafe.Offsetof(UserRegs{}.ElrEl1)))
+	return show("  ", &regs)
+}
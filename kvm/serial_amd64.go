@@ -0,0 +1,15 @@
+package kvm
+
+import "io"
+
+const (
+	serialPort = 0x3f8 // COM1
+	serialIRQ  = 4
+)
+
+// AddSerial attaches a 16550 UART at the conventional COM1 port (0x3f8,
+// IRQ 4). Guest output is written to out, and in (if non-nil) is used as
+// guest input.
+func (m *Machine) AddSerial(in io.Reader, out io.Writer) error {
+	return m.RegisterPIO(serialPort, 8, NewUART16550(in, out, m.irqLine(serialIRQ)))
+}
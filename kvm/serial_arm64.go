@@ -0,0 +1,14 @@
+package kvm
+
+import "io"
+
+const (
+	serialBase = 0x0900_0000
+	serialIRQ  = 33 // SPI 1
+)
+
+// AddSerial attaches a PL011 UART at 0x09000000 (SPI 1). Guest output is
+// written to out, and in (if non-nil) is used as guest input.
+func (m *Machine) AddSerial(in io.Reader, out io.Writer) error {
+	return m.RegisterMMIO(serialBase, pl011Size, NewPL011(in, out, m.irqLine(serialIRQ)))
+}
@@ -0,0 +1,120 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// errStopped is returned internally when a vCPU stops because the machine
+// was stopped.
+var errStopped = errors.New("machine stopped")
+
+// mpState is struct kvm_mp_state.
+type mpState struct {
+	state uint32
+}
+
+// Stop makes every vCPU return from RunInfiniteLoop, including application
+// processors that have not been started yet. It is called automatically
+// when any vCPU exits so that the remaining vCPUs do not keep the machine
+// alive.
+func (m *Machine) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopc)
+	})
+	for cpu := range m.runs {
+		m.kick(cpu)
+	}
+}
+
+func (m *Machine) stopped() bool {
+	select {
+	case <-m.stopc:
+		return true
+	default:
+		return false
+	}
+}
+
+// kick forces a vCPU out of KVM_RUN. ImmediateExit covers the case where the
+// vCPU thread is about to enter the guest, and the signal interrupts a vCPU
+// that is already running.
+func (m *Machine) kick(cpu int) {
+	m.runs[cpu].ImmediateExit = 1
+	if tid := m.tids[cpu].Load(); tid != 0 {
+		syscall.Tgkill(syscall.Getpid(), int(tid), syscall.SIGURG)
+	}
+}
+
+func (m *Machine) checkAP(cpu int) error {
+	if cpu <= 0 || cpu >= len(m.runs) {
+		return fmt.Errorf("CPU %d is not an application processor", cpu)
+	}
+	return nil
+}
+
+// Pause stops every vCPU at an instruction boundary and returns once all of
+// them are parked, so that their state can be read or changed from any
+// thread. vCPUs that are not running are unaffected, but cannot start until
+// Resume is called. Pause must not be called from a hypercall handler.
+func (m *Machine) Pause() {
+	m.pauseMu.Lock()
+	m.pauseVCPUs(-1)
+}
+
+// Resume restarts the vCPUs stopped by Pause.
+func (m *Machine) Resume() {
+	m.resumeVCPUs(-1)
+	m.pauseMu.Unlock()
+}
+
+// pauseVCPUs parks every vCPU other than except, which is -1 or the vCPU
+// whose hypercall handler is pausing the others. pauseMu must be held.
+func (m *Machine) pauseVCPUs(except int) {
+	m.pauseLock.Lock()
+	m.pausing.Store(true)
+	m.pauseLock.Unlock()
+	for cpu := range m.runs {
+		if cpu != except {
+			m.kick(cpu)
+		}
+	}
+	for cpu := range m.runLocks {
+		if cpu != except {
+			m.runLocks[cpu].Lock()
+		}
+	}
+}
+
+// resumeVCPUs restarts the vCPUs stopped by pauseVCPUs.
+func (m *Machine) resumeVCPUs(except int) {
+	m.pauseLock.Lock()
+	m.pausing.Store(false)
+	m.pauseCond.Broadcast()
+	m.pauseLock.Unlock()
+	for cpu := range m.runLocks {
+		if cpu != except {
+			m.runLocks[cpu].Unlock()
+		}
+	}
+}
+
+// park releases a vCPU's run lock until the machine is resumed. It must be
+// called on the vCPU's thread with the run lock held.
+func (m *Machine) park(cpu int) {
+	// Entering the guest with ImmediateExit set completes any pending MMIO
+	// or port I/O, so the saved state does not depend on the last exit.
+	m.runs[cpu].ImmediateExit = 1
+	m.vm.vcpus[cpu].Run()
+
+	m.runLocks[cpu].Unlock()
+	m.pauseLock.Lock()
+	for m.pausing.Load() {
+		m.pauseCond.Wait()
+	}
+	m.pauseLock.Unlock()
+	m.runLocks[cpu].Lock()
+	m.runs[cpu].ImmediateExit = 0
+	m.ramChanged.Store(true)
+}
@@ -0,0 +1,417 @@
+package kvm
+
+import (
+	"bufio"
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+const (
+	snapshotMagic   = "REVISNAP"
+	snapshotVersion = 3
+
+	// kinds of snapshot
+	snapshotFull      = 0
+	snapshotDelta     = 1
+	snapshotMigration = 2
+
+	// limit on the size of handler state, to reject corrupt snapshots
+	snapshotMaxBlob = 64 << 20
+)
+
+// StateSaver is implemented by hypercall handlers that keep state which
+// must be saved with the machine, such as open files.
+type StateSaver interface {
+	SaveState(w io.Writer) error
+	RestoreState(m *Machine, r io.Reader) error
+}
+
+type snapshotHeader struct {
+	magic   [8]byte
+	version uint32
+	arch    uint32
+	ncpus   uint32
+	kind    uint32
+	memSize uint64
+	// a delta applies on top of the snapshot whose id is its parent
+	id     uint64
+	parent uint64
+}
+
+// Snapshot pauses the machine and writes a checkpoint of it to w: guest RAM,
+// the state of every vCPU and of the interrupt controllers, and the state of
+// the hypercall handler if it implements StateSaver. The machine resumes once
+// the snapshot is written. State held by devices such as virtio devices and
+// serial ports is not saved. Snapshot must not be called from a hypercall
+// handler.
+//
+// Snapshot enables dirty logging so that later checkpoints can be taken with
+// SnapshotDelta.
+func (m *Machine) Snapshot(w io.Writer) error {
+	if err := m.EnableDirtyLogging(); err != nil {
+		return err
+	}
+	m.Pause()
+	defer m.Resume()
+	return m.snapshot(w, snapshotFull)
+}
+
+// SnapshotDelta is like Snapshot but only writes the pages of guest RAM
+// dirtied since the previous snapshot, which must have been taken with
+// Snapshot or SnapshotDelta. Use RestoreIncremental to restore it.
+func (m *Machine) SnapshotDelta(w io.Writer) error {
+	m.Pause()
+	defer m.Resume()
+	return m.snapshot(w, snapshotDelta)
+}
+
+// snapshot writes a checkpoint of a paused machine. Once it is written, the
+// pages dirtied from then on make up the next delta.
+func (m *Machine) snapshot(w io.Writer, kind uint32) error {
+	m.dirtyLock.Lock()
+	defer m.dirtyLock.Unlock()
+	if kind == snapshotDelta && m.snapDirty == nil {
+		return errors.New("no previous snapshot to take a delta against")
+	}
+	// clears the dirty log for a full snapshot
+	if err := m.fetchDirty(); err != nil {
+		return err
+	}
+
+	var id [8]byte
+	if _, err := crand.Read(id[:]); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	hdr := m.snapshotHeader(kind)
+	hdr.id = binary.LittleEndian.Uint64(id[:])
+	if kind == snapshotDelta {
+		hdr.parent = m.snapID
+	}
+	if _, err := bw.Write(rawBytes(&hdr)); err != nil {
+		return err
+	}
+	var err error
+	if kind == snapshotDelta {
+		err = m.writeDirtyRAM(bw, m.snapDirty)
+	} else {
+		err = m.writeRAM(bw)
+	}
+	if err != nil {
+		return err
+	}
+	if err := endRAM(bw); err != nil {
+		return err
+	}
+	if err := m.writeState(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	// if writing failed, the pages stay dirty for the next attempt
+	m.snapDirty = make([]uint64, m.DirtyBitmapSize()/8)
+	m.snapID = hdr.id
+	return nil
+}
+
+// writeState writes the state of a paused machine that follows RAM in a
+// snapshot: the amount of RAM the guest has, the started vCPUs, the vCPU and
+// VM state and the handler state.
+func (m *Machine) writeState(w io.Writer) error {
+	plugged := m.Memory()
+	if _, err := w.Write(rawBytes(&plugged)); err != nil {
+		return err
+	}
+	started := make([]byte, len(m.runs))
+	for cpu := range started {
+		if m.started[cpu].Load() {
+			started[cpu] = 1
+		}
+	}
+	if _, err := w.Write(started); err != nil {
+		return err
+	}
+	for cpu := range m.runs {
+		if err := m.saveVCPUState(cpu, w); err != nil {
+			return fmt.Errorf("CPU %d: %w", cpu, err)
+		}
+	}
+	if err := m.saveVMState(w); err != nil {
+		return err
+	}
+
+	var state bytes.Buffer
+	if s, ok := m.handler.(StateSaver); ok {
+		if err := s.SaveState(&state); err != nil {
+			return err
+		}
+	}
+	return writeBlob(w, state.Bytes())
+}
+
+// RestoreMachine creates a machine from a snapshot written by Snapshot. The
+// handler's state is restored if it implements StateSaver. The machine is
+// ready to run with StartVCPU; devices must be added again by the caller.
+func RestoreMachine(r io.Reader, handler HypercallHandler) (*Machine, error) {
+	return RestoreIncremental(r, nil, handler)
+}
+
+// RestoreIncremental is like RestoreMachine, but layers the deltas written
+// by SnapshotDelta on top of the base snapshot. The deltas must be given in
+// the order they were taken, starting with the one following base.
+func RestoreIncremental(base io.Reader, deltas []io.Reader, handler HypercallHandler) (*Machine, error) {
+	var m *Machine
+	var prev snapshotHeader
+	var started, state []byte
+	for i, r := range append([]io.Reader{base}, deltas...) {
+		br := bufio.NewReader(r)
+		hdr, err := readSnapshotHeader(br)
+		if err != nil {
+			return nil, closeOnError(m, err)
+		}
+		if i == 0 {
+			if hdr.kind != snapshotFull {
+				return nil, errors.New("snapshot is not a full snapshot")
+			}
+			m, err = NewMachine("/dev/kvm", int(hdr.ncpus), int64(hdr.memSize), handler)
+			if err != nil {
+				return nil, err
+			}
+		} else if hdr.kind != snapshotDelta || hdr.parent != prev.id || hdr.ncpus != prev.ncpus || hdr.memSize != prev.memSize {
+			return nil, closeOnError(m, fmt.Errorf("delta %d does not follow the snapshot before it", i))
+		}
+		prev = hdr
+
+		if started, state, err = m.restoreLayer(br); err != nil {
+			return nil, closeOnError(m, err)
+		}
+	}
+	if err := m.finishRestore(started, state); err != nil {
+		return nil, closeOnError(m, err)
+	}
+	return m, nil
+}
+
+func (m *Machine) snapshotHeader(kind uint32) snapshotHeader {
+	hdr := snapshotHeader{
+		version: snapshotVersion,
+		arch:    snapshotArch,
+		ncpus:   uint32(len(m.runs)),
+		kind:    kind,
+		memSize: uint64(len(m.vm.mem)),
+	}
+	copy(hdr.magic[:], snapshotMagic)
+	return hdr
+}
+
+func readSnapshotHeader(r io.Reader) (snapshotHeader, error) {
+	var hdr snapshotHeader
+	if _, err := io.ReadFull(r, rawBytes(&hdr)); err != nil {
+		return hdr, err
+	}
+	if string(hdr.magic[:]) != snapshotMagic {
+		return hdr, errors.New("not a machine snapshot")
+	}
+	if hdr.version != snapshotVersion || hdr.arch != snapshotArch {
+		return hdr, fmt.Errorf("unsupported snapshot version %d for architecture %d", hdr.version, hdr.arch)
+	}
+	return hdr, nil
+}
+
+// finishRestore marks the started vCPUs and restores the handler state
+// once every snapshot has been applied.
+func (m *Machine) finishRestore(started, state []byte) error {
+	for cpu := range m.runs {
+		if started[cpu] != 0 {
+			m.started[cpu].Store(true)
+			close(m.start[cpu])
+		}
+	}
+	if s, ok := m.handler.(StateSaver); ok {
+		return s.RestoreState(m, bytes.NewReader(state))
+	} else if len(state) != 0 {
+		return errors.New("snapshot has hypercall handler state but the handler cannot restore it")
+	}
+	return nil
+}
+
+// restoreLayer restores guest RAM, vCPU and VM state from a snapshot after
+// its header. It returns the started flags of the vCPUs and the handler
+// state, which only matter for the last snapshot applied.
+func (m *Machine) restoreLayer(r io.Reader) (started, state []byte, err error) {
+	if err := m.readRAM(r); err != nil {
+		return nil, nil, err
+	}
+	var plugged uint64
+	if _, err := io.ReadFull(r, rawBytes(&plugged)); err != nil {
+		return nil, nil, err
+	}
+	if plugged == 0 || plugged > m.MaxMemory() {
+		return nil, nil, fmt.Errorf("snapshot has %d bytes of RAM", plugged)
+	}
+	m.memLock.Lock()
+	err = m.vm.resetRAM(plugged)
+	m.memLock.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	started = make([]byte, len(m.runs))
+	if _, err := io.ReadFull(r, started); err != nil {
+		return nil, nil, err
+	}
+	for cpu := range m.runs {
+		if err := m.restoreVCPUState(cpu, r); err != nil {
+			return nil, nil, fmt.Errorf("CPU %d: %w", cpu, err)
+		}
+	}
+	if err := m.restoreVMState(r); err != nil {
+		return nil, nil, err
+	}
+	state, err = readBlob(r)
+	return started, state, err
+}
+
+func closeOnError(m *Machine, err error) error {
+	if m != nil {
+		m.Close()
+	}
+	return err
+}
+
+// writeRAM writes guest RAM as runs of pages that are not entirely zero,
+// each preceded by its offset and length. The runs are terminated by endRAM.
+func (m *Machine) writeRAM(w io.Writer) error {
+	pagesize := os.Getpagesize()
+	zero := make([]byte, pagesize)
+	mem := m.vm.mem
+	for off := 0; off < len(mem); {
+		if bytes.Equal(mem[off:off+pagesize], zero) {
+			off += pagesize
+			continue
+		}
+		end := off + pagesize
+		for end < len(mem) && !bytes.Equal(mem[end:end+pagesize], zero) {
+			end += pagesize
+		}
+		if err := writeRun(w, uint64(off), mem[off:end]); err != nil {
+			return err
+		}
+		off = end
+	}
+	return nil
+}
+
+// writeDirtyRAM writes the pages set in the dirty bitmap in the same format
+// as writeRAM, including pages that are zero.
+func (m *Machine) writeDirtyRAM(w io.Writer, dirty []uint64) error {
+	pagesize := os.Getpagesize()
+	npages := len(m.vm.mem) / pagesize
+	isDirty := func(page int) bool {
+		return dirty[page/64]&(1<<(page%64)) != 0
+	}
+	for page := 0; page < npages; {
+		if !isDirty(page) {
+			page++
+			continue
+		}
+		end := page + 1
+		for end < npages && isDirty(end) {
+			end++
+		}
+		if err := writeRun(w, uint64(page*pagesize), m.vm.mem[page*pagesize:end*pagesize]); err != nil {
+			return err
+		}
+		page = end
+	}
+	return nil
+}
+
+// endRAM writes the empty run that ends guest RAM.
+func endRAM(w io.Writer) error {
+	return writeRun(w, 0, nil)
+}
+
+func writeRun(w io.Writer, off uint64, data []byte) error {
+	run := [2]uint64{off, uint64(len(data))}
+	if _, err := w.Write(rawBytes(&run)); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readRAM reads the runs written by writeRAM or writeDirtyRAM into guest
+// RAM. Pages outside the runs are left unchanged, so they must already be
+// zero or hold the contents of the snapshot a delta applies to.
+func (m *Machine) readRAM(r io.Reader) error {
+	for {
+		var run [2]uint64
+		if _, err := io.ReadFull(r, rawBytes(&run)); err != nil {
+			return err
+		}
+		off, n := run[0], run[1]
+		if n == 0 {
+			return nil
+		}
+		if off+n < off || off+n > uint64(len(m.vm.mem)) {
+			return fmt.Errorf("snapshot RAM run [%#x, %#x) out of range", off, off+n)
+		}
+		if _, err := io.ReadFull(r, m.vm.mem[off:off+n]); err != nil {
+			return err
+		}
+	}
+}
+
+func writeBlob(w io.Writer, b []byte) error {
+	n := uint64(len(b))
+	if _, err := w.Write(rawBytes(&n)); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readBlob(r io.Reader) ([]byte, error) {
+	var n uint64
+	if _, err := io.ReadFull(r, rawBytes(&n)); err != nil {
+		return nil, err
+	}
+	if n > snapshotMaxBlob {
+		return nil, fmt.Errorf("snapshot section of %d bytes is too large", n)
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// rawBytes returns the in-memory representation of v. Snapshots store
+// kernel structures this way, so they are only portable between hosts of the
+// same architecture.
+func rawBytes[T any](v *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v))
+}
+
+// getState and setState transfer a fixed-size state structure with an
+// ioctl on fd.
+func getState[T any](fd uintptr, nr uintptr, name string, v *T) error {
+	_, err := Ioctl(fd, IIOR(nr, unsafe.Sizeof(*v)), uintptr(unsafe.Pointer(v)))
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func setState[T any](fd uintptr, nr uintptr, name string, v *T) error {
+	_, err := Ioctl(fd, IIOW(nr, unsafe.Sizeof(*v)), uintptr(unsafe.Pointer(v)))
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+const snapshotArch = 1
+
+type xsaveState struct {
+	region [1024]uint32
+}
+
+type xcr struct {
+	xcr   uint32
+	_     uint32
+	value uint64
+}
+
+type xcrsState struct {
+	nr    uint32
+	flags uint32
+	xcrs  [16]xcr
+	_     [16]uint64
+}
+
+type lapicState struct {
+	regs [1024]byte
+}
+
+type vcpuEvents struct {
+	data [64]byte
+}
+
+type msrEntry struct {
+	index uint32
+	_     uint32
+	data  uint64
+}
+
+// vcpuState is the fixed-size part of a saved vCPU. It is followed by the
+// vCPU's MSRs.
+type vcpuState struct {
+	regs   Regs
+	sregs  Sregs
+	xsave  xsaveState
+	xcrs   xcrsState
+	lapic  lapicState
+	events vcpuEvents
+	mp     mpState
+	dregs  DebugRegs
+}
+
+type irqchipState struct {
+	chipID uint32
+	_      uint32
+	chip   [512]byte
+}
+
+type pitState struct {
+	data [112]byte
+}
+
+type clockData struct {
+	clock    uint64
+	flags    uint32
+	_        uint32
+	realtime uint64
+	hostTSC  uint64
+	_        [4]uint32
+}
+
+// the PIC master, PIC slave and IOAPIC
+const numIrqchips = 3
+
+type vmState struct {
+	irqchips [numIrqchips]irqchipState
+	pit      pitState
+	clock    clockData
+}
+
+func (m *Machine) saveVCPUState(cpu int, w io.Writer) error {
+	vcpu := &m.vm.vcpus[cpu]
+	var s vcpuState
+	regs, err := vcpu.GetRegs()
+	if err != nil {
+		return err
+	}
+	s.regs = *regs
+	sregs, err := vcpu.GetSregs()
+	if err != nil {
+		return err
+	}
+	s.sregs = *sregs
+	if err := getState(vcpu.fd, kvmGetXSAVE, "KVM_GET_XSAVE", &s.xsave); err != nil {
+		return err
+	}
+	if err := getState(vcpu.fd, kvmGetXCRS, "KVM_GET_XCRS", &s.xcrs); err != nil {
+		return err
+	}
+	if err := getState(vcpu.fd, kvmGetLAPIC, "KVM_GET_LAPIC", &s.lapic); err != nil {
+		return err
+	}
+	if err := getState(vcpu.fd, kvmGetVCPUEvents, "KVM_GET_VCPU_EVENTS", &s.events); err != nil {
+		return err
+	}
+	if err := getState(vcpu.fd, kvmGetMPState, "KVM_GET_MP_STATE", &s.mp); err != nil {
+		return err
+	}
+	if err := vcpu.GetDebugRegs(&s.dregs); err != nil {
+		return fmt.Errorf("KVM_GET_DEBUGREGS: %w", err)
+	}
+
+	indices, err := m.msrIndexList()
+	if err != nil {
+		return err
+	}
+	msrs, err := vcpu.getMSRs(indices)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(rawBytes(&s)); err != nil {
+		return err
+	}
+	n := uint64(len(msrs))
+	if _, err := w.Write(rawBytes(&n)); err != nil {
+		return err
+	}
+	for i := range msrs {
+		if _, err := w.Write(rawBytes(&msrs[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Machine) restoreVCPUState(cpu int, r io.Reader) error {
+	vcpu := &m.vm.vcpus[cpu]
+	var s vcpuState
+	if _, err := io.ReadFull(r, rawBytes(&s)); err != nil {
+		return err
+	}
+	var n uint64
+	if _, err := io.ReadFull(r, rawBytes(&n)); err != nil {
+		return err
+	}
+	if n > 1<<16 {
+		return fmt.Errorf("snapshot has %d MSRs", n)
+	}
+	msrs := make([]msrEntry, n)
+	for i := range msrs {
+		if _, err := io.ReadFull(r, rawBytes(&msrs[i])); err != nil {
+			return err
+		}
+	}
+
+	// the same order as QEMU: the LAPIC after the APIC base in the MSRs and
+	// pending events after the LAPIC
+	if err := vcpu.SetRegs(&s.regs); err != nil {
+		return err
+	}
+	if err := setState(vcpu.fd, kvmSetXSAVE, "KVM_SET_XSAVE", &s.xsave); err != nil {
+		return err
+	}
+	if err := setState(vcpu.fd, kvmSetXCRS, "KVM_SET_XCRS", &s.xcrs); err != nil {
+		return err
+	}
+	if err := vcpu.SetSregs(&s.sregs); err != nil {
+		return err
+	}
+	if err := vcpu.setMSRs(msrs); err != nil {
+		return err
+	}
+	if err := setState(vcpu.fd, kvmSetMPState, "KVM_SET_MP_STATE", &s.mp); err != nil {
+		return err
+	}
+	if err := setState(vcpu.fd, kvmSetLAPIC, "KVM_SET_LAPIC", &s.lapic); err != nil {
+		return err
+	}
+	if err := setState(vcpu.fd, kvmSetVCPUEvents, "KVM_SET_VCPU_EVENTS", &s.events); err != nil {
+		return err
+	}
+	if err := vcpu.SetDebugRegs(&s.dregs); err != nil {
+		return fmt.Errorf("KVM_SET_DEBUGREGS: %w", err)
+	}
+	return nil
+}
+
+func (m *Machine) saveVMState(w io.Writer) error {
+	var s vmState
+	for i := range s.irqchips {
+		chip := &s.irqchips[i]
+		chip.chipID = uint32(i)
+		_, err := Ioctl(m.vm.fd, IIOWR(kvmGetIRQChip, unsafe.Sizeof(*chip)), uintptr(unsafe.Pointer(chip)))
+		if err != nil {
+			return fmt.Errorf("KVM_GET_IRQCHIP: %w", err)
+		}
+	}
+	if err := getState(m.vm.fd, kvmGetPIT2, "KVM_GET_PIT2", &s.pit); err != nil {
+		return err
+	}
+	if err := getState(m.vm.fd, kvmGetClock, "KVM_GET_CLOCK", &s.clock); err != nil {
+		return err
+	}
+	_, err := w.Write(rawBytes(&s))
+	return err
+}
+
+func (m *Machine) restoreVMState(r io.Reader) error {
+	var s vmState
+	if _, err := io.ReadFull(r, rawBytes(&s)); err != nil {
+		return err
+	}
+	for i := range s.irqchips {
+		chip := &s.irqchips[i]
+		// KVM_SET_IRQCHIP is historically defined as a read
+		_, err := Ioctl(m.vm.fd, IIOR(kvmSetIRQChip, unsafe.Sizeof(*chip)), uintptr(unsafe.Pointer(chip)))
+		if err != nil {
+			return fmt.Errorf("KVM_SET_IRQCHIP: %w", err)
+		}
+	}
+	if err := setState(m.vm.fd, kvmSetPIT2, "KVM_SET_PIT2", &s.pit); err != nil {
+		return err
+	}
+	clock := clockData{clock: s.clock.clock}
+	return setState(m.vm.fd, kvmSetClock, "KVM_SET_CLOCK", &clock)
+}
+
+// msrIndexList returns the MSRs that KVM saves and restores.
+func (m *Machine) msrIndexList() ([]uint32, error) {
+	// struct kvm_msr_list: the count followed by the indices
+	list := []uint32{0}
+	for {
+		_, err := Ioctl(m.kvmfd, IIOWR(kvmGetMSRIndexList, 4), uintptr(unsafe.Pointer(&list[0])))
+		if err == nil {
+			return list[1 : 1+list[0]], nil
+		}
+		if !errors.Is(err, syscall.E2BIG) {
+			return nil, fmt.Errorf("KVM_GET_MSR_INDEX_LIST: %w", err)
+		}
+		n := list[0]
+		list = make([]uint32, 1+n)
+		list[0] = n
+	}
+}
+
+// msrs is struct kvm_msrs followed by its entries.
+type msrs struct {
+	nmsrs   uint32
+	_       uint32
+	entries [64]msrEntry
+}
+
+// getMSRs reads the given MSRs, skipping any that the vCPU does not
+// support.
+func (vcpu *vcpu) getMSRs(indices []uint32) ([]msrEntry, error) {
+	var out []msrEntry
+	for len(indices) > 0 {
+		var buf msrs
+		n := min(len(indices), len(buf.entries))
+		for i := 0; i < n; i++ {
+			buf.entries[i].index = indices[i]
+		}
+		buf.nmsrs = uint32(n)
+		ret, err := Ioctl(vcpu.fd, IIOWR(kvmGetMSRS, 8), uintptr(unsafe.Pointer(&buf)))
+		if err != nil {
+			return nil, fmt.Errorf("KVM_GET_MSRS: %w", err)
+		}
+		out = append(out, buf.entries[:ret]...)
+		// KVM stops at the first MSR it cannot read
+		if int(ret) < n {
+			ret++
+		}
+		indices = indices[ret:]
+	}
+	return out, nil
+}
+
+// setMSRs writes the given MSRs, skipping any that KVM refuses.
+func (vcpu *vcpu) setMSRs(entries []msrEntry) error {
+	for len(entries) > 0 {
+		var buf msrs
+		n := copy(buf.entries[:], entries)
+		buf.nmsrs = uint32(n)
+		ret, err := Ioctl(vcpu.fd, IIOW(kvmSetMSRS, 8), uintptr(unsafe.Pointer(&buf)))
+		if err != nil {
+			return fmt.Errorf("KVM_SET_MSRS: %w", err)
+		}
+		if int(ret) < n {
+			ret++
+		}
+		entries = entries[ret:]
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	const data = physRamBase + 0x20_0000
+	code := []byte{
+		0xc7, 0x05, 0, 0, 0x20, 0x40, 0xef, 0xbe, 0xad, 0xde, // mov dword [data], 0xdeadbeef
+		0xb0, 0x34, // mov al, 0x34: PIT channel 0, low then high byte, mode 2
+		0xe6, 0x43, // out 0x43, al
+		0xb0, 0x34, // mov al, 0x34
+		0xe6, 0x40, // out 0x40, al
+		0xb0, 0x12, // mov al, 0x12
+		0xe6, 0x40, // out 0x40, al
+		0xc7, 0x05, 0x80, 0x00, 0xe0, 0xfe, 0x20, 0, 0, 0, // mov dword [lapic+TPR], 0x20
+		0xb8, 0x44, 0x33, 0x22, 0x11, // mov eax, 0x11223344
+		0xbb, 0x88, 0x77, 0x66, 0x55, // mov ebx, 0x55667788
+	}
+	if err := runCode(t, m, append(code, doneCode...)); err != nil {
+		t.Fatal(err)
+	}
+	// a restored clock continues from the snapshot instead of from zero
+	const clock = 1000e9
+	if err := setState(m.vm.fd, kvmSetClock, "KVM_SET_CLOCK", &clockData{clock: clock}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := m.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := RestoreMachine(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if !bytes.Equal(r.vm.mem[:m.Memory()], m.vm.mem[:m.Memory()]) {
+		t.Error("restored RAM differs")
+	}
+	if got := binary.LittleEndian.Uint32(r.vm.mem[data-physRamBase:]); got != 0xdeadbeef {
+		t.Errorf("restored RAM holds %#x, want the guest's write", got)
+	}
+
+	want, err := m.vm.vcpus[0].GetRegs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	regs, err := r.vm.vcpus[0].GetRegs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *regs != *want || regs.Rax != 0x11223344 || regs.Rbx != 0x55667788 {
+		t.Errorf("restored registers %+v, want %+v", *regs, *want)
+	}
+
+	var lapic lapicState
+	if err := getState(r.vm.vcpus[0].fd, kvmGetLAPIC, "KVM_GET_LAPIC", &lapic); err != nil {
+		t.Fatal(err)
+	}
+	if tpr := binary.LittleEndian.Uint32(lapic.regs[0x80:]); tpr != 0x20 {
+		t.Errorf("restored LAPIC TPR %#x, want %#x", tpr, 0x20)
+	}
+
+	var pit pitState
+	if err := getState(r.vm.fd, kvmGetPIT2, "KVM_GET_PIT2", &pit); err != nil {
+		t.Fatal(err)
+	}
+	// struct kvm_pit_channel_state: count at 0, rw_mode at 12, mode at 13
+	if count, mode := binary.LittleEndian.Uint32(pit.data[0:]), pit.data[13]; count != 0x1234 || mode != 2 {
+		t.Errorf("restored PIT channel 0 has count %#x in mode %d, want %#x in mode 2", count, mode, 0x1234)
+	}
+
+	var c clockData
+	if err := getState(r.vm.fd, kvmGetClock, "KVM_GET_CLOCK", &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.clock < clock || c.clock > clock+60e9 {
+		t.Errorf("restored clock %d, want about %d", c.clock, uint64(clock))
+	}
+}
+
+func TestSnapshotDeltaMatchesFull(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	// mov dword [pa], val; mov eax, val
+	store := func(pa, val uint32) []byte {
+		code := []byte{0xc7, 0x05}
+		code = binary.LittleEndian.AppendUint32(code, pa)
+		code = binary.LittleEndian.AppendUint32(code, val)
+		code = append(code, 0xb8)
+		code = binary.LittleEndian.AppendUint32(code, val)
+		return append(code, doneCode...)
+	}
+	if err := runCode(t, m, store(physRamBase+0x20_0000, 1)); err != nil {
+		t.Fatal(err)
+	}
+	var base, delta, full bytes.Buffer
+	if err := m.Snapshot(&base); err != nil {
+		t.Fatal(err)
+	}
+	// the guest and the host change RAM after the base snapshot
+	copy(m.Slice(physRamBase+0x30_0000, physRamBase+0x30_0004), "host")
+	if err := runCode(t, m, store(physRamBase+0x20_1000, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SnapshotDelta(&delta); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Snapshot(&full); err != nil {
+		t.Fatal(err)
+	}
+
+	layered, err := RestoreIncremental(&base, []io.Reader{&delta}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layered.Close()
+	restored, err := RestoreMachine(&full, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if layered.Memory() != restored.Memory() || !bytes.Equal(layered.vm.mem, restored.vm.mem) {
+		t.Error("RAM restored from the base and delta differs from the full snapshot")
+	}
+	if !bytes.Equal(layered.vm.mem, m.vm.mem) {
+		t.Error("RAM restored from the base and delta differs from the machine")
+	}
+	want, err := restored.vm.vcpus[0].GetRegs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	regs, err := layered.vm.vcpus[0].GetRegs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *regs != *want || regs.Rax != 2 {
+		t.Errorf("registers restored from the base and delta %+v, want %+v", *regs, *want)
+	}
+}
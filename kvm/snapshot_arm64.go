@@ -0,0 +1,295 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+const snapshotArch = 2
+
+const (
+	kvmRegSizeShift = 52
+	kvmRegSizeMask  = 0x00f0000000000000
+
+	kvmRegArm64Sysreg = 0x0013 << kvmRegArmCoprocShift
+
+	_KVM_DEV_ARM_VGIC_GRP_DIST_REGS   = 1
+	_KVM_DEV_ARM_VGIC_GRP_REDIST_REGS = 5
+	_KVM_DEV_ARM_VGIC_GRP_CPU_SYSREGS = 6
+	_KVM_DEV_ARM_VGIC_GRP_LEVEL_INFO  = 7
+
+	_KVM_DEV_ARM_VGIC_V3_MPIDR_SHIFT = 32
+
+	gicSGIBase = 0x10000
+)
+
+// sysreg encodes a system register as KVM does, without the register type.
+func sysreg(op0, op1, crn, crm, op2 uint64) uint64 {
+	return op0<<14 | op1<<11 | crn<<7 | crm<<3 | op2
+}
+
+// oneReg is struct kvm_one_reg for registers of any size.
+type oneReg struct {
+	id   uint64
+	addr uintptr
+}
+
+func regSize(id uint64) int {
+	return 1 << ((id & kvmRegSizeMask) >> kvmRegSizeShift)
+}
+
+// regList returns the IDs of all registers of a vCPU.
+func (vcpu *vcpu) regList() ([]uint64, error) {
+	// struct kvm_reg_list: the count followed by the IDs
+	list := []uint64{0}
+	for {
+		_, err := Ioctl(vcpu.fd, IIOWR(kvmGetRegList, 8), uintptr(unsafe.Pointer(&list[0])))
+		if err == nil {
+			return list[1 : 1+list[0]], nil
+		}
+		if !errors.Is(err, syscall.E2BIG) {
+			return nil, fmt.Errorf("KVM_GET_REG_LIST: %w", err)
+		}
+		n := list[0]
+		list = make([]uint64, 1+n)
+		list[0] = n
+	}
+}
+
+func (vcpu *vcpu) oneReg(nr uintptr, id uint64, val []byte) error {
+	reg := oneReg{
+		id:   id,
+		addr: uintptr(unsafe.Pointer(&val[0])),
+	}
+	_, err := Ioctl(vcpu.fd, IIOW(nr, unsafe.Sizeof(reg)), uintptr(unsafe.Pointer(&reg)))
+	return err
+}
+
+// A vCPU is saved as its MP state and every register in its register list,
+// which covers the core, FP/SIMD, system, timer and firmware registers.
+func (m *Machine) saveVCPUState(cpu int, w io.Writer) error {
+	vcpu := &m.vm.vcpus[cpu]
+	var mp mpState
+	if err := getState(vcpu.fd, kvmGetMPState, "KVM_GET_MP_STATE", &mp); err != nil {
+		return err
+	}
+	ids, err := vcpu.regList()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(rawBytes(&mp)); err != nil {
+		return err
+	}
+	n := uint64(len(ids))
+	if _, err := w.Write(rawBytes(&n)); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		val := make([]byte, regSize(id))
+		if err := vcpu.oneReg(kvmGetOneReg, id, val); err != nil {
+			return fmt.Errorf("KVM_GET_ONE_REG %#x: %w", id, err)
+		}
+		if _, err := w.Write(rawBytes(&id)); err != nil {
+			return err
+		}
+		if _, err := w.Write(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Machine) restoreVCPUState(cpu int, r io.Reader) error {
+	vcpu := &m.vm.vcpus[cpu]
+	var mp mpState
+	if _, err := io.ReadFull(r, rawBytes(&mp)); err != nil {
+		return err
+	}
+	var n uint64
+	if _, err := io.ReadFull(r, rawBytes(&n)); err != nil {
+		return err
+	}
+	if n > 1<<16 {
+		return fmt.Errorf("snapshot has %d registers", n)
+	}
+	for i := uint64(0); i < n; i++ {
+		var id uint64
+		if _, err := io.ReadFull(r, rawBytes(&id)); err != nil {
+			return err
+		}
+		val := make([]byte, regSize(id))
+		if _, err := io.ReadFull(r, val); err != nil {
+			return err
+		}
+		if err := vcpu.oneReg(kvmSetOneReg, id, val); err != nil {
+			return fmt.Errorf("KVM_SET_ONE_REG %#x: %w", id, err)
+		}
+	}
+	return setState(vcpu.fd, kvmSetMPState, "KVM_SET_MP_STATE", &mp)
+}
+
+// gicReg is a GICv3 register accessed through the device attributes of the
+// in-kernel GIC.
+type gicReg struct {
+	group uint32
+	wide  uint32 // 64-bit rather than 32-bit
+	attr  uint64
+	value uint64
+}
+
+func (m *Machine) gicAttr(nr uintptr, reg *gicReg) error {
+	var val32 uint32
+	attr := DeviceAttr{
+		group: reg.group,
+		attr:  reg.attr,
+		addr:  uint64(uintptr(unsafe.Pointer(&val32))),
+	}
+	if reg.wide != 0 {
+		attr.addr = uint64(uintptr(unsafe.Pointer(&reg.value)))
+	} else {
+		val32 = uint32(reg.value)
+	}
+	_, err := Ioctl(m.irqfd, IIOW(nr, unsafe.Sizeof(attr)), uintptr(unsafe.Pointer(&attr)))
+	if reg.wide == 0 {
+		reg.value = uint64(val32)
+	}
+	return err
+}
+
+// gicRegs lists the GIC registers that make up its state, in the order in
+// which they are restored.
+func (m *Machine) gicRegs() ([]gicReg, error) {
+	var nirqs uint32
+	nr := DeviceAttr{
+		group: _KVM_DEV_ARM_VGIC_GRP_NR_IRQS,
+		addr:  uint64(uintptr(unsafe.Pointer(&nirqs))),
+	}
+	if _, err := Ioctl(m.irqfd, IIOW(kvmGetDeviceAttr, unsafe.Sizeof(nr)), uintptr(unsafe.Pointer(&nr))); err != nil {
+		return nil, fmt.Errorf("VGIC_GRP_NR_IRQS: %w", err)
+	}
+
+	var regs []gicReg
+	dist := func(off uint64) {
+		regs = append(regs, gicReg{group: _KVM_DEV_ARM_VGIC_GRP_DIST_REGS, attr: off})
+	}
+	// distributor: the SPIs, from interrupt 32
+	dist(0x0) // GICD_CTLR
+	for irq := uint64(32); irq < uint64(nirqs); irq += 32 {
+		dist(0x80 + irq/8)  // GICD_IGROUPR
+		dist(0xd00 + irq/8) // GICD_IGRPMODR
+		dist(0xc00 + irq/4) // GICD_ICFGR
+		dist(0xc04 + irq/4)
+		for i := uint64(0); i < 32; i += 4 {
+			dist(0x400 + irq + i) // GICD_IPRIORITYR
+		}
+		for i := uint64(0); i < 32; i++ {
+			dist(0x6000 + 8*(irq+i)) // GICD_IROUTER, in two halves
+			dist(0x6004 + 8*(irq+i))
+		}
+		dist(0x100 + irq/8) // GICD_ISENABLER
+		dist(0x200 + irq/8) // GICD_ISPENDR
+		dist(0x300 + irq/8) // GICD_ISACTIVER
+	}
+
+	for cpu := range m.vm.vcpus {
+		// the vCPU's affinity as Aff3.Aff2.Aff1.Aff0
+		mpidr := m.vm.vcpus[cpu].getReg(uintptr(kvmRegArm64 | kvmRegSizeU64 | kvmRegArm64Sysreg | sysreg(3, 0, 0, 0, 5)))
+		aff := (mpidr&0xffffff | (mpidr>>32&0xff)<<24) << _KVM_DEV_ARM_VGIC_V3_MPIDR_SHIFT
+
+		redist := func(off uint64) {
+			regs = append(regs, gicReg{group: _KVM_DEV_ARM_VGIC_GRP_REDIST_REGS, attr: aff | off})
+		}
+		// redistributor: the SGIs and PPIs
+		redist(gicSGIBase + 0x080) // GICR_IGROUPR0
+		redist(gicSGIBase + 0xd00) // GICR_IGRPMODR0
+		redist(gicSGIBase + 0xc00) // GICR_ICFGR0
+		redist(gicSGIBase + 0xc04) // GICR_ICFGR1
+		for i := uint64(0); i < 32; i += 4 {
+			redist(gicSGIBase + 0x400 + i) // GICR_IPRIORITYR
+		}
+		redist(gicSGIBase + 0x100) // GICR_ISENABLER0
+		redist(gicSGIBase + 0x200) // GICR_ISPENDR0
+		redist(gicSGIBase + 0x300) // GICR_ISACTIVER0
+
+		// CPU interface
+		for _, r := range []uint64{
+			sysreg(3, 0, 12, 12, 5), // ICC_SRE_EL1
+			sysreg(3, 0, 12, 12, 4), // ICC_CTLR_EL1
+			sysreg(3, 0, 4, 6, 0),   // ICC_PMR_EL1
+			sysreg(3, 0, 12, 8, 3),  // ICC_BPR0_EL1
+			sysreg(3, 0, 12, 12, 3), // ICC_BPR1_EL1
+			sysreg(3, 0, 12, 12, 6), // ICC_IGRPEN0_EL1
+			sysreg(3, 0, 12, 12, 7), // ICC_IGRPEN1_EL1
+			sysreg(3, 0, 12, 8, 4),  // ICC_AP0R<n>_EL1
+			sysreg(3, 0, 12, 8, 5),
+			sysreg(3, 0, 12, 8, 6),
+			sysreg(3, 0, 12, 8, 7),
+			sysreg(3, 0, 12, 9, 0), // ICC_AP1R<n>_EL1
+			sysreg(3, 0, 12, 9, 1),
+			sysreg(3, 0, 12, 9, 2),
+			sysreg(3, 0, 12, 9, 3),
+		} {
+			regs = append(regs, gicReg{group: _KVM_DEV_ARM_VGIC_GRP_CPU_SYSREGS, wide: 1, attr: aff | r})
+		}
+
+		if cpu == 0 {
+			// line levels of level-triggered SPIs
+			for irq := uint64(32); irq < uint64(nirqs); irq += 32 {
+				regs = append(regs, gicReg{group: _KVM_DEV_ARM_VGIC_GRP_LEVEL_INFO, attr: aff | irq})
+			}
+		}
+	}
+	return regs, nil
+}
+
+// The GIC is saved as a list of registers. Registers that the host does not
+// implement, such as unused active priority registers, are left out.
+func (m *Machine) saveVMState(w io.Writer) error {
+	regs, err := m.gicRegs()
+	if err != nil {
+		return err
+	}
+	var saved []gicReg
+	for i := range regs {
+		if err := m.gicAttr(kvmGetDeviceAttr, &regs[i]); err != nil {
+			if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENXIO) {
+				continue
+			}
+			return fmt.Errorf("GIC register %#x: %w", regs[i].attr, err)
+		}
+		saved = append(saved, regs[i])
+	}
+	n := uint64(len(saved))
+	if _, err := w.Write(rawBytes(&n)); err != nil {
+		return err
+	}
+	for i := range saved {
+		if _, err := w.Write(rawBytes(&saved[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Machine) restoreVMState(r io.Reader) error {
+	var n uint64
+	if _, err := io.ReadFull(r, rawBytes(&n)); err != nil {
+		return err
+	}
+	if n > 1<<20 {
+		return fmt.Errorf("snapshot has %d GIC registers", n)
+	}
+	for i := uint64(0); i < n; i++ {
+		var reg gicReg
+		if _, err := io.ReadFull(r, rawBytes(&reg)); err != nil {
+			return err
+		}
+		if err := m.gicAttr(kvmSetDeviceAttr, &reg); err != nil {
+			return fmt.Errorf("GIC register %#x: %w", reg.attr, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package kvm
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	uartRBR = 0 // receive buffer (read, DLAB=0)
+	uartTHR = 0 // transmit holding (write, DLAB=0)
+	uartIER = 1 // interrupt enable (DLAB=0)
+	uartIIR = 2 // interrupt identification (read)
+	uartFCR = 2 // FIFO control (write)
+	uartLCR = 3 // line control
+	uartMCR = 4 // modem control
+	uartLSR = 5 // line status
+	uartMSR = 6 // modem status
+	uartSCR = 7 // scratch
+
+	uartIERRecv = 1 << 0
+	uartIERXmit = 1 << 1
+
+	uartIIRNone  = 0x01
+	uartIIRXmit  = 0x02
+	uartIIRRecv  = 0x04
+	uartIIRFIFOs = 0xc0
+
+	uartFCREnable = 1 << 0
+
+	uartLCRDLAB = 1 << 7
+
+	uartMCRLoop = 1 << 4
+
+	uartLSRDataReady = 1 << 0
+	uartLSRTHREmpty  = 1 << 5
+	uartLSRTxEmpty   = 1 << 6
+
+	uartMSRCTS = 1 << 4
+	uartMSRDSR = 1 << 5
+	uartMSRDCD = 1 << 7
+)
+
+// UART16550 emulates a 16550A serial port. Transmitted bytes are written to
+// out, and bytes read from in are made available to the guest.
+type UART16550 struct {
+	lock sync.Mutex
+	out  io.Writer
+	rx   []byte
+
+	ier, lcr, mcr, scr, fcr byte
+	dll, dlm                byte
+	xmitPending             bool
+
+	irq   func(level bool)
+	level bool
+}
+
+// NewUART16550 creates a 16550 UART. If in is non-nil, a goroutine copies
+// its contents into the receive buffer. The irq function is called whenever
+// the interrupt line changes level and may be nil.
+func NewUART16550(in io.Reader, out io.Writer, irq func(level bool)) *UART16550 {
+	u := &UART16550{
+		out: out,
+		irq: irq,
+	}
+	if in != nil {
+		go receive(in, u.receive)
+	}
+	return u
+}
+
+func (u *UART16550) receive(b []byte) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.rx = append(u.rx, b...)
+	u.update()
+}
+
+// update recomputes the interrupt line. Must be called with the lock held.
+func (u *UART16550) update() {
+	level := u.iir()&0x0f != uartIIRNone
+	if u.irq != nil && level != u.level {
+		u.level = level
+		u.irq(level)
+	}
+}
+
+func (u *UART16550) iir() byte {
+	var fifos byte
+	if u.fcr&uartFCREnable != 0 {
+		fifos = uartIIRFIFOs
+	}
+	if u.ier&uartIERRecv != 0 && len(u.rx) > 0 {
+		return fifos | uartIIRRecv
+	}
+	if u.ier&uartIERXmit != 0 && u.xmitPending {
+		return fifos | uartIIRXmit
+	}
+	return fifos | uartIIRNone
+}
+
+func (u *UART16550) Read(offset uint64, data []byte) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	var v byte
+	switch offset {
+	case uartRBR:
+		if u.lcr&uartLCRDLAB != 0 {
+			v = u.dll
+		} else if len(u.rx) > 0 {
+			v = u.rx[0]
+			u.rx = u.rx[1:]
+		}
+	case uartIER:
+		if u.lcr&uartLCRDLAB != 0 {
+			v = u.dlm
+		} else {
+			v = u.ier
+		}
+	case uartIIR:
+		v = u.iir()
+		if v&0x0f == uartIIRXmit {
+			// reading IIR acknowledges the transmitter interrupt
+			u.xmitPending = false
+		}
+	case uartLCR:
+		v = u.lcr
+	case uartMCR:
+		v = u.mcr
+	case uartLSR:
+		v = uartLSRTHREmpty | uartLSRTxEmpty
+		if len(u.rx) > 0 {
+			v |= uartLSRDataReady
+		}
+	case uartMSR:
+		v = uartMSRCTS | uartMSRDSR | uartMSRDCD
+	case uartSCR:
+		v = u.scr
+	}
+	fill(data, 0)
+	data[0] = v
+	u.update()
+	return nil
+}
+
+func (u *UART16550) Write(offset uint64, data []byte) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	v := data[0]
+	switch offset {
+	case uartTHR:
+		if u.lcr&uartLCRDLAB != 0 {
+			u.dll = v
+			break
+		}
+		if u.mcr&uartMCRLoop != 0 {
+			u.rx = append(u.rx, v)
+		} else if u.out != nil {
+			u.out.Write([]byte{v})
+		}
+		u.xmitPending = true
+	case uartIER:
+		if u.lcr&uartLCRDLAB != 0 {
+			u.dlm = v
+		} else {
+			u.ier = v & 0x0f
+			// enabling the transmitter interrupt raises it immediately
+			// since the holding register is always empty
+			u.xmitPending = u.ier&uartIERXmit != 0
+		}
+	case uartFCR:
+		u.fcr = v
+	case uartLCR:
+		u.lcr = v
+	case uartMCR:
+		u.mcr = v
+	case uartSCR:
+		u.scr = v
+	}
+	u.update()
+	return nil
+}
+
+// receive copies from r to fn until r returns an error.
+func receive(r io.Reader, fn func([]byte)) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			fn(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package kvm
+
+import (
+	"bytes"
+	"testing"
+)
+
+type irqLine struct {
+	level bool
+	edges int
+}
+
+func (l *irqLine) set(level bool) {
+	l.level = level
+	l.edges++
+}
+
+func TestUART16550(t *testing.T) {
+	var out bytes.Buffer
+	var irq irqLine
+	u := NewUART16550(nil, &out, irq.set)
+	read := func(off uint64) byte {
+		data := []byte{0xff}
+		u.Read(off, data)
+		return data[0]
+	}
+	write := func(off uint64, v byte) {
+		u.Write(off, []byte{v})
+	}
+
+	write(uartTHR, 'a')
+	write(uartTHR, 'b')
+	if out.String() != "ab" {
+		t.Errorf("transmitted %q", out.String())
+	}
+
+	// the divisor latch hides THR and IER
+	write(uartLCR, uartLCRDLAB)
+	write(uartTHR, 0x0c)
+	write(uartIER, 0x01)
+	if read(uartRBR) != 0x0c || read(uartIER) != 0x01 || out.Len() != 2 {
+		t.Error("divisor latch not selected by DLAB")
+	}
+	write(uartLCR, 0x03)
+
+	write(uartIER, uartIERRecv)
+	if irq.level || read(uartLSR)&uartLSRDataReady != 0 {
+		t.Fatal("data ready without input")
+	}
+	u.receive([]byte("hi"))
+	if !irq.level || read(uartIIR)&0x0f != uartIIRRecv || read(uartLSR)&uartLSRDataReady == 0 {
+		t.Fatal("received data not signalled")
+	}
+	if c1, c2 := read(uartRBR), read(uartRBR); c1 != 'h' || c2 != 'i' {
+		t.Errorf("received %q", []byte{c1, c2})
+	}
+	if irq.level || read(uartLSR)&uartLSRDataReady != 0 {
+		t.Error("interrupt still raised after the input was read")
+	}
+
+	// in loopback mode, transmitted bytes are received
+	write(uartMCR, uartMCRLoop)
+	write(uartTHR, 'x')
+	if read(uartRBR) != 'x' || out.Len() != 2 {
+		t.Error("loopback byte not received")
+	}
+
+	// enabling the transmitter interrupt raises it until IIR is read
+	write(uartIER, uartIERXmit)
+	if !irq.level || read(uartIIR)&0x0f != uartIIRXmit || irq.level {
+		t.Error("transmitter interrupt not raised and acknowledged")
+	}
+}
+
+func TestPL011(t *testing.T) {
+	var out bytes.Buffer
+	var irq irqLine
+	u := NewPL011(nil, &out, irq.set)
+	read := func(off uint64) uint32 {
+		data := make([]byte, 4)
+		u.Read(off, data)
+		return uint32(getLE(data))
+	}
+	write := func(off uint64, v uint32) {
+		data := make([]byte, 4)
+		putLE(data, uint64(v))
+		u.Write(off, data)
+	}
+
+	write(pl011DR, 'a')
+	if out.String() != "a" {
+		t.Errorf("transmitted %q", out.String())
+	}
+	if read(pl011FR)&pl011FRRXFE == 0 {
+		t.Error("receive FIFO not empty without input")
+	}
+
+	write(pl011IMSC, pl011IntRX)
+	if irq.level {
+		t.Fatal("interrupt raised without input")
+	}
+	u.receive([]byte("hi"))
+	if !irq.level || read(pl011FR)&pl011FRRXFE != 0 || read(pl011MIS) != pl011IntRX {
+		t.Fatal("received data not signalled")
+	}
+	if c1, c2 := read(pl011DR), read(pl011DR); c1 != 'h' || c2 != 'i' {
+		t.Errorf("received %q", []byte{byte(c1), byte(c2)})
+	}
+	if irq.level || read(pl011FR)&pl011FRRXFE == 0 {
+		t.Error("interrupt still raised after the input was read")
+	}
+
+	// the transmit interrupt is raised when unmasked and cleared through ICR
+	write(pl011IMSC, pl011IntTX)
+	if !irq.level {
+		t.Error("transmit interrupt not raised")
+	}
+	write(pl011ICR, pl011IntTX)
+	if irq.level || read(pl011RIS)&pl011IntTX != 0 {
+		t.Error("transmit interrupt not cleared")
+	}
+
+	for i, id := range pl011IDs {
+		if v := read(pl011ID + 4*uint64(i)); v != uint32(id) {
+			t.Errorf("ID register %d is %#x, want %#x", i, v, id)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// virtio-mmio register layout (virtio 1.1, section 4.2.2).
+const (
+	virtioMMIOMagicValue        = 0x000
+	virtioMMIOVersion           = 0x004
+	virtioMMIODeviceID          = 0x008
+	virtioMMIOVendorID          = 0x00c
+	virtioMMIODeviceFeatures    = 0x010
+	virtioMMIODeviceFeaturesSel = 0x014
+	virtioMMIODriverFeatures    = 0x020
+	virtioMMIODriverFeaturesSel = 0x024
+	virtioMMIOQueueSel          = 0x030
+	virtioMMIOQueueNumMax       = 0x034
+	virtioMMIOQueueNum          = 0x038
+	virtioMMIOQueueReady        = 0x044
+	virtioMMIOQueueNotify       = 0x050
+	virtioMMIOInterruptStatus   = 0x060
+	virtioMMIOInterruptACK      = 0x064
+	virtioMMIOStatus            = 0x070
+	virtioMMIOQueueDescLow      = 0x080
+	virtioMMIOQueueDescHigh     = 0x084
+	virtioMMIOQueueDriverLow    = 0x090
+	virtioMMIOQueueDriverHigh   = 0x094
+	virtioMMIOQueueDeviceLow    = 0x0a0
+	virtioMMIOQueueDeviceHigh   = 0x0a4
+	virtioMMIOConfigGeneration  = 0x0fc
+	virtioMMIOConfig            = 0x100
+
+	virtioMMIOMagic    = 0x74726976 // "virt"
+	virtioMMIOVendor   = 0x554d4551 // "QEMU", which guest drivers accept
+	virtioMMIOSize     = 0x200
+	virtioQueueNumMax  = 256
+	virtioFVersion1    = 1 << 32
+	virtioIntUsedRing  = 1 << 0
+	virtioIntConfig    = 1 << 1
+	virtioStatusFailed = 1 << 7
+
+	virtqDescFNext     = 1
+	virtqDescFWrite    = 2
+	virtqDescFIndirect = 4
+	// most descriptors accepted in a chain, including indirect ones
+	virtqMaxChain = 1024
+
+	virtqAvailFNoInterrupt = 1
+)
+
+const (
+	virtioIDNet     = 1
+	virtioIDBlock   = 2
+	virtioIDConsole = 3
+	virtioIDRNG     = 4
+	virtioID9P      = 9
+	virtioIDVsock   = 19
+)
+
+// virtioBackend implements the device-specific part of a virtio device. All
+// methods are called with the transport lock held.
+type virtioBackend interface {
+	deviceID() uint32
+	features() uint64
+	numQueues() int
+	readConfig(offset uint64, data []byte)
+	writeConfig(offset uint64, data []byte)
+	// notify is called when the driver makes buffers available in queue q.
+	notify(t *virtioMMIO, q int)
+	reset()
+}
+
+// virtioMMIO is a virtio-mmio transport. It implements Device.
+type virtioMMIO struct {
+	lock sync.Mutex
+	m    *Machine
+	dev  virtioBackend
+	irq  func(level bool)
+
+	status      uint32
+	devFeatSel  uint32
+	drvFeatSel  uint32
+	drvFeatures uint64
+	queueSel    uint32
+	intStatus   uint32
+	configGen   uint32
+	queues      []virtqueue
+}
+
+// addVirtio attaches a virtio backend to the next free virtio-mmio slot.
+// Guests discover devices by probing slots starting at virtioBase until the
+// magic value no longer matches.
+func (m *Machine) addVirtio(dev virtioBackend) (*virtioMMIO, error) {
+	slot := len(m.virtio)
+	if slot >= virtioMaxDevices {
+		return nil, errors.New("no free virtio-mmio slots")
+	}
+	t := &virtioMMIO{
+		m:      m,
+		dev:    dev,
+		irq:    m.irqLine(virtioIRQBase + uint32(slot)),
+		queues: make([]virtqueue, dev.numQueues()),
+	}
+	if err := m.RegisterMMIO(virtioBase+uint64(slot)*virtioMMIOSize, virtioMMIOSize, t); err != nil {
+		return nil, err
+	}
+	m.virtio = append(m.virtio, t)
+	return t, nil
+}
+
+func (t *virtioMMIO) Read(offset uint64, data []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if offset >= virtioMMIOConfig {
+		t.dev.readConfig(offset-virtioMMIOConfig, data)
+		return nil
+	}
+
+	var v uint32
+	q := t.selected()
+	switch offset {
+	case virtioMMIOMagicValue:
+		v = virtioMMIOMagic
+	case virtioMMIOVersion:
+		v = 2
+	case virtioMMIODeviceID:
+		v = t.dev.deviceID()
+	case virtioMMIOVendorID:
+		v = virtioMMIOVendor
+	case virtioMMIODeviceFeatures:
+		feat := t.dev.features() | virtioFVersion1
+		if t.devFeatSel < 2 {
+			v = uint32(feat >> (32 * t.devFeatSel))
+		}
+	case virtioMMIOQueueNumMax:
+		if q != nil {
+			v = virtioQueueNumMax
+		}
+	case virtioMMIOQueueReady:
+		if q != nil && q.ready {
+			v = 1
+		}
+	case virtioMMIOInterruptStatus:
+		v = t.intStatus
+	case virtioMMIOStatus:
+		v = t.status
+	case virtioMMIOConfigGeneration:
+		v = t.configGen
+	}
+	putLE(data, uint64(v))
+	return nil
+}
+
+func (t *virtioMMIO) Write(offset uint64, data []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if offset >= virtioMMIOConfig {
+		t.dev.writeConfig(offset-virtioMMIOConfig, data)
+		return nil
+	}
+
+	v := uint32(getLE(data))
+	q := t.selected()
+	switch offset {
+	case virtioMMIODeviceFeaturesSel:
+		t.devFeatSel = v
+	case virtioMMIODriverFeatures:
+		if t.drvFeatSel < 2 {
+			shift := 32 * t.drvFeatSel
+			t.drvFeatures = t.drvFeatures&^(0xffffffff<<shift) | uint64(v)<<shift
+		}
+	case virtioMMIODriverFeaturesSel:
+		t.drvFeatSel = v
+	case virtioMMIOQueueSel:
+		t.queueSel = v
+	case virtioMMIOQueueNum:
+		if q != nil && v <= virtioQueueNumMax && v&(v-1) == 0 {
+			q.num = uint16(v)
+		}
+	case virtioMMIOQueueReady:
+		if q != nil {
+			q.ready = v == 1
+		}
+	case virtioMMIOQueueNotify:
+		if int(v) < len(t.queues) && t.queues[v].ready {
+			t.dev.notify(t, int(v))
+		}
+	case virtioMMIOInterruptACK:
+		t.intStatus &^= v
+		if t.intStatus == 0 {
+			t.irq(false)
+		}
+	case virtioMMIOStatus:
+		if v == 0 {
+			t.reset()
+			break
+		}
+		t.status = v
+	case virtioMMIOQueueDescLow, virtioMMIOQueueDescHigh:
+		if q != nil {
+			setHalf(&q.desc, v, offset == virtioMMIOQueueDescHigh)
+		}
+	case virtioMMIOQueueDriverLow, virtioMMIOQueueDriverHigh:
+		if q != nil {
+			setHalf(&q.avail, v, offset == virtioMMIOQueueDriverHigh)
+		}
+	case virtioMMIOQueueDeviceLow, virtioMMIOQueueDeviceHigh:
+		if q != nil {
+			setHalf(&q.used, v, offset == virtioMMIOQueueDeviceHigh)
+		}
+	}
+	return nil
+}
+
+func setHalf(addr *uint64, v uint32, high bool) {
+	if high {
+		*addr = *addr&0xffffffff | uint64(v)<<32
+	} else {
+		*addr = *addr&^0xffffffff | uint64(v)
+	}
+}
+
+func (t *virtioMMIO) selected() *virtqueue {
+	if int(t.queueSel) < len(t.queues) {
+		return &t.queues[t.queueSel]
+	}
+	return nil
+}
+
+func (t *virtioMMIO) reset() {
+	t.status = 0
+	t.drvFeatures = 0
+	t.intStatus = 0
+	for i := range t.queues {
+		t.queues[i] = virtqueue{}
+	}
+	t.irq(false)
+	t.dev.reset()
+}
+
+// driverOK reports whether the driver has finished initializing the device.
+func (t *virtioMMIO) driverOK() bool {
+	const statusDriverOK = 1 << 2
+	return t.status&statusDriverOK != 0 && t.status&virtioStatusFailed == 0
+}
+
+// interrupt raises a used-buffer interrupt if the device added buffers to the
+// used ring of queue q since the last one, unless the driver suppressed it.
+func (t *virtioMMIO) interrupt(q int) {
+	vq := &t.queues[q]
+	if vq.usedIdx == vq.signalled {
+		return
+	}
+	vq.signalled = vq.usedIdx
+	if flags, err := vq.availFlags(t.m); err == nil && flags&virtqAvailFNoInterrupt != 0 {
+		return
+	}
+	t.intStatus |= virtioIntUsedRing
+	t.irq(true)
+}
+
+// configChanged notifies the driver that the configuration space changed.
+func (t *virtioMMIO) configChanged() {
+	t.configGen++
+	t.intStatus |= virtioIntConfig
+	t.irq(true)
+}
+
+// ErrVirtqueue is returned when the driver places malformed descriptors in a
+// virtqueue.
+var ErrVirtqueue = errors.New("malformed virtqueue")
+
+// virtqueue is a split virtqueue (virtio 1.1, section 2.6).
+type virtqueue struct {
+	num   uint16
+	ready bool
+	desc  uint64
+	avail uint64
+	used  uint64
+
+	lastAvail uint16
+	usedIdx   uint16
+	signalled uint16 // usedIdx at the last interrupt
+}
+
+type virtqDesc struct {
+	Addr  uint64
+	Len   uint32
+	Flags uint16
+	Next  uint16
+}
+
+// virtqChain is a descriptor chain popped from the available ring.
+type virtqChain struct {
+	head     uint16
+	readable [][]byte // buffers the device reads (the driver's output)
+	writable [][]byte // buffers the device writes (the driver's input)
+}
+
+func (c *virtqChain) readableLen() int {
+	n := 0
+	for _, b := range c.readable {
+		n += len(b)
+	}
+	return n
+}
+
+// read gathers all device-readable buffers into one slice.
+func (c *virtqChain) read() []byte {
+	if len(c.readable) == 1 {
+		return c.readable[0]
+	}
+	return gather(c.readable)
+}
+
+// write scatters data into the device-writable buffers and returns the
+// number of bytes written.
+func (c *virtqChain) write(data []byte) int {
+	return scatter(c.writable, data)
+}
+
+func (c *virtqChain) writableLen() int {
+	n := 0
+	for _, b := range c.writable {
+		n += len(b)
+	}
+	return n
+}
+
+func (q *virtqueue) availFlags(m *Machine) (uint16, error) {
+	b, err := m.PhysSlice(q.avail, 4)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&b[0])))), nil
+}
+
+// pending reports whether the driver has made buffers available that the
+// device has not consumed yet.
+func (q *virtqueue) pending(m *Machine) bool {
+	if !q.ready || q.num == 0 {
+		return false
+	}
+	b, err := m.PhysSlice(q.avail, 4)
+	if err != nil {
+		return false
+	}
+	idx := uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&b[0]))) >> 16)
+	return idx != q.lastAvail
+}
+
+// pop removes the next descriptor chain from the available ring. It returns
+// nil if no chain is available.
+func (q *virtqueue) pop(m *Machine) (*virtqChain, error) {
+	if !q.pending(m) {
+		return nil, nil
+	}
+	ring, err := m.PhysSlice(q.avail+4, 2*uint64(q.num))
+	if err != nil {
+		return nil, err
+	}
+	head := binary.LittleEndian.Uint16(ring[2*(q.lastAvail%q.num):])
+	q.lastAvail++
+
+	c := &virtqChain{head: head}
+	if err := q.walk(m, c, q.desc, q.num, head, false); err != nil {
+		// hand the chain back unused so that the driver does not lose it
+		if err := q.push(m, &virtqChain{head: head}, 0); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// walk adds the buffers of the descriptors chained from descriptor i of a
+// table of num descriptors to c. An indirect table may not contain indirect
+// descriptors itself.
+func (q *virtqueue) walk(m *Machine, c *virtqChain, table uint64, num, i uint16, indirect bool) error {
+	for n := 0; ; n++ {
+		if i >= num || n >= int(num) || len(c.readable)+len(c.writable) >= virtqMaxChain {
+			return fmt.Errorf("%w: descriptor %d", ErrVirtqueue, i)
+		}
+		b, err := m.PhysSlice(table+16*uint64(i), 16)
+		if err != nil {
+			return err
+		}
+		d := virtqDesc{
+			Addr:  binary.LittleEndian.Uint64(b[0:]),
+			Len:   binary.LittleEndian.Uint32(b[8:]),
+			Flags: binary.LittleEndian.Uint16(b[12:]),
+			Next:  binary.LittleEndian.Uint16(b[14:]),
+		}
+		if d.Flags&virtqDescFIndirect != 0 {
+			if indirect || d.Len%16 != 0 || d.Len/16 > virtqMaxChain {
+				return fmt.Errorf("%w: indirect descriptor %d", ErrVirtqueue, i)
+			}
+			if err := q.walk(m, c, d.Addr, uint16(d.Len/16), 0, true); err != nil {
+				return err
+			}
+		} else {
+			buf, err := m.PhysSlice(d.Addr, uint64(d.Len))
+			if err != nil {
+				return err
+			}
+			if d.Flags&virtqDescFWrite != 0 {
+				c.writable = append(c.writable, buf)
+			} else {
+				c.readable = append(c.readable, buf)
+			}
+		}
+		if d.Flags&virtqDescFNext == 0 {
+			return nil
+		}
+		i = d.Next
+	}
+}
+
+// push returns a chain to the driver through the used ring, recording that
+// n bytes were written to it.
+func (q *virtqueue) push(m *Machine, c *virtqChain, n int) error {
+	b, err := m.PhysSlice(q.used, 4+8*uint64(q.num))
+	if err != nil {
+		return err
+	}
+	elem := b[4+8*uint64(q.usedIdx%q.num):]
+	binary.LittleEndian.PutUint32(elem[0:], uint32(c.head))
+	binary.LittleEndian.PutUint32(elem[4:], uint32(n))
+	q.usedIdx++
+	// The flags and idx fields are both owned by the device, so publish them
+	// together with a single atomic store.
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&b[0])), uint32(q.usedIdx)<<16)
+	return nil
+}
+
+// splitBufs splits a scatter list at byte offset n.
+func splitBufs(bufs [][]byte, n int) ([][]byte, [][]byte) {
+	var head [][]byte
+	for len(bufs) > 0 && n > 0 {
+		if len(bufs[0]) > n {
+			head = append(head, bufs[0][:n])
+			bufs = append([][]byte{bufs[0][n:]}, bufs[1:]...)
+			break
+		}
+		head = append(head, bufs[0])
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	return head, bufs
+}
+
+// gather concatenates a scatter list.
+func gather(bufs [][]byte) []byte {
+	var b []byte
+	for _, buf := range bufs {
+		b = append(b, buf...)
+	}
+	return b
+}
+
+// scatter copies data into a scatter list and returns the number of bytes
+// copied.
+func scatter(bufs [][]byte, data []byte) int {
+	n := 0
+	for _, buf := range bufs {
+		m := copy(buf, data[n:])
+		n += m
+		if n == len(data) {
+			break
+		}
+	}
+	return n
+}
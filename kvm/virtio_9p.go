@@ -0,0 +1,96 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+const (
+	virtio9PFMountTag = 1 << 0
+
+	virtio9PMaxTagLen = 255
+)
+
+// P9Handler serves 9P messages received by a virtio-9p device.
+type P9Handler interface {
+	// Handle9P processes one request message and returns the response
+	// message. The request is only valid for the duration of the call.
+	Handle9P(req []byte) []byte
+}
+
+// Virtio9P is a virtio-9p device. The guest mounts it by its tag and sends
+// 9P requests through a single request queue; each descriptor chain holds a
+// request followed by space for the response.
+type Virtio9P struct {
+	t   *virtioMMIO
+	tag string
+	h   P9Handler
+}
+
+// Add9P attaches a virtio-9p device with the given mount tag whose requests
+// are served by h.
+func (m *Machine) Add9P(tag string, h P9Handler) (*Virtio9P, error) {
+	if tag == "" || len(tag) > virtio9PMaxTagLen {
+		return nil, fmt.Errorf("invalid 9p mount tag %q", tag)
+	}
+	p := &Virtio9P{
+		tag: tag,
+		h:   h,
+	}
+	t, err := m.addVirtio(p)
+	if err != nil {
+		return nil, err
+	}
+	p.t = t
+	return p, nil
+}
+
+func (p *Virtio9P) deviceID() uint32 {
+	return virtioID9P
+}
+
+func (p *Virtio9P) features() uint64 {
+	return virtio9PFMountTag
+}
+
+func (p *Virtio9P) numQueues() int {
+	return 1
+}
+
+func (p *Virtio9P) readConfig(offset uint64, data []byte) {
+	cfg := make([]byte, 2+len(p.tag))
+	binary.LittleEndian.PutUint16(cfg, uint16(len(p.tag)))
+	copy(cfg[2:], p.tag)
+	copyConfig(data, cfg, offset)
+}
+
+func (p *Virtio9P) writeConfig(offset uint64, data []byte) {}
+
+func (p *Virtio9P) reset() {}
+
+// notify serves all pending requests, so a guest can batch several
+// operations into a single exit.
+func (p *Virtio9P) notify(t *virtioMMIO, q int) {
+	vq := &t.queues[q]
+	for {
+		chain, err := vq.pop(t.m)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "virtio-9p: %v\n", err)
+			break
+		}
+		if chain == nil {
+			break
+		}
+		resp := p.h.Handle9P(chain.read())
+		if len(resp) > chain.writableLen() {
+			fmt.Fprintf(os.Stderr, "virtio-9p: response of %d bytes does not fit in %d byte buffer\n", len(resp), chain.writableLen())
+			resp = nil
+		}
+		if err := vq.push(t.m, chain, chain.write(resp)); err != nil {
+			fmt.Fprintf(os.Stderr, "virtio-9p: %v\n", err)
+			break
+		}
+	}
+	t.interrupt(q)
+}
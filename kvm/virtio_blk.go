@@ -0,0 +1,203 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const (
+	virtioBlkFSegMax  = 1 << 2
+	virtioBlkFRO      = 1 << 5
+	virtioBlkFBlkSize = 1 << 6
+	virtioBlkFFlush   = 1 << 9
+	virtioBlkFDiscard = 1 << 13
+
+	virtioBlkTIn      = 0
+	virtioBlkTOut     = 1
+	virtioBlkTFlush   = 4
+	virtioBlkTGetID   = 8
+	virtioBlkTDiscard = 11
+
+	virtioBlkSOK     = 0
+	virtioBlkSIOErr  = 1
+	virtioBlkSUnsupp = 2
+
+	virtioBlkSectorSize = 512
+	virtioBlkSegMax     = 128
+	virtioBlkIDBytes    = 20
+
+	fallocPunchHole = 0x02
+	fallocKeepSize  = 0x01
+)
+
+// VirtioBlock is a virtio block device backed by a raw image file.
+type VirtioBlock struct {
+	t        *virtioMMIO
+	file     *os.File
+	readOnly bool
+	sectors  uint64
+}
+
+// AddBlock attaches a virtio block device backed by the raw image f. If
+// readOnly is set, the device advertises VIRTIO_BLK_F_RO and rejects writes
+// and discards.
+func (m *Machine) AddBlock(f *os.File, readOnly bool) (*VirtioBlock, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b := &VirtioBlock{
+		file:     f,
+		readOnly: readOnly,
+		sectors:  uint64(info.Size()) / virtioBlkSectorSize,
+	}
+	t, err := m.addVirtio(b)
+	if err != nil {
+		return nil, err
+	}
+	b.t = t
+	return b, nil
+}
+
+func (b *VirtioBlock) deviceID() uint32 {
+	return virtioIDBlock
+}
+
+func (b *VirtioBlock) features() uint64 {
+	feat := uint64(virtioBlkFSegMax | virtioBlkFBlkSize | virtioBlkFFlush)
+	if b.readOnly {
+		feat |= virtioBlkFRO
+	} else {
+		feat |= virtioBlkFDiscard
+	}
+	return feat
+}
+
+func (b *VirtioBlock) numQueues() int {
+	return 1
+}
+
+func (b *VirtioBlock) readConfig(offset uint64, data []byte) {
+	var cfg [60]byte
+	binary.LittleEndian.PutUint64(cfg[0:], b.sectors)
+	binary.LittleEndian.PutUint32(cfg[12:], virtioBlkSegMax)
+	binary.LittleEndian.PutUint32(cfg[20:], virtioBlkSectorSize)
+	binary.LittleEndian.PutUint32(cfg[36:], ^uint32(0)) // max_discard_sectors
+	binary.LittleEndian.PutUint32(cfg[40:], 1)          // max_discard_seg
+	binary.LittleEndian.PutUint32(cfg[44:], 1)          // discard_sector_alignment
+	copyConfig(data, cfg[:], offset)
+}
+
+func (b *VirtioBlock) writeConfig(offset uint64, data []byte) {}
+
+func (b *VirtioBlock) reset() {}
+
+func (b *VirtioBlock) notify(t *virtioMMIO, q int) {
+	vq := &t.queues[q]
+	for {
+		chain, err := vq.pop(t.m)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "virtio-blk: %v\n", err)
+			break
+		}
+		if chain == nil {
+			break
+		}
+		n := b.request(chain)
+		if err := vq.push(t.m, chain, n); err != nil {
+			fmt.Fprintf(os.Stderr, "virtio-blk: %v\n", err)
+			break
+		}
+	}
+	t.interrupt(q)
+}
+
+// request handles one request and returns the number of bytes written to the
+// chain, including the status byte.
+func (b *VirtioBlock) request(chain *virtqChain) int {
+	const hdrSize = 16
+	hdr, src := splitBufs(chain.readable, hdrSize)
+	hdrb := gather(hdr)
+	total := chain.writableLen()
+	if len(hdrb) < hdrSize || total < 1 {
+		return 0
+	}
+	dst, status := splitBufs(chain.writable, total-1)
+
+	typ := binary.LittleEndian.Uint32(hdrb[0:])
+	sector := binary.LittleEndian.Uint64(hdrb[8:])
+	off := int64(sector * virtioBlkSectorSize)
+
+	n, s := 0, byte(virtioBlkSOK)
+	switch typ {
+	case virtioBlkTIn:
+		if !b.inRange(sector, uint64(total-1)) {
+			s = virtioBlkSIOErr
+			break
+		}
+		for _, buf := range dst {
+			m, err := b.file.ReadAt(buf, off)
+			fill(buf[m:], 0)
+			if err != nil && m == 0 && len(buf) > 0 {
+				s = virtioBlkSIOErr
+				break
+			}
+			off += int64(len(buf))
+			n += len(buf)
+		}
+	case virtioBlkTOut:
+		if b.readOnly || !b.inRange(sector, uint64(chain.readableLen()-hdrSize)) {
+			s = virtioBlkSIOErr
+			break
+		}
+		for _, buf := range src {
+			if _, err := b.file.WriteAt(buf, off); err != nil {
+				s = virtioBlkSIOErr
+				break
+			}
+			off += int64(len(buf))
+		}
+	case virtioBlkTFlush:
+		if err := b.file.Sync(); err != nil {
+			s = virtioBlkSIOErr
+		}
+	case virtioBlkTGetID:
+		id := make([]byte, virtioBlkIDBytes)
+		copy(id, "revisor")
+		n = scatter(dst, id)
+	case virtioBlkTDiscard:
+		if b.readOnly {
+			s = virtioBlkSIOErr
+			break
+		}
+		s = b.discard(gather(src))
+	default:
+		s = virtioBlkSUnsupp
+	}
+	scatter(status, []byte{s})
+	return n + 1
+}
+
+// inRange reports whether the n bytes starting at sector are on the disk.
+func (b *VirtioBlock) inRange(sector, n uint64) bool {
+	return sector <= b.sectors && n <= (b.sectors-sector)*virtioBlkSectorSize
+}
+
+// discard punches holes in the image for each discard segment in segs.
+func (b *VirtioBlock) discard(segs []byte) byte {
+	const segSize = 16
+	for ; len(segs) >= segSize; segs = segs[segSize:] {
+		sector := binary.LittleEndian.Uint64(segs[0:])
+		num := binary.LittleEndian.Uint32(segs[8:])
+		if !b.inRange(sector, uint64(num)*virtioBlkSectorSize) {
+			return virtioBlkSIOErr
+		}
+		err := syscall.Fallocate(int(b.file.Fd()), fallocPunchHole|fallocKeepSize, int64(sector)*virtioBlkSectorSize, int64(num)*virtioBlkSectorSize)
+		if err != nil {
+			return virtioBlkSIOErr
+		}
+	}
+	return virtioBlkSOK
+}
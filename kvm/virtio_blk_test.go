@@ -0,0 +1,55 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockWriteOutOfRange(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(8 * virtioBlkSectorSize); err != nil {
+		t.Fatal(err)
+	}
+	b := &VirtioBlock{file: f, sectors: 8}
+
+	write := func(sector uint64, n int) byte {
+		hdr := make([]byte, 16)
+		binary.LittleEndian.PutUint32(hdr[0:], virtioBlkTOut)
+		binary.LittleEndian.PutUint64(hdr[8:], sector)
+		status := []byte{0xff}
+		b.request(&virtqChain{
+			readable: [][]byte{hdr, make([]byte, n)},
+			writable: [][]byte{status},
+		})
+		return status[0]
+	}
+	for _, tt := range []struct {
+		sector uint64
+		n      int
+		status byte
+	}{
+		{7, virtioBlkSectorSize, virtioBlkSOK},
+		{7, 2 * virtioBlkSectorSize, virtioBlkSIOErr},
+		{8, virtioBlkSectorSize, virtioBlkSIOErr},
+		{1 << 60, virtioBlkSectorSize, virtioBlkSIOErr},
+		// wraps to sector 0 when multiplied by the sector size
+		{1 << 55, virtioBlkSectorSize, virtioBlkSIOErr},
+	} {
+		if s := write(tt.sector, tt.n); s != tt.status {
+			t.Errorf("write of %d bytes at sector %d: status %d, want %d", tt.n, tt.sector, s, tt.status)
+		}
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 8*virtioBlkSectorSize {
+		t.Errorf("image grew to %d bytes", info.Size())
+	}
+}
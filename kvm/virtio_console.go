@@ -0,0 +1,307 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	virtioConsoleFSize       = 1 << 0
+	virtioConsoleFMultiport  = 1 << 1
+	virtioConsoleFEmergWrite = 1 << 2
+
+	virtioConsoleDeviceReady  = 0
+	virtioConsoleDeviceAdd    = 1
+	virtioConsoleDeviceRemove = 2
+	virtioConsolePortReady    = 3
+	virtioConsoleConsolePort  = 4
+	virtioConsoleResize       = 5
+	virtioConsolePortOpen     = 6
+	virtioConsolePortName     = 7
+
+	virtioConsoleCtrlRx = 2
+	virtioConsoleCtrlTx = 3
+)
+
+// ConsolePort is an extra named port of a virtio console. Data written by the
+// guest to the port is written to Conn, and data read from Conn is sent to
+// the guest.
+type ConsolePort struct {
+	Name string
+	Conn io.ReadWriter
+}
+
+type consolePort struct {
+	name string
+	in   io.Reader
+	out  io.Writer
+	rx   []byte
+	open bool
+}
+
+// VirtioConsole is a virtio console device. Port 0 is the console itself and
+// additional ports are announced to the guest through the multiport control
+// queues.
+type VirtioConsole struct {
+	t     *virtioMMIO
+	ports []*consolePort
+	ctrl  [][]byte
+}
+
+// AddConsole attaches a virtio console whose port 0 is connected to in and
+// out, with extra named ports.
+func (m *Machine) AddConsole(in io.Reader, out io.Writer, ports ...ConsolePort) (*VirtioConsole, error) {
+	c := &VirtioConsole{
+		ports: []*consolePort{{in: in, out: out}},
+	}
+	for _, p := range ports {
+		c.ports = append(c.ports, &consolePort{
+			name: p.Name,
+			in:   p.Conn,
+			out:  p.Conn,
+		})
+	}
+	t, err := m.addVirtio(c)
+	if err != nil {
+		return nil, err
+	}
+	c.t = t
+	for i, p := range c.ports {
+		if p.in != nil {
+			i := i
+			go receive(p.in, func(b []byte) {
+				c.receive(i, b)
+			})
+		}
+	}
+	return c, nil
+}
+
+func (c *VirtioConsole) receive(port int, b []byte) {
+	c.t.lock.Lock()
+	defer c.t.lock.Unlock()
+	p := c.ports[port]
+	p.rx = append(p.rx, b...)
+	if err := c.flushRx(port); err != nil {
+		fmt.Fprintf(os.Stderr, "virtio-console: %v\n", err)
+	}
+}
+
+// Port 0 uses queues 0 and 1, the control queues are 2 and 3, and port n
+// uses queues 2n+2 and 2n+3.
+func rxQueue(port int) int {
+	if port == 0 {
+		return 0
+	}
+	return 2*port + 2
+}
+
+func queuePort(q int) int {
+	if q < 2 {
+		return 0
+	}
+	return (q - 2) / 2
+}
+
+func (c *VirtioConsole) deviceID() uint32 {
+	return virtioIDConsole
+}
+
+func (c *VirtioConsole) features() uint64 {
+	return virtioConsoleFMultiport | virtioConsoleFEmergWrite
+}
+
+func (c *VirtioConsole) numQueues() int {
+	return 2*len(c.ports) + 2
+}
+
+func (c *VirtioConsole) readConfig(offset uint64, data []byte) {
+	var cfg [12]byte
+	binary.LittleEndian.PutUint32(cfg[4:], uint32(len(c.ports)))
+	copyConfig(data, cfg[:], offset)
+}
+
+func (c *VirtioConsole) writeConfig(offset uint64, data []byte) {
+	const emergWr = 8
+	if offset == emergWr && c.ports[0].out != nil {
+		c.ports[0].out.Write(data[:1])
+	}
+}
+
+func (c *VirtioConsole) reset() {
+	c.ctrl = nil
+	for _, p := range c.ports {
+		p.open = false
+	}
+}
+
+func (c *VirtioConsole) notify(t *virtioMMIO, q int) {
+	var err error
+	switch {
+	case q == virtioConsoleCtrlRx:
+		err = c.flushCtrl()
+	case q == virtioConsoleCtrlTx:
+		err = c.control()
+	case q%2 == 0:
+		err = c.flushRx(queuePort(q))
+	default:
+		err = c.transmit(q)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "virtio-console: %v\n", err)
+	}
+}
+
+// flushRx copies pending host data for port into the port's receive queue.
+func (c *VirtioConsole) flushRx(port int) error {
+	p := c.ports[port]
+	q := rxQueue(port)
+	vq := &c.t.queues[q]
+	used := false
+	for len(p.rx) > 0 {
+		chain, err := vq.pop(c.t.m)
+		if err != nil {
+			return err
+		}
+		if chain == nil {
+			break
+		}
+		n := chain.write(p.rx)
+		p.rx = p.rx[n:]
+		if err := vq.push(c.t.m, chain, n); err != nil {
+			return err
+		}
+		used = true
+	}
+	if used {
+		c.t.interrupt(q)
+	}
+	return nil
+}
+
+// transmit writes guest output from transmit queue q to its port.
+func (c *VirtioConsole) transmit(q int) error {
+	p := c.ports[queuePort(q)]
+	vq := &c.t.queues[q]
+	for {
+		chain, err := vq.pop(c.t.m)
+		if err != nil {
+			return err
+		}
+		if chain == nil {
+			break
+		}
+		if p.out != nil {
+			for _, b := range chain.readable {
+				p.out.Write(b)
+			}
+		}
+		if err := vq.push(c.t.m, chain, 0); err != nil {
+			return err
+		}
+	}
+	c.t.interrupt(q)
+	return nil
+}
+
+func (c *VirtioConsole) sendCtrl(id uint32, event, value uint16, extra []byte) {
+	msg := make([]byte, 8, 8+len(extra))
+	binary.LittleEndian.PutUint32(msg[0:], id)
+	binary.LittleEndian.PutUint16(msg[4:], event)
+	binary.LittleEndian.PutUint16(msg[6:], value)
+	c.ctrl = append(c.ctrl, append(msg, extra...))
+}
+
+// control handles control messages sent by the guest.
+func (c *VirtioConsole) control() error {
+	vq := &c.t.queues[virtioConsoleCtrlTx]
+	for {
+		chain, err := vq.pop(c.t.m)
+		if err != nil {
+			return err
+		}
+		if chain == nil {
+			break
+		}
+		msg := chain.read()
+		if err := vq.push(c.t.m, chain, 0); err != nil {
+			return err
+		}
+		if len(msg) < 8 {
+			continue
+		}
+		id := binary.LittleEndian.Uint32(msg[0:])
+		event := binary.LittleEndian.Uint16(msg[4:])
+		value := binary.LittleEndian.Uint16(msg[6:])
+
+		switch event {
+		case virtioConsoleDeviceReady:
+			if value != 1 {
+				break
+			}
+			for i := range c.ports {
+				c.sendCtrl(uint32(i), virtioConsoleDeviceAdd, 0, nil)
+			}
+		case virtioConsolePortReady:
+			if value != 1 || int(id) >= len(c.ports) {
+				break
+			}
+			if id == 0 {
+				c.sendCtrl(id, virtioConsoleConsolePort, 1, nil)
+			}
+			if name := c.ports[id].name; name != "" {
+				c.sendCtrl(id, virtioConsolePortName, 1, append([]byte(name), 0))
+			}
+			c.sendCtrl(id, virtioConsolePortOpen, 1, nil)
+		case virtioConsolePortOpen:
+			if int(id) < len(c.ports) {
+				c.ports[id].open = value == 1
+			}
+		}
+	}
+	c.t.interrupt(virtioConsoleCtrlTx)
+	return c.flushCtrl()
+}
+
+// flushCtrl delivers pending control messages to the guest.
+func (c *VirtioConsole) flushCtrl() error {
+	vq := &c.t.queues[virtioConsoleCtrlRx]
+	used := false
+	for len(c.ctrl) > 0 {
+		chain, err := vq.pop(c.t.m)
+		if err != nil {
+			return err
+		}
+		if chain == nil {
+			break
+		}
+		n := chain.write(c.ctrl[0])
+		c.ctrl = c.ctrl[1:]
+		if err := vq.push(c.t.m, chain, n); err != nil {
+			return err
+		}
+		used = true
+	}
+	if used {
+		c.t.interrupt(virtioConsoleCtrlRx)
+	}
+	return nil
+}
+
+// PortOpen reports whether the guest has opened the given port.
+func (c *VirtioConsole) PortOpen(port int) bool {
+	c.t.lock.Lock()
+	defer c.t.lock.Unlock()
+	return port < len(c.ports) && c.ports[port].open
+}
+
+// copyConfig copies the part of a device configuration space at offset into
+// data.
+func copyConfig(data, cfg []byte, offset uint64) {
+	fill(data, 0)
+	if offset < uint64(len(cfg)) {
+		copy(data, cfg[offset:])
+	}
+}
@@ -0,0 +1,51 @@
+package kvm
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+type pipePort struct {
+	io.Reader
+	io.Writer
+}
+
+func TestConsolePortInput(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	var ports []ConsolePort
+	var inputs []*io.PipeWriter
+	for _, name := range []string{"a", "b"} {
+		r, w := io.Pipe()
+		defer w.Close()
+		ports = append(ports, ConsolePort{Name: name, Conn: pipePort{r, io.Discard}})
+		inputs = append(inputs, w)
+	}
+	c, err := m.AddConsole(nil, nil, ports...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs[0].Write([]byte("to a"))
+	inputs[1].Write([]byte("to b"))
+
+	// the guest has not set up its receive queues, so input stays buffered
+	rx := func(port int) []byte {
+		c.t.lock.Lock()
+		defer c.t.lock.Unlock()
+		return append([]byte(nil), c.ports[port].rx...)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rx(1)) < 4 || len(rx(2)) < 4 {
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := rx(1); !bytes.Equal(got, []byte("to a")) {
+		t.Errorf("port a received %q", got)
+	}
+	if got := rx(2); !bytes.Equal(got, []byte("to b")) {
+		t.Errorf("port b received %q", got)
+	}
+}
@@ -0,0 +1,174 @@
+package kvm
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+const (
+	virtioNetFMAC    = 1 << 5
+	virtioNetFStatus = 1 << 16
+
+	virtioNetSLinkUp = 1
+
+	virtioNetHdrSize = 12
+	virtioNetRx      = 0
+	virtioNetTx      = 1
+
+	// maximum number of received frames buffered while the guest has no
+	// receive buffers available
+	virtioNetRxPending = 256
+)
+
+// NetBackend carries Ethernet frames between a virtio-net device and the
+// host.
+type NetBackend interface {
+	// Attach registers the function that delivers frames to the guest. The
+	// function may be called from any goroutine, including from within Send.
+	Attach(recv func(frame []byte))
+	// Send transmits a frame sent by the guest. The frame is only valid for
+	// the duration of the call.
+	Send(frame []byte) error
+	Close() error
+}
+
+// VirtioNet is a virtio network device connected to a NetBackend.
+type VirtioNet struct {
+	t       *virtioMMIO
+	mac     net.HardwareAddr
+	backend NetBackend
+	rx      chan []byte
+	pending [][]byte
+}
+
+// AddNet attaches a virtio network device with the given MAC address to
+// backend.
+func (m *Machine) AddNet(mac net.HardwareAddr, backend NetBackend) (*VirtioNet, error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %v", mac)
+	}
+	n := &VirtioNet{
+		mac:     mac,
+		backend: backend,
+		rx:      make(chan []byte, virtioNetRxPending),
+	}
+	t, err := m.addVirtio(n)
+	if err != nil {
+		return nil, err
+	}
+	n.t = t
+	backend.Attach(n.receive)
+	go n.deliver()
+	return n, nil
+}
+
+// receive queues a frame for the guest. Frames are dropped if the queue is
+// full, as a physical NIC would.
+func (n *VirtioNet) receive(frame []byte) {
+	select {
+	case n.rx <- append([]byte(nil), frame...):
+	default:
+	}
+}
+
+// deliver moves received frames into the guest's receive queue. It runs in
+// its own goroutine so that backends can deliver frames from within Send
+// without reacquiring the transport lock.
+func (n *VirtioNet) deliver() {
+	for frame := range n.rx {
+		n.t.lock.Lock()
+		if len(n.pending) < virtioNetRxPending {
+			n.pending = append(n.pending, frame)
+		}
+		if err := n.flushRx(); err != nil {
+			fmt.Fprintf(os.Stderr, "virtio-net: %v\n", err)
+		}
+		n.t.lock.Unlock()
+	}
+}
+
+func (n *VirtioNet) deviceID() uint32 {
+	return virtioIDNet
+}
+
+func (n *VirtioNet) features() uint64 {
+	return virtioNetFMAC | virtioNetFStatus
+}
+
+func (n *VirtioNet) numQueues() int {
+	return 2
+}
+
+func (n *VirtioNet) readConfig(offset uint64, data []byte) {
+	var cfg [12]byte
+	copy(cfg[0:6], n.mac)
+	cfg[6] = virtioNetSLinkUp
+	cfg[8] = 1 // max_virtqueue_pairs
+	copyConfig(data, cfg[:], offset)
+}
+
+func (n *VirtioNet) writeConfig(offset uint64, data []byte) {}
+
+func (n *VirtioNet) reset() {}
+
+func (n *VirtioNet) notify(t *virtioMMIO, q int) {
+	var err error
+	switch q {
+	case virtioNetRx:
+		err = n.flushRx()
+	case virtioNetTx:
+		err = n.transmit()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "virtio-net: %v\n", err)
+	}
+}
+
+func (n *VirtioNet) flushRx() error {
+	vq := &n.t.queues[virtioNetRx]
+	used := false
+	for len(n.pending) > 0 {
+		chain, err := vq.pop(n.t.m)
+		if err != nil {
+			return err
+		}
+		if chain == nil {
+			break
+		}
+		var hdr [virtioNetHdrSize]byte
+		hdr[10] = 1 // num_buffers
+		w := chain.write(append(hdr[:], n.pending[0]...))
+		n.pending = n.pending[1:]
+		if err := vq.push(n.t.m, chain, w); err != nil {
+			return err
+		}
+		used = true
+	}
+	if used {
+		n.t.interrupt(virtioNetRx)
+	}
+	return nil
+}
+
+func (n *VirtioNet) transmit() error {
+	vq := &n.t.queues[virtioNetTx]
+	for {
+		chain, err := vq.pop(n.t.m)
+		if err != nil {
+			return err
+		}
+		if chain == nil {
+			break
+		}
+		_, frame := splitBufs(chain.readable, virtioNetHdrSize)
+		if err := n.backend.Send(gather(frame)); err != nil {
+			fmt.Fprintf(os.Stderr, "virtio-net: %v\n", err)
+		}
+		if err := vq.push(n.t.m, chain, 0); err != nil {
+			return err
+		}
+	}
+	n.t.interrupt(virtioNetTx)
+	return nil
+}
@@ -0,0 +1,72 @@
+package kvm
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetLoopback(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	n, err := m.AddNet(mac, NewLoopbackNet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.t.lock.Lock()
+	rx := newTestQueue(m, &n.t.queues[virtioNetRx], physRamBase+0x10000)
+	tx := newTestQueue(m, &n.t.queues[virtioNetTx], physRamBase+0x20000)
+	n.t.lock.Unlock()
+
+	// waitRx waits until the guest has received count frames and returns the
+	// length of the last one.
+	waitRx := func(count int) int {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			n.t.lock.Lock()
+			used, size := rx.used()
+			n.t.lock.Unlock()
+			if used == count {
+				return size
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("guest received %d frames, want %d", used, count)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	send := func(frame []byte) {
+		n.t.lock.Lock()
+		defer n.t.lock.Unlock()
+		tx.add([][]byte{make([]byte, virtioNetHdrSize), frame}, nil)
+		n.notify(n.t, virtioNetTx)
+		if used, _ := tx.used(); used == 0 {
+			t.Fatal("transmitted frame not returned to the guest")
+		}
+	}
+	check := func(buf uint64, size int, frame []byte) {
+		got := m.Slice(buf, buf+uint64(size))
+		if size != virtioNetHdrSize+len(frame) || got[10] != 1 || !bytes.Equal(got[virtioNetHdrSize:], frame) {
+			t.Errorf("guest received % x, want % x after the header", got, frame)
+		}
+	}
+
+	frame1 := append(append(mac, mac...), 0x08, 0x00, 1, 2, 3, 4)
+	n.t.lock.Lock()
+	buf := rx.add(nil, []int{2048})[0]
+	n.t.lock.Unlock()
+	send(frame1)
+	check(buf, waitRx(1), frame1)
+
+	// a frame received while the guest has no receive buffers is delivered
+	// once it adds one
+	frame2 := append(append(mac, mac...), 0x08, 0x00, 5, 6, 7, 8)
+	send(frame2)
+	time.Sleep(10 * time.Millisecond)
+	n.t.lock.Lock()
+	buf = rx.add(nil, []int{2048})[0]
+	n.notify(n.t, virtioNetRx)
+	n.t.lock.Unlock()
+	check(buf, waitRx(2), frame2)
+}
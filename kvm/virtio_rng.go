@@ -0,0 +1,74 @@
+package kvm
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// VirtioRNG is a virtio entropy device that fills guest buffers from an
+// io.Reader.
+type VirtioRNG struct {
+	t *virtioMMIO
+	r io.Reader
+}
+
+// AddRNG attaches a virtio entropy device backed by r, which is typically
+// crypto/rand.Reader.
+func (m *Machine) AddRNG(r io.Reader) (*VirtioRNG, error) {
+	rng := &VirtioRNG{r: r}
+	t, err := m.addVirtio(rng)
+	if err != nil {
+		return nil, err
+	}
+	rng.t = t
+	return rng, nil
+}
+
+func (rng *VirtioRNG) deviceID() uint32 {
+	return virtioIDRNG
+}
+
+func (rng *VirtioRNG) features() uint64 {
+	return 0
+}
+
+func (rng *VirtioRNG) numQueues() int {
+	return 1
+}
+
+func (rng *VirtioRNG) readConfig(offset uint64, data []byte) {
+	fill(data, 0)
+}
+
+func (rng *VirtioRNG) writeConfig(offset uint64, data []byte) {}
+
+func (rng *VirtioRNG) reset() {}
+
+func (rng *VirtioRNG) notify(t *virtioMMIO, q int) {
+	vq := &t.queues[q]
+	for {
+		chain, err := vq.pop(t.m)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "virtio-rng: %v\n", err)
+			break
+		}
+		if chain == nil {
+			break
+		}
+		n := 0
+		for _, b := range chain.writable {
+			k, err := io.ReadFull(rng.r, b)
+			n += k
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "virtio-rng: %v\n", err)
+				break
+			}
+		}
+		if err := vq.push(t.m, chain, n); err != nil {
+			fmt.Fprintf(os.Stderr, "virtio-rng: %v\n", err)
+			break
+		}
+	}
+	t.interrupt(q)
+}
@@ -0,0 +1,28 @@
+package kvm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRNGFillsBuffers(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	src := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7}, 100)
+	rng, err := m.AddRNG(bytes.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng.t.lock.Lock()
+	defer rng.t.lock.Unlock()
+	q := newTestQueue(m, &rng.t.queues[0], physRamBase+0x10000)
+	bufs := q.add(nil, []int{16, 48})
+	rng.notify(rng.t, 0)
+
+	if used, n := q.used(); used != 1 || n != 64 {
+		t.Fatalf("%d chains used with %d bytes, want one with 64", used, n)
+	}
+	got := append(append([]byte(nil), m.Slice(bufs[0], bufs[0]+16)...), m.Slice(bufs[1], bufs[1]+48)...)
+	if !bytes.Equal(got, src[:64]) {
+		t.Error("buffers not filled from the entropy source")
+	}
+}
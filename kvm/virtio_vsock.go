@@ -0,0 +1,739 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	vsockRx    = 0
+	vsockTx    = 1
+	vsockEvent = 2
+
+	vsockHdrSize = 44
+
+	vsockTypeStream = 1
+
+	vsockOpRequest       = 1
+	vsockOpResponse      = 2
+	vsockOpRst           = 3
+	vsockOpShutdown      = 4
+	vsockOpRW            = 5
+	vsockOpCreditUpdate  = 6
+	vsockOpCreditRequest = 7
+
+	vsockShutRecv = 1
+	vsockShutSend = 2
+
+	vsockEventTransportReset = 0
+
+	// VsockHostCID is the context ID of the host.
+	VsockHostCID = 2
+
+	// receive buffer space advertised to the guest for each connection
+	vsockBufSize = 256 * 1024
+	// maximum payload of a single packet sent to the guest
+	vsockMaxPayload = 64 * 1024
+	// first port used for host-initiated connections
+	vsockEphemeralPort = 49152
+	vsockBacklog       = 64
+	// maximum number of resets queued for packets that do not belong to a
+	// connection; further ones are dropped and the guest times out instead
+	vsockMaxReplies  = 64
+	vsockDialTimeout = 5 * time.Second
+)
+
+// VsockAddr is the address of a vsock endpoint. It implements net.Addr.
+type VsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+func (a VsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a VsockAddr) String() string {
+	return strconv.FormatUint(uint64(a.CID), 10) + ":" + strconv.FormatUint(uint64(a.Port), 10)
+}
+
+type vsockHdr struct {
+	srcCID   uint64
+	dstCID   uint64
+	srcPort  uint32
+	dstPort  uint32
+	len      uint32
+	typ      uint16
+	op       uint16
+	flags    uint32
+	bufAlloc uint32
+	fwdCnt   uint32
+}
+
+func (h *vsockHdr) decode(b []byte) {
+	h.srcCID = binary.LittleEndian.Uint64(b[0:])
+	h.dstCID = binary.LittleEndian.Uint64(b[8:])
+	h.srcPort = binary.LittleEndian.Uint32(b[16:])
+	h.dstPort = binary.LittleEndian.Uint32(b[20:])
+	h.len = binary.LittleEndian.Uint32(b[24:])
+	h.typ = binary.LittleEndian.Uint16(b[28:])
+	h.op = binary.LittleEndian.Uint16(b[30:])
+	h.flags = binary.LittleEndian.Uint32(b[32:])
+	h.bufAlloc = binary.LittleEndian.Uint32(b[36:])
+	h.fwdCnt = binary.LittleEndian.Uint32(b[40:])
+}
+
+func (h *vsockHdr) encode(b []byte) {
+	binary.LittleEndian.PutUint64(b[0:], h.srcCID)
+	binary.LittleEndian.PutUint64(b[8:], h.dstCID)
+	binary.LittleEndian.PutUint32(b[16:], h.srcPort)
+	binary.LittleEndian.PutUint32(b[20:], h.dstPort)
+	binary.LittleEndian.PutUint32(b[24:], h.len)
+	binary.LittleEndian.PutUint16(b[28:], h.typ)
+	binary.LittleEndian.PutUint16(b[30:], h.op)
+	binary.LittleEndian.PutUint32(b[32:], h.flags)
+	binary.LittleEndian.PutUint32(b[36:], h.bufAlloc)
+	binary.LittleEndian.PutUint32(b[40:], h.fwdCnt)
+}
+
+type vsockPacket struct {
+	hdr   vsockHdr
+	data  []byte
+	reply bool // sent by reply rather than by a connection
+}
+
+// vsockKey identifies a connection by its host and guest ports.
+type vsockKey struct {
+	host  uint32
+	guest uint32
+}
+
+// VirtioVsock is a virtio socket device. It provides stream connections
+// between ports in the guest and the host, which are exposed to Go code as
+// net.Conn and net.Listener.
+type VirtioVsock struct {
+	t         *virtioMMIO
+	cid       uint32
+	cond      *sync.Cond
+	conns     map[vsockKey]*vsockConn
+	listeners map[uint32]*vsockListener
+	rx        []vsockPacket
+	replies   int // number of packets in rx queued by reply
+	nextPort  uint32
+	// a transport reset event is waiting for an event buffer
+	resetPending bool
+}
+
+// AddVsock attaches a virtio socket device. The guest is assigned the
+// context ID cid, which must be at least 3.
+func (m *Machine) AddVsock(cid uint32) (*VirtioVsock, error) {
+	if cid <= VsockHostCID || cid == ^uint32(0) {
+		return nil, fmt.Errorf("invalid guest CID %d", cid)
+	}
+	v := &VirtioVsock{
+		cid:       cid,
+		conns:     make(map[vsockKey]*vsockConn),
+		listeners: make(map[uint32]*vsockListener),
+		nextPort:  vsockEphemeralPort,
+	}
+	t, err := m.addVirtio(v)
+	if err != nil {
+		return nil, err
+	}
+	v.t = t
+	v.cond = sync.NewCond(&t.lock)
+	return v, nil
+}
+
+// CID returns the context ID of the guest.
+func (v *VirtioVsock) CID() uint32 {
+	return v.cid
+}
+
+// Dial connects to a port in the guest.
+func (v *VirtioVsock) Dial(port uint32) (net.Conn, error) {
+	v.t.lock.Lock()
+	defer v.t.lock.Unlock()
+
+	c := v.newConn(vsockKey{host: v.allocPort(), guest: port})
+	c.send(vsockOpRequest, 0, nil)
+	v.flush()
+
+	deadline := time.Now().Add(vsockDialTimeout)
+	timer := time.AfterFunc(vsockDialTimeout, v.wake)
+	defer timer.Stop()
+	for !c.connected && c.err == nil {
+		if !time.Now().Before(deadline) {
+			c.abort()
+			v.flush()
+			c.err = os.ErrDeadlineExceeded
+			break
+		}
+		v.cond.Wait()
+	}
+	if c.err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: c.RemoteAddr(), Err: c.err}
+	}
+	return c, nil
+}
+
+// Listen accepts connections from the guest to a host port.
+func (v *VirtioVsock) Listen(port uint32) (net.Listener, error) {
+	v.t.lock.Lock()
+	defer v.t.lock.Unlock()
+
+	if _, ok := v.listeners[port]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "vsock", Addr: VsockAddr{VsockHostCID, port}, Err: syscall.EADDRINUSE}
+	}
+	l := &vsockListener{
+		v:      v,
+		port:   port,
+		accept: make(chan *vsockConn, vsockBacklog),
+		done:   make(chan struct{}),
+	}
+	v.listeners[port] = l
+	return l, nil
+}
+
+// allocPort returns an unused host port for an outgoing connection.
+func (v *VirtioVsock) allocPort() uint32 {
+	for {
+		port := v.nextPort
+		v.nextPort++
+		if v.nextPort == 0 {
+			v.nextPort = vsockEphemeralPort
+		}
+		if _, ok := v.listeners[port]; ok {
+			continue
+		}
+		used := false
+		for k := range v.conns {
+			if k.host == port {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return port
+		}
+	}
+}
+
+func (v *VirtioVsock) newConn(key vsockKey) *vsockConn {
+	c := &vsockConn{v: v, key: key}
+	v.conns[key] = c
+	return c
+}
+
+// wake wakes up all goroutines blocked on a connection so that they can
+// check their deadlines.
+func (v *VirtioVsock) wake() {
+	v.t.lock.Lock()
+	v.cond.Broadcast()
+	v.t.lock.Unlock()
+}
+
+func (v *VirtioVsock) wakeAt(t time.Time) {
+	if !t.IsZero() {
+		time.AfterFunc(time.Until(t), v.wake)
+	}
+}
+
+func (v *VirtioVsock) flush() {
+	if err := v.flushRx(); err != nil {
+		fmt.Fprintf(os.Stderr, "virtio-vsock: %v\n", err)
+	}
+}
+
+func (v *VirtioVsock) deviceID() uint32 {
+	return virtioIDVsock
+}
+
+func (v *VirtioVsock) features() uint64 {
+	return 0
+}
+
+func (v *VirtioVsock) numQueues() int {
+	return 3
+}
+
+func (v *VirtioVsock) readConfig(offset uint64, data []byte) {
+	var cfg [8]byte
+	binary.LittleEndian.PutUint64(cfg[:], uint64(v.cid))
+	copyConfig(data, cfg[:], offset)
+}
+
+func (v *VirtioVsock) writeConfig(offset uint64, data []byte) {}
+
+// reset drops all connections, since the guest loses its socket state.
+func (v *VirtioVsock) reset() {
+	for k, c := range v.conns {
+		c.err = syscall.ECONNRESET
+		delete(v.conns, k)
+	}
+	v.rx = nil
+	v.replies = 0
+	v.resetPending = false
+	if v.cond != nil {
+		v.cond.Broadcast()
+	}
+}
+
+func (v *VirtioVsock) notify(t *virtioMMIO, q int) {
+	var err error
+	switch q {
+	case vsockRx:
+		err = v.flushRx()
+	case vsockTx:
+		err = v.transmit()
+	case vsockEvent:
+		err = v.flushEvent()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "virtio-vsock: %v\n", err)
+	}
+}
+
+// ResetTransport resets all connections and sends the guest a transport
+// reset event, after which it resets its own connections as well. Embedders
+// use it when the host loses the state of the guest's connections, for
+// example when the process that serves them restarts.
+func (v *VirtioVsock) ResetTransport() {
+	v.t.lock.Lock()
+	defer v.t.lock.Unlock()
+
+	for k, c := range v.conns {
+		c.err = syscall.ECONNRESET
+		delete(v.conns, k)
+	}
+	// packets for the old connections are stale
+	v.rx = nil
+	v.replies = 0
+	v.resetPending = true
+	if err := v.flushEvent(); err != nil {
+		fmt.Fprintf(os.Stderr, "virtio-vsock: %v\n", err)
+	}
+	v.cond.Broadcast()
+}
+
+// flushEvent delivers a pending transport reset event once the guest has
+// made an event buffer available.
+func (v *VirtioVsock) flushEvent() error {
+	if !v.resetPending {
+		return nil
+	}
+	vq := &v.t.queues[vsockEvent]
+	chain, err := vq.pop(v.t.m)
+	if err != nil || chain == nil {
+		return err
+	}
+	var ev [4]byte
+	binary.LittleEndian.PutUint32(ev[:], vsockEventTransportReset)
+	if err := vq.push(v.t.m, chain, chain.write(ev[:])); err != nil {
+		return err
+	}
+	v.resetPending = false
+	v.t.interrupt(vsockEvent)
+	return nil
+}
+
+// flushRx moves queued packets into the guest's receive queue, splitting
+// data packets that do not fit in a single buffer.
+func (v *VirtioVsock) flushRx() error {
+	vq := &v.t.queues[vsockRx]
+	used := false
+	var err error
+	for len(v.rx) > 0 {
+		var chain *virtqChain
+		chain, err = vq.pop(v.t.m)
+		if err != nil || chain == nil {
+			break
+		}
+		space := chain.writableLen() - vsockHdrSize
+		if space < 0 {
+			// give the buffer back empty rather than lose it
+			if err = vq.push(v.t.m, chain, 0); err == nil {
+				used = true
+				err = fmt.Errorf("%w: receive buffer too small", ErrVirtqueue)
+			}
+			break
+		}
+		p := &v.rx[0]
+		n := min(len(p.data), space)
+		buf := make([]byte, vsockHdrSize+n)
+		hdr := p.hdr
+		hdr.len = uint32(n)
+		hdr.encode(buf)
+		copy(buf[vsockHdrSize:], p.data[:n])
+		w := chain.write(buf)
+		if n < len(p.data) {
+			p.data = p.data[n:]
+		} else {
+			if p.reply {
+				v.replies--
+			}
+			v.rx = v.rx[1:]
+		}
+		if err = vq.push(v.t.m, chain, w); err != nil {
+			break
+		}
+		used = true
+	}
+	if used {
+		v.t.interrupt(vsockRx)
+	}
+	return err
+}
+
+// transmit handles packets sent by the guest.
+func (v *VirtioVsock) transmit() error {
+	vq := &v.t.queues[vsockTx]
+	for {
+		chain, err := vq.pop(v.t.m)
+		if err != nil {
+			return err
+		}
+		if chain == nil {
+			break
+		}
+		pkt := chain.read()
+		if len(pkt) >= vsockHdrSize {
+			var hdr vsockHdr
+			hdr.decode(pkt)
+			data := pkt[vsockHdrSize:]
+			if uint32(len(data)) > hdr.len {
+				data = data[:hdr.len]
+			}
+			v.receive(&hdr, data)
+		}
+		if err := vq.push(v.t.m, chain, 0); err != nil {
+			return err
+		}
+	}
+	v.t.interrupt(vsockTx)
+	v.cond.Broadcast()
+	return v.flushRx()
+}
+
+// receive handles a single packet sent by the guest.
+func (v *VirtioVsock) receive(hdr *vsockHdr, data []byte) {
+	if hdr.dstCID != VsockHostCID || hdr.typ != vsockTypeStream {
+		v.reply(hdr, vsockOpRst)
+		return
+	}
+	key := vsockKey{host: hdr.dstPort, guest: hdr.srcPort}
+	c := v.conns[key]
+	if hdr.op == vsockOpRequest {
+		l := v.listeners[hdr.dstPort]
+		if c != nil || l == nil {
+			v.reply(hdr, vsockOpRst)
+			return
+		}
+		c = v.newConn(key)
+		c.connected = true
+		c.credit(hdr)
+		select {
+		case l.accept <- c:
+			c.send(vsockOpResponse, 0, nil)
+		default:
+			c.abort()
+		}
+		return
+	}
+	if c == nil {
+		if hdr.op != vsockOpRst {
+			v.reply(hdr, vsockOpRst)
+		}
+		return
+	}
+	c.credit(hdr)
+	switch hdr.op {
+	case vsockOpResponse:
+		c.connected = true
+	case vsockOpRst:
+		if !c.connected {
+			c.err = syscall.ECONNREFUSED
+		} else if c.peerShut != vsockShutRecv|vsockShutSend {
+			c.err = syscall.ECONNRESET
+		}
+		delete(v.conns, key)
+	case vsockOpShutdown:
+		c.peerShut |= hdr.flags & (vsockShutRecv | vsockShutSend)
+		if c.peerShut == vsockShutRecv|vsockShutSend {
+			c.abort()
+		}
+	case vsockOpRW:
+		if c.closed {
+			break
+		}
+		// the guest may not send more than the buffer space advertised to it
+		if len(c.buf)+len(data) > vsockBufSize {
+			c.err = syscall.ECONNRESET
+			c.abort()
+			break
+		}
+		c.buf = append(c.buf, data...)
+	case vsockOpCreditRequest:
+		c.send(vsockOpCreditUpdate, 0, nil)
+	}
+}
+
+// reply sends a control packet in response to hdr without a connection.
+// Replies are dropped while the guest has vsockMaxReplies of them left to
+// receive, so that a guest that keeps sending packets to closed ports without
+// reading its receive queue cannot grow the queue without bound.
+func (v *VirtioVsock) reply(hdr *vsockHdr, op uint16) {
+	if v.replies >= vsockMaxReplies {
+		return
+	}
+	v.replies++
+	v.rx = append(v.rx, vsockPacket{
+		hdr: vsockHdr{
+			srcCID:  hdr.dstCID,
+			dstCID:  hdr.srcCID,
+			srcPort: hdr.dstPort,
+			dstPort: hdr.srcPort,
+			typ:     vsockTypeStream,
+			op:      op,
+		},
+		reply: true,
+	})
+}
+
+// vsockConn is a stream connection between a host and a guest port. All
+// fields are protected by the transport lock.
+type vsockConn struct {
+	v         *VirtioVsock
+	key       vsockKey
+	connected bool
+	closed    bool
+	err       error
+	buf       []byte
+
+	localShut uint32
+	peerShut  uint32
+
+	// credit-based flow control (virtio 1.2, section 5.10.6.3)
+	peerBufAlloc uint32
+	peerFwdCnt   uint32
+	txCnt        uint32
+	fwdCnt       uint32
+	lastFwdCnt   uint32
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// send queues a packet for the guest. The caller must flush the receive
+// queue afterwards.
+func (c *vsockConn) send(op uint16, flags uint32, data []byte) {
+	c.v.rx = append(c.v.rx, vsockPacket{
+		hdr: vsockHdr{
+			srcCID:   VsockHostCID,
+			dstCID:   uint64(c.v.cid),
+			srcPort:  c.key.host,
+			dstPort:  c.key.guest,
+			typ:      vsockTypeStream,
+			op:       op,
+			flags:    flags,
+			bufAlloc: vsockBufSize,
+			fwdCnt:   c.fwdCnt,
+		},
+		data: data,
+	})
+	c.lastFwdCnt = c.fwdCnt
+}
+
+// abort resets the connection and removes it from the device.
+func (c *vsockConn) abort() {
+	if c.v.conns[c.key] == c {
+		c.send(vsockOpRst, 0, nil)
+		delete(c.v.conns, c.key)
+	}
+}
+
+func (c *vsockConn) credit(hdr *vsockHdr) {
+	c.peerBufAlloc = hdr.bufAlloc
+	c.peerFwdCnt = hdr.fwdCnt
+}
+
+func (c *vsockConn) wait(deadline time.Time) error {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	c.v.cond.Wait()
+	return nil
+}
+
+func (c *vsockConn) Read(b []byte) (int, error) {
+	c.v.t.lock.Lock()
+	defer c.v.t.lock.Unlock()
+
+	for len(c.buf) == 0 {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.peerShut&vsockShutSend != 0:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		}
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	c.fwdCnt += uint32(n)
+	if c.fwdCnt-c.lastFwdCnt >= vsockBufSize/2 && c.v.conns[c.key] == c {
+		c.send(vsockOpCreditUpdate, 0, nil)
+		c.v.flush()
+	}
+	return n, nil
+}
+
+func (c *vsockConn) Write(b []byte) (int, error) {
+	c.v.t.lock.Lock()
+	defer c.v.t.lock.Unlock()
+
+	n := 0
+	for n < len(b) {
+		switch {
+		case c.closed:
+			return n, net.ErrClosed
+		case c.err != nil:
+			return n, c.err
+		case c.localShut&vsockShutSend != 0 || c.peerShut&vsockShutRecv != 0 || c.v.conns[c.key] != c:
+			return n, syscall.EPIPE
+		}
+		credit := c.peerBufAlloc - (c.txCnt - c.peerFwdCnt)
+		if credit == 0 || credit > c.peerBufAlloc {
+			if err := c.wait(c.writeDeadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		k := min(len(b)-n, int(credit), vsockMaxPayload)
+		c.send(vsockOpRW, 0, append([]byte(nil), b[n:n+k]...))
+		c.txCnt += uint32(k)
+		n += k
+		c.v.flush()
+	}
+	return n, nil
+}
+
+// CloseWrite shuts down the sending side of the connection.
+func (c *vsockConn) CloseWrite() error {
+	c.v.t.lock.Lock()
+	defer c.v.t.lock.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	if c.localShut&vsockShutSend == 0 && c.v.conns[c.key] == c {
+		c.localShut |= vsockShutSend
+		c.send(vsockOpShutdown, vsockShutSend, nil)
+		c.v.flush()
+	}
+	return nil
+}
+
+func (c *vsockConn) Close() error {
+	c.v.t.lock.Lock()
+	defer c.v.t.lock.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.buf = nil
+	if c.v.conns[c.key] == c {
+		c.send(vsockOpShutdown, vsockShutRecv|vsockShutSend, nil)
+		delete(c.v.conns, c.key)
+		c.v.flush()
+	}
+	c.v.cond.Broadcast()
+	return nil
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return VsockAddr{CID: VsockHostCID, Port: c.key.host}
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return VsockAddr{CID: c.v.cid, Port: c.key.guest}
+}
+
+func (c *vsockConn) SetDeadline(t time.Time) error {
+	c.v.t.lock.Lock()
+	defer c.v.t.lock.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.v.wakeAt(t)
+	return nil
+}
+
+func (c *vsockConn) SetReadDeadline(t time.Time) error {
+	c.v.t.lock.Lock()
+	defer c.v.t.lock.Unlock()
+	c.readDeadline = t
+	c.v.wakeAt(t)
+	return nil
+}
+
+func (c *vsockConn) SetWriteDeadline(t time.Time) error {
+	c.v.t.lock.Lock()
+	defer c.v.t.lock.Unlock()
+	c.writeDeadline = t
+	c.v.wakeAt(t)
+	return nil
+}
+
+type vsockListener struct {
+	v      *VirtioVsock
+	port   uint32
+	accept chan *vsockConn
+	done   chan struct{}
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections and resets connections that have not
+// been accepted yet.
+func (l *vsockListener) Close() error {
+	l.v.t.lock.Lock()
+	defer l.v.t.lock.Unlock()
+
+	if l.v.listeners[l.port] != l {
+		return net.ErrClosed
+	}
+	delete(l.v.listeners, l.port)
+	close(l.done)
+	for {
+		select {
+		case c := <-l.accept:
+			c.abort()
+		default:
+			l.v.flush()
+			return nil
+		}
+	}
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return VsockAddr{CID: VsockHostCID, Port: l.port}
+}
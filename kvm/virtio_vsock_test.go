@@ -0,0 +1,100 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestVsockCreditExceeded(t *testing.T) {
+	v := &VirtioVsock{
+		cid:   3,
+		conns: make(map[vsockKey]*vsockConn),
+	}
+	key := vsockKey{host: 1000, guest: 2000}
+	c := v.newConn(key)
+	c.connected = true
+
+	hdr := vsockHdr{
+		srcCID:  3,
+		dstCID:  VsockHostCID,
+		srcPort: key.guest,
+		dstPort: key.host,
+		typ:     vsockTypeStream,
+		op:      vsockOpRW,
+	}
+	data := make([]byte, vsockMaxPayload)
+	for sent := 0; sent+len(data) <= vsockBufSize; sent += len(data) {
+		v.receive(&hdr, data)
+	}
+	if v.conns[key] != c || len(v.rx) != 0 {
+		t.Fatal("connection reset within its credit")
+	}
+	v.receive(&hdr, data)
+	if v.conns[key] == c {
+		t.Fatal("connection not reset after exceeding its credit")
+	}
+	if len(v.rx) != 1 || v.rx[0].hdr.op != vsockOpRst {
+		t.Errorf("got %d packets for the guest, want a reset", len(v.rx))
+	}
+	if len(c.buf) != vsockBufSize || !errors.Is(c.err, syscall.ECONNRESET) {
+		t.Errorf("buffered %d bytes with error %v", len(c.buf), c.err)
+	}
+}
+
+func TestVsockRepliesBounded(t *testing.T) {
+	v := &VirtioVsock{
+		cid:   3,
+		conns: make(map[vsockKey]*vsockConn),
+	}
+	hdr := vsockHdr{
+		srcCID:  3,
+		dstCID:  VsockHostCID,
+		srcPort: 2000,
+		dstPort: 1000,
+		typ:     vsockTypeStream,
+		op:      vsockOpRequest,
+	}
+	// nothing listens on the port, and the guest never reads the resets
+	for i := 0; i < 10*vsockMaxReplies; i++ {
+		v.receive(&hdr, nil)
+	}
+	if len(v.rx) != vsockMaxReplies {
+		t.Errorf("%d resets queued, want %d", len(v.rx), vsockMaxReplies)
+	}
+}
+
+func TestVsockTransportReset(t *testing.T) {
+	m := newTestMachine(t, 16<<20)
+	v, err := m.AddVsock(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.t.lock.Lock()
+	c := v.newConn(vsockKey{host: 1000, guest: 2000})
+	c.connected = true
+	events := newTestQueue(m, &v.t.queues[vsockEvent], physRamBase+0x10000)
+	v.t.lock.Unlock()
+
+	// the event waits until the guest provides a buffer for it
+	v.ResetTransport()
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("read from a reset connection returned %v", err)
+	}
+	v.t.lock.Lock()
+	defer v.t.lock.Unlock()
+	if used, _ := events.used(); used != 0 {
+		t.Fatal("event delivered without an event buffer")
+	}
+	buf := events.add(nil, []int{4})[0]
+	copy(m.Slice(buf, buf+4), []byte{0xff, 0xff, 0xff, 0xff})
+	v.notify(v.t, vsockEvent)
+	used, n := events.used()
+	if used != 1 || n != 4 {
+		t.Fatalf("%d events of %d bytes delivered, want one of 4 bytes", used, n)
+	}
+	if id := binary.LittleEndian.Uint32(m.Slice(buf, buf+4)); id != vsockEventTransportReset {
+		t.Errorf("event id %d, want a transport reset", id)
+	}
+}
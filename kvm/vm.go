@@ -3,6 +3,7 @@ package kvm
 import (
 	"fmt"
 	"os"
+	"syscall"
 	"unsafe"
 
 	"github.com/tysonmote/gommap"
@@ -12,6 +13,27 @@ const (
 	physSysBase  = 0x0000_4000
 	physRamBase  = 0x4000_0000
 	physKernBase = 0x4000_8000
+
+	mfdCloexec = 0x1
+	mfdHugetlb = 0x4
+
+	madvHugepage = 14
+)
+
+// Hugepages selects whether guest RAM is backed by huge pages.
+type Hugepages int
+
+const (
+	HugepagesNone Hugepages = iota
+	// HugepagesTransparent asks for transparent huge pages with madvise. They
+	// are only used if shmem huge pages are enabled in
+	// /sys/kernel/mm/transparent_hugepage/shmem_enabled.
+	HugepagesTransparent
+	// HugepagesHugetlb allocates RAM from the hugetlbfs pool of default-sized
+	// huge pages, which must have enough free pages. The memory size must be
+	// a multiple of the huge page size. Forking reserves pages for the whole
+	// RAM of the parent and of each child.
+	HugepagesHugetlb
 )
 
 type vm struct {
@@ -19,9 +41,48 @@ type vm struct {
 	mem   gommap.MMap
 	sys   gommap.MMap
 	vcpus []vcpu
+
+	// memfd backs guest RAM. Once a machine has been forked, mem maps it
+	// privately and the memfd is the read-only template shared with the
+	// children.
+	memfd     int
+	private   bool
+	hugepages Hugepages
+	// size of the pages backing RAM
+	pagesize uint64
+
+	// RAM is mapped into the guest by consecutive slots covering its first
+	// plugged bytes, and more slots are added as it grows. Guarded ranges have
+	// read-only slots of their own.
+	ramSlots []ramSlot
+	plugged  uint64
+	ramFlags uint32
+	// memory slots in use
+	slots map[uint32]bool
 }
 
-func NewVM(kvmfd uintptr, memSize int64) (*vm, error) {
+type ramSlot struct {
+	slot     uint32
+	off      uint64
+	size     uint64
+	readonly bool
+}
+
+func NewVM(kvmfd uintptr, memSize int64, hugepages Hugepages) (*vm, error) {
+	memfd, err := memfdCreate("revisor-ram", memSize, hugepages)
+	if err != nil {
+		return nil, err
+	}
+	vm, err := newVM(kvmfd, memfd, memSize, gommap.MAP_SHARED, hugepages)
+	if err != nil {
+		syscall.Close(memfd)
+		return nil, err
+	}
+	return vm, nil
+}
+
+// newVM creates a VM whose RAM maps memfd with the given sharing flag.
+func newVM(kvmfd uintptr, memfd int, memSize int64, flags gommap.MapFlags, hugepages Hugepages) (*vm, error) {
 	v, err := getAPIVersion(kvmfd)
 	if err != nil {
 		return nil, err
@@ -33,32 +94,161 @@ func NewVM(kvmfd uintptr, memSize int64) (*vm, error) {
 	if err != nil {
 		return nil, fmt.Errorf("KVM_CREATE_VM: %w", err)
 	}
-	nofd := -1
-	mem, err := gommap.MapAt(0, uintptr(nofd), 0, memSize, gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED|gommap.MAP_ANONYMOUS)
+	mem, err := gommap.MapAt(0, uintptr(memfd), 0, memSize, gommap.PROT_READ|gommap.PROT_WRITE, flags)
 	if err != nil {
 		return nil, fmt.Errorf("mmap: %w", err)
 	}
+	if err := adviseRAM(mem, hugepages); err != nil {
+		return nil, err
+	}
+	nofd := -1
 	sys, err := gommap.MapAt(0, uintptr(nofd), 0, int64(os.Getpagesize()), gommap.PROT_NONE, gommap.MAP_SHARED|gommap.MAP_ANONYMOUS)
 	if err != nil {
 		return nil, fmt.Errorf("mmap: %w", err)
 	}
+	pagesize := uint64(os.Getpagesize())
+	if hugepages == HugepagesHugetlb {
+		// hugetlbfs reports its page size as the block size
+		var st syscall.Stat_t
+		if err := syscall.Fstat(memfd, &st); err != nil {
+			return nil, fmt.Errorf("fstat: %w", err)
+		}
+		pagesize = uint64(st.Blksize)
+	}
 
 	return &vm{
-		fd:  vmfd,
-		mem: mem,
-		sys: sys,
+		fd:        vmfd,
+		mem:       mem,
+		sys:       sys,
+		memfd:     memfd,
+		private:   flags == gommap.MAP_PRIVATE,
+		hugepages: hugepages,
+		pagesize:  pagesize,
 	}, nil
 }
 
-func (vm *vm) initMemory() error {
+// setRAMSlot maps the part of RAM covered by a slot with the given memory
+// region flags, or read-only if the slot is. A slot of size 0 is removed.
+func (vm *vm) setRAMSlot(s ramSlot, flags uint32) error {
+	if s.readonly {
+		flags = kvmMemReadonly
+	}
 	if err := vm.SetUserspaceMemoryRegion(&UserspaceMemoryRegion{
-		Slot:          0,
-		GuestPhysAddr: physRamBase,
-		MemorySize:    uint64(len(vm.mem)),
-		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&vm.mem[0]))),
+		Slot:          s.slot,
+		Flags:         flags,
+		GuestPhysAddr: physRamBase + s.off,
+		MemorySize:    s.size,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&vm.mem[s.off]))),
 	}); err != nil {
 		return fmt.Errorf("KVM_SET_USERSPACE_MEMORY_REGION: %w", err)
 	}
+	return nil
+}
+
+// setRAMFlags maps every slot of guest RAM with the given memory region
+// flags.
+func (vm *vm) setRAMFlags(flags uint32) error {
+	for _, s := range vm.ramSlots {
+		if err := vm.setRAMSlot(s, flags); err != nil {
+			return err
+		}
+	}
+	vm.ramFlags = flags
+	return nil
+}
+
+// plugRAM maps the size bytes of RAM that follow the plugged RAM in a new
+// slot.
+func (vm *vm) plugRAM(size uint64) error {
+	s := ramSlot{slot: vm.allocSlot(), off: vm.plugged, size: size}
+	if err := vm.setRAMSlot(s, vm.ramFlags); err != nil {
+		delete(vm.slots, s.slot)
+		return err
+	}
+	vm.ramSlots = append(vm.ramSlots, s)
+	vm.plugged += size
+	return nil
+}
+
+// resetRAM removes every slot of RAM and maps its first size bytes in slot
+// 0. The vCPUs must not have run, since RAM disappears in between.
+func (vm *vm) resetRAM(size uint64) error {
+	if size == vm.plugged {
+		return nil
+	}
+	for _, s := range vm.ramSlots {
+		if err := vm.setRAMSlot(ramSlot{slot: s.slot, off: s.off}, 0); err != nil {
+			return err
+		}
+		delete(vm.slots, s.slot)
+	}
+	vm.ramSlots = nil
+	vm.plugged = 0
+	vm.slots[0] = true
+	s := ramSlot{slot: 0, size: size}
+	if err := vm.setRAMSlot(s, vm.ramFlags); err != nil {
+		return err
+	}
+	vm.ramSlots = []ramSlot{s}
+	vm.plugged = size
+	return nil
+}
+
+// allocSlot returns the lowest memory slot that is not in use and marks it
+// as used.
+func (vm *vm) allocSlot() uint32 {
+	slot := uint32(0)
+	for vm.slots[slot] {
+		slot++
+	}
+	vm.slots[slot] = true
+	return slot
+}
+
+// memfdCreate creates a memfd of the given size to back guest RAM.
+func memfdCreate(name string, size int64, hugepages Hugepages) (int, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return -1, err
+	}
+	flags := uintptr(mfdCloexec)
+	if hugepages == HugepagesHugetlb {
+		flags |= mfdHugetlb
+	}
+	fd, _, errno := syscall.Syscall(sysMemfdCreate, uintptr(unsafe.Pointer(p)), flags, 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("memfd_create: %w", errno)
+	}
+	if err := syscall.Ftruncate(int(fd), size); err != nil {
+		syscall.Close(int(fd))
+		if hugepages == HugepagesHugetlb {
+			return -1, fmt.Errorf("ftruncate: %w (the memory size must be a multiple of the huge page size)", err)
+		}
+		return -1, fmt.Errorf("ftruncate: %w", err)
+	}
+	return int(fd), nil
+}
+
+// adviseRAM asks for transparent huge pages for a new mapping of RAM if
+// they were requested.
+func adviseRAM(mem gommap.MMap, hugepages Hugepages) error {
+	if hugepages != HugepagesTransparent {
+		return nil
+	}
+	if err := mem.Advise(madvHugepage); err != nil {
+		return fmt.Errorf("madvise: %w", err)
+	}
+	return nil
+}
+
+func (vm *vm) initMemory() error {
+	// slot 0 is RAM and slot 1 is the sys page
+	vm.slots = map[uint32]bool{0: true, 1: true}
+	vm.ramSlots = []ramSlot{{slot: 0, size: uint64(len(vm.mem))}}
+	vm.plugged = uint64(len(vm.mem))
+	if err := vm.setRAMFlags(0); err != nil {
+		return err
+	}
 	if err := vm.SetUserspaceMemoryRegion(&UserspaceMemoryRegion{
 		Slot:          1,
 		GuestPhysAddr: physSysBase,
@@ -0,0 +1,209 @@
+package revisor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/zyedidia/revisor/kvm"
+)
+
+// hypMmap flags
+const (
+	// map the file copy-on-write instead of read-only
+	mapPrivate = 1 << 0
+)
+
+// fileMapping is a host file mapped into guest-physical memory by the mmap
+// hypercall.
+type fileMapping struct {
+	region *kvm.Region
+	path   string
+	off    int64
+	flags  uint64
+}
+
+// mmap maps size bytes of the file fd at offset off into a new memory slot
+// at the guest-physical address pa.
+func (c *Container) mmap(m *kvm.Machine, fd, pa, size uint64, off int64, flags uint64) uint64 {
+	f, ok := c.file(fd)
+	if !ok || flags&^mapPrivate != 0 {
+		return errFail
+	}
+	fm, err := c.mapFile(m, f, pa, size, off, flags)
+	if err != nil {
+		return errFail
+	}
+	c.lock.Lock()
+	c.mappings[pa] = fm
+	c.lock.Unlock()
+	return 0
+}
+
+// mapFile maps f at pa. The mapping may not extend past the end of the
+// file, where accesses would fault in the host.
+func (c *Container) mapFile(m *kvm.Machine, f *os.File, pa, size uint64, off int64, flags uint64) (*fileMapping, error) {
+	pagesize := uint64(os.Getpagesize())
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// the last page of the file may be mapped whole; size is checked before
+	// it is rounded up, which could overflow
+	end := (uint64(fi.Size()) + pagesize - 1) / pagesize * pagesize
+	if off < 0 || uint64(off)%pagesize != 0 || uint64(off) > end || size == 0 || size > end-uint64(off) {
+		return nil, fmt.Errorf("cannot map %d bytes at offset %d of %s", size, off, f.Name())
+	}
+	size = (size + pagesize - 1) / pagesize * pagesize
+	rflags := kvm.RegionReadOnly
+	if flags&mapPrivate != 0 {
+		rflags = kvm.RegionPrivate
+	}
+	region, err := m.AddFileRegion(pa, f, off, size, rflags)
+	if err != nil {
+		return nil, err
+	}
+	return &fileMapping{
+		region: region,
+		path:   f.Name(),
+		off:    off,
+		flags:  flags,
+	}, nil
+}
+
+func (c *Container) munmap(m *kvm.Machine, pa uint64) uint64 {
+	c.lock.Lock()
+	fm, ok := c.mappings[pa]
+	delete(c.mappings, pa)
+	c.lock.Unlock()
+	if !ok || m.RemoveRegion(fm.region) != nil {
+		return errFail
+	}
+	return 0
+}
+
+// changedPages returns the offsets of the pages of a private mapping that
+// the guest has changed, compared with the file.
+func (fm *fileMapping) changedPages() ([]uint64, error) {
+	if fm.flags&mapPrivate == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(fm.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mem := fm.region.Bytes()
+	pagesize := os.Getpagesize()
+	page := make([]byte, pagesize)
+	var changed []uint64
+	for off := 0; off < len(mem); off += pagesize {
+		n, err := f.ReadAt(page, fm.off+int64(off))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		// past the end of the file, the mapping reads as zero
+		clear(page[n:])
+		if !bytes.Equal(page, mem[off:off+pagesize]) {
+			changed = append(changed, uint64(off))
+		}
+	}
+	return changed, nil
+}
+
+// saveMappings writes the file mappings, with the pages of private mappings
+// that differ from the file.
+func (c *Container) saveMappings(w io.Writer) error {
+	c.lock.Lock()
+	mappings := make(map[uint64]*fileMapping, len(c.mappings))
+	for pa, fm := range c.mappings {
+		mappings[pa] = fm
+	}
+	c.lock.Unlock()
+
+	le := binary.LittleEndian
+	if err := binary.Write(w, le, uint64(len(mappings))); err != nil {
+		return err
+	}
+	pagesize := os.Getpagesize()
+	for pa, fm := range mappings {
+		changed, err := fm.changedPages()
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(w, le, []uint64{pa, fm.region.Size(), uint64(fm.off), fm.flags, uint64(len(fm.path)), uint64(len(changed))}); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, fm.path); err != nil {
+			return err
+		}
+		mem := fm.region.Bytes()
+		for _, off := range changed {
+			if err := binary.Write(w, le, off); err != nil {
+				return err
+			}
+			if _, err := w.Write(mem[off : off+uint64(pagesize)]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoreMappings maps the files saved by saveMappings into m again.
+func (c *Container) restoreMappings(m *kvm.Machine, r io.Reader) (map[uint64]*fileMapping, error) {
+	le := binary.LittleEndian
+	mappings := make(map[uint64]*fileMapping)
+	var n uint64
+	if err := binary.Read(r, le, &n); err != nil {
+		// snapshots from before file mappings end here
+		if err == io.EOF {
+			return mappings, nil
+		}
+		return nil, err
+	}
+	if n > fdMax {
+		return nil, fmt.Errorf("invalid number of file mappings %d", n)
+	}
+	pagesize := uint64(os.Getpagesize())
+	for i := uint64(0); i < n; i++ {
+		var info [6]uint64
+		if err := binary.Read(r, le, &info); err != nil {
+			return nil, err
+		}
+		pa, size, off, flags, pathLen, nchanged := info[0], info[1], int64(info[2]), info[3], info[4], info[5]
+		if pathLen > 4096 || nchanged > size/pagesize {
+			return nil, fmt.Errorf("invalid file mapping at %#x", pa)
+		}
+		path := make([]byte, pathLen)
+		if _, err := io.ReadFull(r, path); err != nil {
+			return nil, err
+		}
+		f, err := c.reopen(string(path), os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		fm, err := c.mapFile(m, f, pa, size, off, flags)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		mem := fm.region.Bytes()
+		for j := uint64(0); j < nchanged; j++ {
+			var page uint64
+			if err := binary.Read(r, le, &page); err != nil {
+				return nil, err
+			}
+			if page%pagesize != 0 || page >= size {
+				return nil, fmt.Errorf("invalid page %#x of file mapping at %#x", page, pa)
+			}
+			if _, err := io.ReadFull(r, mem[page:page+pagesize]); err != nil {
+				return nil, err
+			}
+		}
+		mappings[pa] = fm
+	}
+	return mappings, nil
+}
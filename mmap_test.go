@@ -0,0 +1,55 @@
+package revisor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zyedidia/revisor/kvm"
+)
+
+func TestMapFileSize(t *testing.T) {
+	c := NewContainer(nil)
+	m, err := kvm.NewMachine("/dev/kvm", 1, 16<<20, c)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer m.Close()
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, make([]byte, 2*os.Getpagesize()+100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pagesize := uint64(os.Getpagesize())
+	for _, tt := range []struct {
+		size uint64
+		off  int64
+		ok   bool
+	}{
+		{100, 0, true},
+		{3 * pagesize, 0, true},
+		{pagesize, 2 * int64(pagesize), true},
+		{0, 0, false},
+		{3*pagesize + 1, 0, false},
+		{1, 3 * int64(pagesize), false},
+		// rounds up to 0
+		{^uint64(0) - 10, 0, false},
+		// wraps around when added to the offset
+		{^uint64(0) - pagesize + 1, 2 * int64(pagesize), false},
+	} {
+		fm, err := c.mapFile(m, f, 0x2000_0000, tt.size, tt.off, 0)
+		if (err == nil) != tt.ok {
+			t.Errorf("mapping %d bytes at offset %d: %v", tt.size, tt.off, err)
+		}
+		if err == nil {
+			if err := m.RemoveRegion(fm.region); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
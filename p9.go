@@ -0,0 +1,1157 @@
+package revisor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 9P2000.L message types.
+const (
+	p9Rlerror      = 7
+	p9Tstatfs      = 8
+	p9Tlopen       = 12
+	p9Tlcreate     = 14
+	p9Tsymlink     = 16
+	p9Tmknod       = 18
+	p9Trename      = 20
+	p9Treadlink    = 22
+	p9Tgetattr     = 24
+	p9Tsetattr     = 26
+	p9Txattrwalk   = 30
+	p9Txattrcreate = 32
+	p9Treaddir     = 40
+	p9Tfsync       = 50
+	p9Tlock        = 52
+	p9Tgetlock     = 54
+	p9Tlink        = 70
+	p9Tmkdir       = 72
+	p9Trenameat    = 74
+	p9Tunlinkat    = 76
+	p9Tversion     = 100
+	p9Tauth        = 102
+	p9Tattach      = 104
+	p9Tflush       = 108
+	p9Twalk        = 110
+	p9Tread        = 116
+	p9Twrite       = 118
+	p9Tclunk       = 120
+	p9Tremove      = 122
+)
+
+const (
+	p9Version  = "9P2000.L"
+	p9MinSize  = 4096
+	p9MaxSize  = 1024 * 1024
+	p9HdrSize  = 7
+	p9IOHdr    = 11 // size, type, tag and count of Rread
+	p9MaxWalk  = 16
+	p9NoFid    = ^uint32(0)
+	p9QidSize  = 13
+	p9RemoveAt = 0x200 // AT_REMOVEDIR
+
+	p9SymlinkNoFollow = 0x100 // AT_SYMLINK_NOFOLLOW
+
+	p9QtDir     = 0x80
+	p9QtSymlink = 0x02
+	p9QtFile    = 0x00
+
+	// open flags that are passed through to the host; the access mode and
+	// these bits have the same value on every Linux architecture
+	p9OpenMask = syscall.O_ACCMODE | syscall.O_CREAT | syscall.O_EXCL | syscall.O_TRUNC | syscall.O_APPEND
+
+	p9SetattrMode     = 0x1
+	p9SetattrUID      = 0x2
+	p9SetattrGID      = 0x4
+	p9SetattrSize     = 0x8
+	p9SetattrAtime    = 0x10
+	p9SetattrMtime    = 0x20
+	p9SetattrAtimeSet = 0x80
+	p9SetattrMtimeSet = 0x100
+
+	p9GetattrBasic = 0x7ff
+
+	p9LockSuccess = 0
+	p9LockUnlck   = 2
+)
+
+var errP9Short = errors.New("short 9p message")
+
+type p9Qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+type p9Fid struct {
+	root string // the exported directory the fid was attached to
+	path string
+	file *os.File
+	dir  []p9Dirent
+}
+
+type p9Dirent struct {
+	qid  p9Qid
+	typ  uint8
+	name string
+}
+
+// P9Server is a 9P2000.L file server for the directories a Container may
+// access. It implements kvm.P9Handler, so a guest can mount the host tree
+// through a virtio-9p device instead of using the path hypercalls.
+//
+// Every path reached by a walk or create is checked with the Container's
+// CanAccess policy. Attach names select the exported directory; an empty
+// name selects the Container's first directory. Files are reached from the
+// exported directory without following symlinks, so symlinks only lead
+// elsewhere when the guest resolves them itself.
+type P9Server struct {
+	lock  sync.Mutex
+	c     *Container
+	msize uint32
+	fids  map[uint32]*p9Fid
+}
+
+func NewP9Server(c *Container) *P9Server {
+	return &P9Server{
+		c:     c,
+		msize: p9MaxSize,
+		fids:  make(map[uint32]*p9Fid),
+	}
+}
+
+// p9Dec decodes the fields of a 9P message. After a short read all further
+// reads return zero values and err is set.
+type p9Dec struct {
+	b   []byte
+	err error
+}
+
+func (d *p9Dec) take(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errP9Short
+		return make([]byte, min(n, 8))
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *p9Dec) u8() uint8   { return d.take(1)[0] }
+func (d *p9Dec) u16() uint16 { return binary.LittleEndian.Uint16(d.take(2)) }
+func (d *p9Dec) u32() uint32 { return binary.LittleEndian.Uint32(d.take(4)) }
+func (d *p9Dec) u64() uint64 { return binary.LittleEndian.Uint64(d.take(8)) }
+func (d *p9Dec) str() string { return string(d.take(int(d.u16()))) }
+
+type p9Enc struct {
+	b []byte
+}
+
+func (e *p9Enc) u8(v uint8)   { e.b = append(e.b, v) }
+func (e *p9Enc) u16(v uint16) { e.b = binary.LittleEndian.AppendUint16(e.b, v) }
+func (e *p9Enc) u32(v uint32) { e.b = binary.LittleEndian.AppendUint32(e.b, v) }
+func (e *p9Enc) u64(v uint64) { e.b = binary.LittleEndian.AppendUint64(e.b, v) }
+
+func (e *p9Enc) str(s string) {
+	e.u16(uint16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *p9Enc) qid(q p9Qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
+
+// p9Errno converts a host error to a Linux errno for Rlerror.
+func p9Errno(err error) uint32 {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return uint32(errno)
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return uint32(syscall.ENOENT)
+	case errors.Is(err, os.ErrPermission):
+		return uint32(syscall.EACCES)
+	case errors.Is(err, os.ErrExist):
+		return uint32(syscall.EEXIST)
+	case errors.Is(err, errP9Short):
+		return uint32(syscall.EINVAL)
+	}
+	return uint32(syscall.EIO)
+}
+
+func p9QidOf(st *syscall.Stat_t) p9Qid {
+	q := p9Qid{typ: p9QtFile, path: st.Ino}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		q.typ = p9QtDir
+	case syscall.S_IFLNK:
+		q.typ = p9QtSymlink
+	}
+	return q
+}
+
+// p9At opens the directory that contains path, which is root or a file
+// below it, and returns it with the last component of path. The directory
+// is reached from root one component at a time without following symlinks,
+// so that a symlink cannot lead outside of root. For root itself the name is
+// ".".
+func p9At(root, path string) (int, string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return -1, "", syscall.EACCES
+	}
+	dir, err := syscall.Open(root, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", err
+	}
+	if rel == "." {
+		return dir, ".", nil
+	}
+	names := strings.Split(rel, "/")
+	for _, name := range names[:len(names)-1] {
+		next, err := syscall.Openat(dir, name, oPath|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		syscall.Close(dir)
+		if err != nil {
+			return -1, "", err
+		}
+		dir = next
+	}
+	return dir, names[len(names)-1], nil
+}
+
+// p9Open opens path below root as p9At resolves it. A symlink at path is
+// not followed either.
+func p9Open(root, path string, flags int, mode uint32) (int, error) {
+	dir, name, err := p9At(root, path)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(dir)
+	return syscall.Openat(dir, name, flags|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, mode)
+}
+
+// p9Stat returns the attributes of path below root, or of the symlink at
+// path.
+func p9Stat(root, path string) (p9Qid, *syscall.Stat_t, error) {
+	fd, err := p9Open(root, path, oPath, 0)
+	if err != nil {
+		return p9Qid{}, nil, err
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return p9Qid{}, nil, err
+	}
+	return p9QidOf(&st), &st, nil
+}
+
+// p9Chmod changes the mode of path below root. Linux cannot change the mode
+// of a symlink, nor of a file open with O_PATH except through its /proc
+// entry, which refers to the open file rather than to a path.
+func p9Chmod(root, path string, mode uint32) error {
+	fd, err := p9Open(root, path, oPath, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return syscall.EOPNOTSUPP
+	}
+	return syscall.Chmod("/proc/self/fd/"+strconv.Itoa(fd), mode)
+}
+
+// p9SymlinkTarget reports whether a symlink in dir, a directory below root,
+// may point to target. The target must be relative, and ".." may only
+// appear before the other components, where it refers to the parents of dir
+// rather than of a symlink, and may not climb out of root. Symlinks that
+// pass the check resolve within root even when the host follows them.
+func p9SymlinkTarget(root, dir, target string) bool {
+	if target == "" || filepath.IsAbs(target) {
+		return false
+	}
+	up := 0
+	names := false
+	for _, name := range strings.Split(target, "/") {
+		switch name {
+		case "", ".":
+		case "..":
+			if names {
+				return false
+			}
+			up++
+		default:
+			names = true
+		}
+	}
+	for i := 0; i < up; i++ {
+		if dir == root {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+	return true
+}
+
+// Serve serves the 9P requests read from conn until it fails or reaches
+// EOF, so that the directories can be exported over a stream such as a
+// socket instead of a virtio-9p device.
+func (s *P9Server) Serve(conn io.ReadWriter) error {
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := binary.LittleEndian.Uint32(size[:])
+		if n < p9HdrSize || n > p9MaxSize {
+			return fmt.Errorf("invalid 9p message size %d", n)
+		}
+		req := make([]byte, n)
+		copy(req, size[:])
+		if _, err := io.ReadFull(conn, req[len(size):]); err != nil {
+			return err
+		}
+		if resp := s.Handle9P(req); resp != nil {
+			if _, err := conn.Write(resp); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Handle9P serves a single 9P request.
+func (s *P9Server) Handle9P(req []byte) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d := &p9Dec{b: req}
+	d.u32() // size
+	typ := d.u8()
+	tag := d.u16()
+	if d.err != nil {
+		return nil
+	}
+
+	e := &p9Enc{b: make([]byte, p9HdrSize, 64)}
+	rtyp := typ + 1
+	err := s.serve(typ, d, e)
+	if err == nil && d.err != nil {
+		err = d.err
+	}
+	if err != nil {
+		e.b = e.b[:p9HdrSize]
+		e.u32(p9Errno(err))
+		rtyp = p9Rlerror
+	}
+	binary.LittleEndian.PutUint32(e.b[0:], uint32(len(e.b)))
+	e.b[4] = rtyp
+	binary.LittleEndian.PutUint16(e.b[5:], tag)
+	return e.b
+}
+
+func (s *P9Server) fid(d *p9Dec) (*p9Fid, error) {
+	f, ok := s.fids[d.u32()]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return f, nil
+}
+
+// child returns the path of name within dir after checking it against the
+// sandbox policy.
+func (s *P9Server) child(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return "", syscall.EINVAL
+	}
+	path := filepath.Join(dir, name)
+	if !s.c.CanAccess(path) {
+		return "", syscall.EACCES
+	}
+	return path, nil
+}
+
+func (s *P9Server) serve(typ uint8, d *p9Dec, e *p9Enc) error {
+	switch typ {
+	case p9Tversion:
+		return s.version(d, e)
+	case p9Tauth:
+		return syscall.EOPNOTSUPP
+	case p9Tattach:
+		return s.attach(d, e)
+	case p9Tflush:
+		return nil
+	case p9Twalk:
+		return s.walk(d, e)
+	case p9Tgetattr:
+		return s.getattr(d, e)
+	case p9Tsetattr:
+		return s.setattr(d)
+	case p9Tlopen:
+		return s.lopen(d, e)
+	case p9Tlcreate:
+		return s.lcreate(d, e)
+	case p9Tread:
+		return s.read(d, e)
+	case p9Twrite:
+		return s.write(d, e)
+	case p9Tclunk:
+		return s.clunk(d)
+	case p9Tremove:
+		return s.remove(d)
+	case p9Treaddir:
+		return s.readdir(d, e)
+	case p9Tstatfs:
+		return s.statfs(d, e)
+	case p9Tfsync:
+		f, err := s.fid(d)
+		if err != nil {
+			return err
+		}
+		if f.file == nil {
+			return syscall.EBADF
+		}
+		return f.file.Sync()
+	case p9Tmkdir:
+		return s.mkdir(d, e)
+	case p9Tsymlink:
+		return s.symlink(d, e)
+	case p9Treadlink:
+		f, err := s.fid(d)
+		if err != nil {
+			return err
+		}
+		dir, name, err := p9At(f.root, f.path)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(dir)
+		target, err := readlinkat(dir, name)
+		if err != nil {
+			return err
+		}
+		e.str(target)
+		return nil
+	case p9Tlink:
+		return s.link(d)
+	case p9Trename:
+		return s.rename(d)
+	case p9Trenameat:
+		return s.renameat(d)
+	case p9Tunlinkat:
+		return s.unlinkat(d)
+	case p9Tlock:
+		return s.lockFile(d, e)
+	case p9Tgetlock:
+		return s.getlock(d, e)
+	case p9Tmknod, p9Txattrwalk, p9Txattrcreate:
+		return syscall.EOPNOTSUPP
+	}
+	return syscall.EOPNOTSUPP
+}
+
+func (s *P9Server) version(d *p9Dec, e *p9Enc) error {
+	msize := d.u32()
+	version := d.str()
+	if d.err != nil {
+		return d.err
+	}
+	// responses must fit at least a directory entry and the Rread header
+	if msize < p9MinSize {
+		return syscall.EINVAL
+	}
+	for _, f := range s.fids {
+		if f.file != nil {
+			f.file.Close()
+		}
+	}
+	s.fids = make(map[uint32]*p9Fid)
+	s.msize = min(msize, p9MaxSize)
+	e.u32(s.msize)
+	if version != p9Version {
+		version = "unknown"
+	}
+	e.str(version)
+	return nil
+}
+
+func (s *P9Server) attach(d *p9Dec, e *p9Enc) error {
+	fid := d.u32()
+	d.u32() // afid
+	d.str() // uname
+	aname := d.str()
+	d.u32() // n_uname
+	if d.err != nil {
+		return d.err
+	}
+	if _, ok := s.fids[fid]; ok {
+		return syscall.EBADF
+	}
+	root := aname
+	if root == "" {
+		if len(s.c.dirs) == 0 {
+			return syscall.ENOENT
+		}
+		root = s.c.dirs[0]
+	}
+	root = filepath.Clean(root)
+	if !filepath.IsAbs(root) || !s.c.CanAccess(root) {
+		return syscall.EACCES
+	}
+	qid, _, err := p9Stat(root, root)
+	if err != nil {
+		return err
+	}
+	s.fids[fid] = &p9Fid{root: root, path: root}
+	e.qid(qid)
+	return nil
+}
+
+func (s *P9Server) walk(d *p9Dec, e *p9Enc) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	newfid := d.u32()
+	nwname := int(d.u16())
+	if nwname > p9MaxWalk {
+		return syscall.EINVAL
+	}
+	names := make([]string, nwname)
+	for i := range names {
+		names[i] = d.str()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if nf, ok := s.fids[newfid]; ok && nf != f {
+		return syscall.EBADF
+	}
+
+	path := f.path
+	var qids []p9Qid
+	for _, name := range names {
+		var next string
+		if name == ".." {
+			// ".." at the root of the export stays at the root
+			next = path
+			if path != f.root {
+				next = filepath.Dir(path)
+			}
+		} else {
+			next, err = s.child(path, name)
+		}
+		var qid p9Qid
+		if err == nil {
+			qid, _, err = p9Stat(f.root, next)
+		}
+		if err != nil {
+			if len(qids) == 0 {
+				return err
+			}
+			break
+		}
+		qids = append(qids, qid)
+		path = next
+	}
+	if len(qids) == len(names) {
+		if newfid == p9NoFid {
+			return syscall.EBADF
+		}
+		s.fids[newfid] = &p9Fid{root: f.root, path: path}
+	}
+	e.u16(uint16(len(qids)))
+	for _, q := range qids {
+		e.qid(q)
+	}
+	return nil
+}
+
+func (s *P9Server) getattr(d *p9Dec, e *p9Enc) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	d.u64() // request mask
+	qid, st, err := p9Stat(f.root, f.path)
+	if err != nil {
+		return err
+	}
+	e.u64(p9GetattrBasic)
+	e.qid(qid)
+	e.u32(st.Mode)
+	e.u32(st.Uid)
+	e.u32(st.Gid)
+	e.u64(uint64(st.Nlink))
+	e.u64(st.Rdev)
+	e.u64(uint64(st.Size))
+	e.u64(uint64(st.Blksize))
+	e.u64(uint64(st.Blocks))
+	e.u64(uint64(st.Atim.Sec))
+	e.u64(uint64(st.Atim.Nsec))
+	e.u64(uint64(st.Mtim.Sec))
+	e.u64(uint64(st.Mtim.Nsec))
+	e.u64(uint64(st.Ctim.Sec))
+	e.u64(uint64(st.Ctim.Nsec))
+	e.u64(0) // btime
+	e.u64(0)
+	e.u64(0) // gen
+	e.u64(0) // data_version
+	return nil
+}
+
+func (s *P9Server) setattr(d *p9Dec) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	valid := d.u32()
+	mode := d.u32()
+	uid := d.u32()
+	gid := d.u32()
+	size := d.u64()
+	atime := syscall.NsecToTimespec(int64(d.u64())*1e9 + int64(d.u64()))
+	mtime := syscall.NsecToTimespec(int64(d.u64())*1e9 + int64(d.u64()))
+	if d.err != nil {
+		return d.err
+	}
+	if valid&p9SetattrMode != 0 {
+		if err := p9Chmod(f.root, f.path, mode&0o7777); err != nil {
+			return err
+		}
+	}
+	dir, name, err := p9At(f.root, f.path)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dir)
+	if valid&(p9SetattrUID|p9SetattrGID) != 0 {
+		u, g := -1, -1
+		if valid&p9SetattrUID != 0 {
+			u = int(uid)
+		}
+		if valid&p9SetattrGID != 0 {
+			g = int(gid)
+		}
+		if err := syscall.Fchownat(dir, name, u, g, p9SymlinkNoFollow); err != nil {
+			return err
+		}
+	}
+	if valid&p9SetattrSize != 0 {
+		fd, err := syscall.Openat(dir, name, syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		err = syscall.Ftruncate(fd, int64(size))
+		syscall.Close(fd)
+		if err != nil {
+			return err
+		}
+	}
+	if valid&(p9SetattrAtime|p9SetattrMtime) != 0 {
+		_, st, err := p9Stat(f.root, f.path)
+		if err != nil {
+			return err
+		}
+		now := syscall.NsecToTimespec(time.Now().UnixNano())
+		ts := [2]syscall.Timespec{st.Atim, st.Mtim}
+		if valid&p9SetattrAtime != 0 {
+			ts[0] = now
+			if valid&p9SetattrAtimeSet != 0 {
+				ts[0] = atime
+			}
+		}
+		if valid&p9SetattrMtime != 0 {
+			ts[1] = now
+			if valid&p9SetattrMtimeSet != 0 {
+				ts[1] = mtime
+			}
+		}
+		if err := utimensat(dir, name, &ts, p9SymlinkNoFollow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *P9Server) iounit() uint32 {
+	return s.msize - p9IOHdr
+}
+
+func (s *P9Server) lopen(d *p9Dec, e *p9Enc) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	flags := int(d.u32()) & p9OpenMask
+	if d.err != nil {
+		return d.err
+	}
+	if f.file != nil {
+		return syscall.EBADF
+	}
+	fd, err := p9Open(f.root, f.path, flags&^(syscall.O_CREAT|syscall.O_EXCL), 0)
+	if err != nil {
+		return err
+	}
+	return s.opened(f, f.path, fd, e)
+}
+
+// opened makes the file open at fd the open file of f and replies with its
+// qid and the I/O unit.
+func (s *P9Server) opened(f *p9Fid, path string, fd int, e *p9Enc) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	f.path = path
+	f.file = os.NewFile(uintptr(fd), path)
+	e.qid(p9QidOf(&st))
+	e.u32(s.iounit())
+	return nil
+}
+
+func (s *P9Server) lcreate(d *p9Dec, e *p9Enc) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	flags := int(d.u32()) & p9OpenMask
+	mode := d.u32()
+	d.u32() // gid
+	if d.err != nil {
+		return d.err
+	}
+	if f.file != nil {
+		return syscall.EBADF
+	}
+	path, err := s.child(f.path, name)
+	if err != nil {
+		return err
+	}
+	fd, err := p9Open(f.root, path, flags|syscall.O_CREAT, mode&0o777)
+	if err != nil {
+		return err
+	}
+	return s.opened(f, path, fd, e)
+}
+
+func (s *P9Server) read(d *p9Dec, e *p9Enc) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	off := int64(d.u64())
+	count := min(d.u32(), s.iounit())
+	if d.err != nil {
+		return d.err
+	}
+	if f.file == nil {
+		return syscall.EBADF
+	}
+	e.u32(0)
+	start := len(e.b)
+	e.b = append(e.b, make([]byte, count)...)
+	n, err := syscall.Pread(int(f.file.Fd()), e.b[start:], off)
+	if err != nil {
+		return err
+	}
+	e.b = e.b[:start+n]
+	binary.LittleEndian.PutUint32(e.b[start-4:], uint32(n))
+	return nil
+}
+
+func (s *P9Server) write(d *p9Dec, e *p9Enc) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	off := int64(d.u64())
+	data := d.take(int(d.u32()))
+	if d.err != nil {
+		return d.err
+	}
+	if f.file == nil {
+		return syscall.EBADF
+	}
+	// pwrite appends regardless of the offset if the file was opened with
+	// O_APPEND, which matches the guest's expectations
+	n, err := syscall.Pwrite(int(f.file.Fd()), data, off)
+	if err != nil {
+		return err
+	}
+	e.u32(uint32(n))
+	return nil
+}
+
+func (s *P9Server) clunk(d *p9Dec) error {
+	fid := d.u32()
+	f, ok := s.fids[fid]
+	if !ok {
+		return syscall.EBADF
+	}
+	delete(s.fids, fid)
+	if f.file != nil {
+		return f.file.Close()
+	}
+	return nil
+}
+
+func (s *P9Server) remove(d *p9Dec) error {
+	fid := d.u32()
+	f, ok := s.fids[fid]
+	if !ok {
+		return syscall.EBADF
+	}
+	// the fid is clunked even if the remove fails
+	delete(s.fids, fid)
+	if f.file != nil {
+		f.file.Close()
+	}
+	if f.path == f.root || !s.c.CanAccess(filepath.Dir(f.path)) {
+		return syscall.EACCES
+	}
+	dir, name, err := p9At(f.root, f.path)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dir)
+	// like os.Remove, try both and report the error that applies
+	err = unlinkat(dir, name, 0)
+	if err == nil {
+		return nil
+	}
+	rmErr := unlinkat(dir, name, p9RemoveAt)
+	if rmErr == nil {
+		return nil
+	}
+	if rmErr != syscall.ENOTDIR {
+		err = rmErr
+	}
+	return err
+}
+
+func (s *P9Server) readdir(d *p9Dec, e *p9Enc) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	off := d.u64()
+	count := min(d.u32(), s.iounit())
+	if d.err != nil {
+		return d.err
+	}
+	if f.file == nil {
+		return syscall.EBADF
+	}
+	if off == 0 || f.dir == nil {
+		if f.dir, err = s.listDir(f); err != nil {
+			return err
+		}
+	}
+	e.u32(0)
+	start := len(e.b)
+	for i := off; i < uint64(len(f.dir)); i++ {
+		ent := f.dir[i]
+		if uint32(len(e.b)-start+p9QidSize+8+1+2+len(ent.name)) > count {
+			break
+		}
+		e.qid(ent.qid)
+		e.u64(i + 1)
+		e.u8(ent.typ)
+		e.str(ent.name)
+	}
+	binary.LittleEndian.PutUint32(e.b[start-4:], uint32(len(e.b)-start))
+	return nil
+}
+
+// listDir reads the open directory of f, including the "." and ".."
+// entries. Offsets used by readdir are indices into the returned list.
+func (s *P9Server) listDir(f *p9Fid) ([]p9Dirent, error) {
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	entries, err := f.file.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	dirents := make([]p9Dirent, 0, len(entries)+2)
+	parent := f.path
+	if f.path != f.root {
+		parent = filepath.Dir(f.path)
+	}
+	for _, dot := range []struct{ name, path string }{{".", f.path}, {"..", parent}} {
+		qid, _, err := p9Stat(f.root, dot.path)
+		if err != nil {
+			return nil, err
+		}
+		dirents = append(dirents, p9Dirent{qid: qid, typ: syscall.DT_DIR, name: dot.name})
+	}
+	dir := int(f.file.Fd())
+	for _, ent := range entries {
+		var st syscall.Stat_t
+		fd, err := syscall.Openat(dir, ent.Name(), oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			continue
+		}
+		err = syscall.Fstat(fd, &st)
+		syscall.Close(fd)
+		if err != nil {
+			continue
+		}
+		qid := p9QidOf(&st)
+		dirents = append(dirents, p9Dirent{
+			qid:  qid,
+			typ:  uint8(st.Mode & syscall.S_IFMT >> 12),
+			name: ent.Name(),
+		})
+	}
+	return dirents, nil
+}
+
+func (s *P9Server) statfs(d *p9Dec, e *p9Enc) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	fd, err := p9Open(f.root, f.path, oPath, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var st syscall.Statfs_t
+	if err := syscall.Fstatfs(fd, &st); err != nil {
+		return err
+	}
+	e.u32(uint32(st.Type))
+	e.u32(uint32(st.Bsize))
+	e.u64(st.Blocks)
+	e.u64(st.Bfree)
+	e.u64(st.Bavail)
+	e.u64(st.Files)
+	e.u64(st.Ffree)
+	e.u64(uint64(uint32(st.Fsid.X__val[0])) | uint64(uint32(st.Fsid.X__val[1]))<<32)
+	e.u32(uint32(st.Namelen))
+	return nil
+}
+
+func (s *P9Server) mkdir(d *p9Dec, e *p9Enc) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	mode := d.u32()
+	d.u32() // gid
+	if d.err != nil {
+		return d.err
+	}
+	path, err := s.child(f.path, name)
+	if err != nil {
+		return err
+	}
+	dir, base, err := p9At(f.root, path)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dir)
+	if err := syscall.Mkdirat(dir, base, mode&0o7777); err != nil {
+		return err
+	}
+	qid, _, err := p9Stat(f.root, path)
+	if err != nil {
+		return err
+	}
+	e.qid(qid)
+	return nil
+}
+
+func (s *P9Server) symlink(d *p9Dec, e *p9Enc) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	target := d.str()
+	d.u32() // gid
+	if d.err != nil {
+		return d.err
+	}
+	path, err := s.child(f.path, name)
+	if err != nil {
+		return err
+	}
+	if !p9SymlinkTarget(f.root, f.path, target) {
+		return syscall.EACCES
+	}
+	dir, base, err := p9At(f.root, path)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dir)
+	if err := symlinkat(target, dir, base); err != nil {
+		return err
+	}
+	qid, _, err := p9Stat(f.root, path)
+	if err != nil {
+		return err
+	}
+	e.qid(qid)
+	return nil
+}
+
+func (s *P9Server) link(d *p9Dec) error {
+	dir, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	if d.err != nil {
+		return d.err
+	}
+	path, err := s.child(dir.path, name)
+	if err != nil {
+		return err
+	}
+	return p9AtBoth(f.root, f.path, dir.root, path, linkat)
+}
+
+// p9AtBoth resolves two paths as p9At does and applies op, such as
+// renameat or linkat, to them.
+func p9AtBoth(oldroot, oldpath, newroot, newpath string, op func(olddirfd int, oldname string, newdirfd int, newname string) error) error {
+	olddir, oldname, err := p9At(oldroot, oldpath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(olddir)
+	newdir, newname, err := p9At(newroot, newpath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(newdir)
+	return op(olddir, oldname, newdir, newname)
+}
+
+func (s *P9Server) rename(d *p9Dec) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	dir, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	if d.err != nil {
+		return d.err
+	}
+	path, err := s.child(dir.path, name)
+	if err != nil {
+		return err
+	}
+	if err := p9AtBoth(f.root, f.path, dir.root, path, syscall.Renameat); err != nil {
+		return err
+	}
+	f.root = dir.root
+	f.path = path
+	return nil
+}
+
+func (s *P9Server) renameat(d *p9Dec) error {
+	olddir, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	oldname := d.str()
+	newdir, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	newname := d.str()
+	if d.err != nil {
+		return d.err
+	}
+	oldpath, err := s.child(olddir.path, oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := s.child(newdir.path, newname)
+	if err != nil {
+		return err
+	}
+	return p9AtBoth(olddir.root, oldpath, newdir.root, newpath, syscall.Renameat)
+}
+
+func (s *P9Server) unlinkat(d *p9Dec) error {
+	dir, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	flags := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	path, err := s.child(dir.path, name)
+	if err != nil {
+		return err
+	}
+	at, name, err := p9At(dir.root, path)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(at)
+	return unlinkat(at, name, int(flags&p9RemoveAt))
+}
+
+// lockFile grants every lock request. Only one guest uses the server, so
+// advisory locks do not need to be enforced on the host.
+func (s *P9Server) lockFile(d *p9Dec, e *p9Enc) error {
+	if _, err := s.fid(d); err != nil {
+		return err
+	}
+	e.u8(p9LockSuccess)
+	return nil
+}
+
+func (s *P9Server) getlock(d *p9Dec, e *p9Enc) error {
+	if _, err := s.fid(d); err != nil {
+		return err
+	}
+	d.u8() // type
+	start := d.u64()
+	length := d.u64()
+	procID := d.u32()
+	clientID := d.str()
+	if d.err != nil {
+		return d.err
+	}
+	e.u8(p9LockUnlck)
+	e.u64(start)
+	e.u64(length)
+	e.u32(procID)
+	e.str(clientID)
+	return nil
+}
@@ -0,0 +1,426 @@
+package revisor
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+// p9Client sends 9P requests to a P9Server over a pipe.
+type p9Client struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// newP9Client exports a new directory and returns a client attached to it
+// as fid 0, together with the exported directory and a directory outside of
+// it.
+func newP9Client(t *testing.T) (*p9Client, string, string) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "export")
+	outside := filepath.Join(tmp, "outside")
+	for _, dir := range []string{root, filepath.Join(root, "dir"), outside} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(root, "file"):      "hello",
+		filepath.Join(outside, "secret"): "secret",
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"escape":     outside,
+		"escapefile": filepath.Join(outside, "secret"),
+		"dir/up":     "../..",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := NewP9Server(NewContainer([]string{root}))
+	client, server := net.Pipe()
+	done := make(chan error)
+	go func() { done <- srv.Serve(server) }()
+	t.Cleanup(func() {
+		client.Close()
+		if err := <-done; err != nil && err != io.ErrClosedPipe {
+			t.Error(err)
+		}
+	})
+
+	c := &p9Client{t: t, conn: client}
+	c.ok(c.rpc(p9Tversion, uint32(p9MaxSize), p9Version))
+	c.ok(c.rpc(p9Tattach, uint32(0), p9NoFid, "", "", uint32(0)))
+	return c, root, outside
+}
+
+// rpc sends a request with the given fields and returns the response type
+// and a decoder for its body. A []string field is encoded with a 16-bit
+// count, as in Twalk.
+func (c *p9Client) rpc(typ uint8, fields ...any) (uint8, *p9Dec) {
+	c.t.Helper()
+	e := &p9Enc{b: make([]byte, p9HdrSize)}
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint8:
+			e.u8(v)
+		case uint16:
+			e.u16(v)
+		case uint32:
+			e.u32(v)
+		case uint64:
+			e.u64(v)
+		case string:
+			e.str(v)
+		case []string:
+			e.u16(uint16(len(v)))
+			for _, s := range v {
+				e.str(s)
+			}
+		case []byte:
+			e.b = append(e.b, v...)
+		default:
+			c.t.Fatalf("cannot encode %T", f)
+		}
+	}
+	binary.LittleEndian.PutUint32(e.b[0:], uint32(len(e.b)))
+	e.b[4] = typ
+	binary.LittleEndian.PutUint16(e.b[5:], 1)
+	if _, err := c.conn.Write(e.b); err != nil {
+		c.t.Fatal(err)
+	}
+
+	var hdr [p9HdrSize]byte
+	if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	resp := make([]byte, binary.LittleEndian.Uint32(hdr[0:])-p9HdrSize)
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		c.t.Fatal(err)
+	}
+	if rtyp := hdr[4]; rtyp != p9Rlerror && rtyp != typ+1 {
+		c.t.Fatalf("response type %d to request type %d", rtyp, typ)
+	}
+	if tag := binary.LittleEndian.Uint16(hdr[5:]); tag != 1 {
+		c.t.Fatalf("response tag %d", tag)
+	}
+	return hdr[4], &p9Dec{b: resp}
+}
+
+// ok fails the test if a response is an error.
+func (c *p9Client) ok(rtyp uint8, d *p9Dec) *p9Dec {
+	c.t.Helper()
+	if rtyp == p9Rlerror {
+		c.t.Fatalf("request failed: %v", syscall.Errno(d.u32()))
+	}
+	return d
+}
+
+// errno returns the error of a response, or 0 if it succeeded.
+func errno(rtyp uint8, d *p9Dec) syscall.Errno {
+	if rtyp != p9Rlerror {
+		return 0
+	}
+	return syscall.Errno(d.u32())
+}
+
+// walk walks fid 0 to newfid and returns the qids of the response.
+func (c *p9Client) walk(newfid uint32, names ...string) []p9Qid {
+	c.t.Helper()
+	d := c.ok(c.rpc(p9Twalk, uint32(0), newfid, names))
+	qids := make([]p9Qid, d.u16())
+	for i := range qids {
+		qids[i] = p9Qid{typ: d.u8(), version: d.u32(), path: d.u64()}
+	}
+	return qids
+}
+
+func (c *p9Client) lopen(fid, flags uint32) {
+	c.t.Helper()
+	c.ok(c.rpc(p9Tlopen, fid, flags))
+}
+
+func (c *p9Client) read(fid uint32) string {
+	c.t.Helper()
+	d := c.ok(c.rpc(p9Tread, fid, uint64(0), uint32(4096)))
+	return string(d.take(int(d.u32())))
+}
+
+func TestP9Version(t *testing.T) {
+	c, _, _ := newP9Client(t)
+	tests := []struct {
+		msize uint32
+		want  uint32
+		err   syscall.Errno
+	}{
+		{0, 0, syscall.EINVAL},
+		{p9IOHdr - 1, 0, syscall.EINVAL},
+		{p9MinSize - 1, 0, syscall.EINVAL},
+		{p9MinSize, p9MinSize, 0},
+		{1 << 31, p9MaxSize, 0},
+	}
+	for _, tt := range tests {
+		rtyp, d := c.rpc(p9Tversion, tt.msize, p9Version)
+		if err := errno(rtyp, d); err != tt.err {
+			t.Errorf("msize %d: got error %v, want %v", tt.msize, err, tt.err)
+			continue
+		}
+		if tt.err == 0 {
+			if msize := d.u32(); msize != tt.want {
+				t.Errorf("msize %d negotiated to %d, want %d", tt.msize, msize, tt.want)
+			}
+		}
+	}
+	// reads are limited by the negotiated size
+	c.ok(c.rpc(p9Tversion, uint32(p9MinSize), p9Version))
+	c.ok(c.rpc(p9Tattach, uint32(0), p9NoFid, "", "", uint32(0)))
+	d := c.ok(c.rpc(p9Tlopen, uint32(0), uint32(syscall.O_RDONLY)))
+	d.take(p9QidSize)
+	if iounit := d.u32(); iounit != p9MinSize-p9IOHdr {
+		t.Errorf("I/O unit %d, want %d", iounit, p9MinSize-p9IOHdr)
+	}
+}
+
+func TestP9Walk(t *testing.T) {
+	tests := []struct {
+		name  string
+		names []string
+		qids  int // number of qids in Rwalk
+		err   syscall.Errno
+	}{
+		{"file", []string{"file"}, 1, 0},
+		{"nested", []string{"dir", ".."}, 2, 0},
+		{"clone", nil, 0, 0},
+		{"missing", []string{"missing"}, 0, syscall.ENOENT},
+		{"partial", []string{"dir", "missing"}, 1, 0},
+		{"slash", []string{"dir/.."}, 0, syscall.EINVAL},
+		{"dot", []string{"."}, 0, syscall.EINVAL},
+		{"too long", make([]string, p9MaxWalk+1), 0, syscall.EINVAL},
+		// symlinks are returned as such, but walks do not pass through them
+		{"symlink", []string{"escape"}, 1, 0},
+		{"through symlink", []string{"escape", "secret"}, 1, 0},
+		{"through relative symlink", []string{"dir", "up", "outside"}, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, _ := newP9Client(t)
+			rtyp, d := c.rpc(p9Twalk, uint32(0), uint32(1), tt.names)
+			if err := errno(rtyp, d); err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.err != 0 {
+				return
+			}
+			if n := int(d.u16()); n != tt.qids {
+				t.Fatalf("walked %d names, want %d", n, tt.qids)
+			}
+			// the new fid only exists if the whole walk succeeded
+			rtyp, d = c.rpc(p9Tgetattr, uint32(1), uint64(p9GetattrBasic))
+			if err := errno(rtyp, d); (err == 0) != (tt.qids == len(tt.names)) {
+				t.Errorf("getattr of the new fid returned %v", err)
+			}
+		})
+	}
+
+	c, _, _ := newP9Client(t)
+	root := c.walk(1, "dir", "..")[1]
+	if up := c.walk(2, ".."); up[0] != root {
+		t.Error(`".." at the root of the export left it`)
+	}
+	if qids := c.walk(3, "escape"); qids[0].typ != p9QtSymlink {
+		t.Errorf("symlink walked to qid type %#x", qids[0].typ)
+	}
+}
+
+func TestP9Read(t *testing.T) {
+	c, _, _ := newP9Client(t)
+	c.walk(1, "file")
+	if rtyp, d := c.rpc(p9Tread, uint32(1), uint64(0), uint32(10)); errno(rtyp, d) != syscall.EBADF {
+		t.Error("read from a fid that is not open")
+	}
+	c.lopen(1, syscall.O_RDONLY)
+	if got := c.read(1); got != "hello" {
+		t.Errorf("read %q", got)
+	}
+	d := c.ok(c.rpc(p9Tread, uint32(1), uint64(3), uint32(10)))
+	if got := string(d.take(int(d.u32()))); got != "lo" {
+		t.Errorf("read %q at offset 3", got)
+	}
+	if rtyp, d := c.rpc(p9Tlopen, uint32(1), uint32(syscall.O_RDONLY)); errno(rtyp, d) != syscall.EBADF {
+		t.Error("opened a fid twice")
+	}
+	if rtyp, d := c.rpc(p9Tread, uint32(7), uint64(0), uint32(10)); errno(rtyp, d) != syscall.EBADF {
+		t.Error("read from an unknown fid")
+	}
+	c.ok(c.rpc(p9Tclunk, uint32(1)))
+	if rtyp, d := c.rpc(p9Tclunk, uint32(1)); errno(rtyp, d) != syscall.EBADF {
+		t.Error("clunked a fid twice")
+	}
+}
+
+func TestP9Readdir(t *testing.T) {
+	c, _, _ := newP9Client(t)
+	c.walk(1)
+	c.lopen(1, syscall.O_RDONLY|syscall.O_DIRECTORY)
+	var names []string
+	off := uint64(0)
+	for {
+		// a small count makes the server return the entries in batches
+		d := c.ok(c.rpc(p9Treaddir, uint32(1), off, uint32(64)))
+		n := d.u32()
+		if n == 0 {
+			break
+		}
+		d = &p9Dec{b: d.take(int(n))}
+		for len(d.b) > 0 {
+			d.take(p9QidSize)
+			off = d.u64()
+			d.u8()
+			names = append(names, d.str())
+		}
+	}
+	sort.Strings(names)
+	want := []string{".", "..", "dir", "escape", "escapefile", "file"}
+	if len(names) != len(want) {
+		t.Fatalf("read entries %q, want %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("read entries %q, want %q", names, want)
+		}
+	}
+}
+
+func TestP9Create(t *testing.T) {
+	c, root, outside := newP9Client(t)
+	c.walk(1, "dir")
+	c.ok(c.rpc(p9Tlcreate, uint32(1), "new", uint32(syscall.O_RDWR), uint32(0o644), uint32(0)))
+	c.ok(c.rpc(p9Twrite, uint32(1), uint64(0), uint32(3), []byte("abc")))
+	if data, err := os.ReadFile(filepath.Join(root, "dir", "new")); err != nil || string(data) != "abc" {
+		t.Errorf("created file holds %q, %v", data, err)
+	}
+	c.ok(c.rpc(p9Tmkdir, uint32(0), "sub", uint32(0o755), uint32(0)))
+	if st, err := os.Stat(filepath.Join(root, "sub")); err != nil || !st.IsDir() {
+		t.Errorf("mkdir did not create a directory: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		err  syscall.Errno
+	}{
+		{"file", syscall.EEXIST},
+		{"a/b", syscall.EINVAL},
+		{"..", syscall.EINVAL},
+		{"escapefile", syscall.EEXIST},
+	}
+	for _, tt := range tests {
+		c.walk(2)
+		rtyp, d := c.rpc(p9Tlcreate, uint32(2), tt.name, uint32(syscall.O_RDWR|syscall.O_EXCL|syscall.O_TRUNC), uint32(0o644), uint32(0))
+		if err := errno(rtyp, d); err != tt.err {
+			t.Errorf("create %q: got error %v, want %v", tt.name, err, tt.err)
+		}
+		c.ok(c.rpc(p9Tclunk, uint32(2)))
+	}
+	// opening a symlink without O_EXCL would truncate the file outside
+	c.walk(2)
+	rtyp, d := c.rpc(p9Tlcreate, uint32(2), "escapefile", uint32(syscall.O_RDWR|syscall.O_TRUNC), uint32(0o644), uint32(0))
+	if err := errno(rtyp, d); err != syscall.ELOOP {
+		t.Errorf("create through a symlink: got error %v, want %v", err, syscall.ELOOP)
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "secret")); string(data) != "secret" {
+		t.Error("file outside the export was truncated")
+	}
+}
+
+func TestP9Escape(t *testing.T) {
+	c, _, outside := newP9Client(t)
+	secret := filepath.Join(outside, "secret")
+	c.walk(1, "escapefile")
+	c.walk(2, "escape")
+
+	requests := []struct {
+		name   string
+		typ    uint8
+		fields []any
+	}{
+		{"open symlink to file", p9Tlopen, []any{uint32(1), uint32(syscall.O_RDONLY)}},
+		{"open symlink to directory", p9Tlopen, []any{uint32(2), uint32(syscall.O_RDONLY)}},
+		{"truncate", p9Tsetattr, []any{uint32(1), uint32(p9SetattrSize), uint32(0), uint32(0), uint32(0), uint64(0), uint64(0), uint64(0), uint64(0), uint64(0)}},
+		{"chmod", p9Tsetattr, []any{uint32(1), uint32(p9SetattrMode), uint32(0o777), uint32(0), uint32(0), uint64(0), uint64(0), uint64(0), uint64(0), uint64(0)}},
+		{"create in symlinked directory", p9Tlcreate, []any{uint32(2), "x", uint32(syscall.O_RDWR), uint32(0o644), uint32(0)}},
+		{"mkdir in symlinked directory", p9Tmkdir, []any{uint32(2), "x", uint32(0o755), uint32(0)}},
+		{"unlink in symlinked directory", p9Tunlinkat, []any{uint32(2), "secret", uint32(0)}},
+		{"absolute symlink", p9Tsymlink, []any{uint32(0), "abs", secret, uint32(0)}},
+		{"symlink out of the export", p9Tsymlink, []any{uint32(0), "up", "../outside/secret", uint32(0)}},
+		{"symlink through a symlink", p9Tsymlink, []any{uint32(0), "up", "escape/../secret", uint32(0)}},
+		{"symlink with inner dot-dot", p9Tsymlink, []any{uint32(0), "up", "dir/../../outside", uint32(0)}},
+	}
+	for _, tt := range requests {
+		if err := errno(c.rpc(tt.typ, tt.fields...)); err == 0 {
+			t.Errorf("%s: succeeded", tt.name)
+		}
+	}
+	st, err := os.Stat(secret)
+	if err != nil || st.Size() != int64(len("secret")) || st.Mode().Perm() != 0o644 {
+		t.Errorf("file outside the export changed: %v, %v", st, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "x")); err == nil {
+		t.Error("file created outside the export")
+	}
+
+	// symlinks that stay within the export can be created and read back
+	for _, target := range []string{"file", "dir", "../file"} {
+		dir := uint32(0)
+		if target == "../file" {
+			c.walk(3, "dir")
+			dir = 3
+		}
+		c.ok(c.rpc(p9Tsymlink, dir, "link", target, uint32(0)))
+		c.rpc(p9Tclunk, uint32(4))
+		if dir == 0 {
+			c.walk(4, "link")
+		} else {
+			c.ok(c.rpc(p9Twalk, dir, uint32(4), []string{"link"}))
+		}
+		d := c.ok(c.rpc(p9Treadlink, uint32(4)))
+		if got := d.str(); got != target {
+			t.Errorf("symlink to %q read back as %q", target, got)
+		}
+		c.ok(c.rpc(p9Tunlinkat, dir, "link", uint32(0)))
+	}
+}
+
+func TestP9Errors(t *testing.T) {
+	c, _, _ := newP9Client(t)
+	tests := []struct {
+		name   string
+		typ    uint8
+		fields []any
+		err    syscall.Errno
+	}{
+		{"auth", p9Tauth, []any{uint32(1), "", "", uint32(0)}, syscall.EOPNOTSUPP},
+		{"unknown message", 200, nil, syscall.EOPNOTSUPP},
+		{"short message", p9Twalk, []any{uint32(0)}, syscall.EINVAL},
+		{"attach used fid", p9Tattach, []any{uint32(0), p9NoFid, "", "", uint32(0)}, syscall.EBADF},
+		{"attach outside", p9Tattach, []any{uint32(1), p9NoFid, "", "/", uint32(0)}, syscall.EACCES},
+		{"getattr unknown fid", p9Tgetattr, []any{uint32(9), uint64(0)}, syscall.EBADF},
+		{"remove root", p9Tremove, []any{uint32(0)}, syscall.EACCES},
+	}
+	for _, tt := range tests {
+		if err := errno(c.rpc(tt.typ, tt.fields...)); err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package revisor
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// seededRand is a deterministic random byte stream formed by hashing the
+// seed together with a block counter.
+type seededRand struct {
+	lock    sync.Mutex
+	seed    uint64
+	counter uint64
+	buf     []byte
+}
+
+// NewSeededRand returns a deterministic source of random bytes. Two sources
+// created with the same seed produce the same stream, which makes runs that
+// consume guest entropy reproducible. It is not suitable for cryptography.
+func NewSeededRand(seed uint64) io.Reader {
+	return &seededRand{seed: seed}
+}
+
+func (r *seededRand) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			var block [16]byte
+			binary.LittleEndian.PutUint64(block[0:], r.seed)
+			binary.LittleEndian.PutUint64(block[8:], r.counter)
+			r.counter++
+			sum := sha256.Sum256(block[:])
+			r.buf = sum[:]
+		}
+		k := copy(p[n:], r.buf)
+		r.buf = r.buf[k:]
+		n += k
+	}
+	return n, nil
+}
@@ -0,0 +1,63 @@
+package revisor
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/zyedidia/revisor/kvm"
+)
+
+func TestSeededRand(t *testing.T) {
+	read := func(r io.Reader, sizes ...int) []byte {
+		var out []byte
+		for _, n := range sizes {
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, buf...)
+		}
+		return out
+	}
+	// the stream does not depend on how it is read
+	a := read(NewSeededRand(1), 100)
+	b := read(NewSeededRand(1), 1, 31, 33, 35)
+	if !bytes.Equal(a, b) {
+		t.Error("the same seed gave different bytes")
+	}
+	if c := read(NewSeededRand(2), 100); bytes.Equal(a, c) {
+		t.Error("different seeds gave the same bytes")
+	}
+}
+
+func TestGetrandom(t *testing.T) {
+	c := NewContainer(nil)
+	c.SetRand(NewSeededRand(1))
+	m, err := kvm.NewMachine("/dev/kvm", 1, 16<<20, c)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer m.Close()
+
+	const ram = 0x40000000
+	if n, _ := c.Hypercall(m, 0, hypGetrandom, ram+0x1000, 64, 0, 0, 0, 0); n != 64 {
+		t.Fatalf("getrandom returned %d, want 64", n)
+	}
+	want := make([]byte, 64)
+	io.ReadFull(NewSeededRand(1), want)
+	if got := m.Slice(ram+0x1000, ram+0x1000+64); !bytes.Equal(got, want) {
+		t.Error("getrandom did not return the seeded bytes")
+	}
+
+	for _, tt := range []struct{ ptr, size uint64 }{
+		{0, 64},
+		{ram + 16<<20 - 8, 64},
+		{ram, 1 << 63},
+		{^uint64(0) - 8, 64},
+	} {
+		if n, err := c.Hypercall(m, 0, hypGetrandom, tt.ptr, tt.size, 0, 0, 0, 0); n != errFail || err != nil {
+			t.Errorf("getrandom(%#x, %#x) returned %#x, %v, want a failure", tt.ptr, tt.size, n, err)
+		}
+	}
+}
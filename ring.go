@@ -0,0 +1,255 @@
+package revisor
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/zyedidia/revisor/kvm"
+)
+
+// Layout of the hypercall ring in guest memory. The header holds four 32-bit
+// indices, followed by the submission queue and then the completion queue.
+//
+//	0x00 sq_head (host)   0x04 sq_tail (guest)
+//	0x08 cq_head (guest)  0x0c cq_tail (host)
+//	0x40 sqe[entries]: num, args[6], user_data (8 bytes each)
+//	     cqe[entries]: user_data, result (8 bytes each)
+//
+// Indices increase freely and are reduced modulo the number of entries.
+const (
+	ringSQHead = 0x0
+	ringSQTail = 0x4
+	ringCQHead = 0x8
+	ringCQTail = 0xc
+
+	ringHdrSize    = 64
+	ringSQESize    = 64
+	ringCQESize    = 16
+	ringMaxEntries = 4096
+	ringWorkers    = 8
+)
+
+// ringOps are the hypercalls that may be submitted through the ring.
+var ringOps = map[uint64]bool{
+	hypWrite:      true,
+	hypOpen:       true,
+	hypRead:       true,
+	hypClose:      true,
+	hypLseek:      true,
+	hypTime:       true,
+	hypFstat:      true,
+	hypGetdents64: true,
+	hypGetrandom:  true,
+}
+
+type ringSQE struct {
+	num      uint64
+	args     [6]uint64
+	userData uint64
+}
+
+type ringCQE struct {
+	userData uint64
+	result   uint64
+}
+
+// hypRing is an io_uring-like pair of queues shared with the guest. The
+// guest fills submission entries and makes a single RingEnter hypercall;
+// worker goroutines perform the operations concurrently and post completion
+// entries, raising irq after each one. The guest lowers the interrupt with
+// the ClearSignal hypercall.
+type hypRing struct {
+	c       *Container
+	m       *kvm.Machine
+	pa      uint64
+	mem     []byte
+	entries uint32
+	irq     uint32
+	work    chan ringSQE
+	// holds a token for each operation started by async
+	async chan struct{}
+
+	// lock serializes completions
+	lock     sync.Mutex
+	cqTail   uint32
+	overflow []ringCQE
+}
+
+func (c *Container) ringSetup(m *kvm.Machine, pa, entries, irq uint64) (uint64, error) {
+	if c.ring != nil || entries == 0 || entries > ringMaxEntries || entries&(entries-1) != 0 || pa%ringHdrSize != 0 || !signalIRQ(irq) {
+		return errFail, nil
+	}
+	mem, err := m.PhysSlice(pa, ringHdrSize+entries*(ringSQESize+ringCQESize))
+	if err != nil {
+		return errFail, nil
+	}
+	r := &hypRing{
+		c:       c,
+		m:       m,
+		pa:      pa,
+		mem:     mem,
+		entries: uint32(entries),
+		irq:     uint32(irq),
+		work:    make(chan ringSQE, entries),
+		async:   make(chan struct{}, entries),
+		cqTail:  r32(mem, ringCQTail),
+	}
+	for i := 0; i < ringWorkers; i++ {
+		go r.worker()
+	}
+	c.ring = r
+	return 0, nil
+}
+
+// ringEnter submits the entries that the guest has added to the submission
+// queue and returns how many were submitted. When the workers are busy with
+// as many operations as the ring has entries, the rest are left in the
+// submission queue for a later RingEnter instead of stalling the vCPU.
+func (c *Container) ringEnter(m *kvm.Machine, cpu int) (uint64, error) {
+	r := c.ring
+	if r == nil {
+		return errFail, nil
+	}
+	r.flushOverflow()
+
+	head := r32(r.mem, ringSQHead)
+	tail := r32(r.mem, ringSQTail)
+	if tail-head > r.entries {
+		return errFail, nil
+	}
+	n := uint64(0)
+	for ; head != tail; head++ {
+		sqe := readSQE(r.mem[ringHdrSize+ringSQESize*(head%r.entries):])
+		sqe.translate(m, cpu)
+		select {
+		case r.work <- sqe:
+		default:
+			m.MarkDirty(r.pa, ringHdrSize)
+			return n, nil
+		}
+		w32(r.mem, ringSQHead, head+1)
+		n++
+	}
+	m.MarkDirty(r.pa, ringHdrSize)
+	return n, nil
+}
+
+// async starts the hypercall described by the submission entry at va on its
+// own goroutine and returns hypPending. The result is posted to the
+// completion queue like a ring submission, so a blocking operation such as a
+// read from a pipe does not stall the vCPU. At most as many operations as the
+// ring has entries run at once; beyond that async returns hypBusy.
+func (c *Container) async(m *kvm.Machine, cpu int, va uint64) (uint64, error) {
+	r := c.ring
+	if r == nil {
+		return errFail, nil
+	}
+	e, err := m.PhysSlice(m.VtoP(cpu, va), ringSQESize)
+	if err != nil {
+		return errFail, nil
+	}
+	sqe := readSQE(e)
+	if !ringOps[sqe.num] {
+		return errFail, nil
+	}
+	select {
+	case r.async <- struct{}{}:
+	default:
+		return hypBusy, nil
+	}
+	sqe.translate(m, cpu)
+	go func() {
+		r.run(sqe)
+		<-r.async
+	}()
+	return hypPending, nil
+}
+
+func readSQE(e []byte) ringSQE {
+	sqe := ringSQE{num: binary.LittleEndian.Uint64(e)}
+	for i := range sqe.args {
+		sqe.args[i] = binary.LittleEndian.Uint64(e[8+8*i:])
+	}
+	sqe.userData = binary.LittleEndian.Uint64(e[56:])
+	return sqe
+}
+
+// translate converts the pointer arguments of a submission to guest physical
+// addresses. It uses the vCPU's page tables, so it must run on the vCPU's
+// thread rather than on a worker.
+func (sqe *ringSQE) translate(m *kvm.Machine, cpu int) {
+	if !ringOps[sqe.num] {
+		return
+	}
+	for _, i := range hypPtrArgs[sqe.num] {
+		sqe.args[i] = m.VtoP(cpu, sqe.args[i])
+	}
+}
+
+func (r *hypRing) worker() {
+	for sqe := range r.work {
+		r.run(sqe)
+	}
+}
+
+func (r *hypRing) run(sqe ringSQE) {
+	result := errFail
+	if ringOps[sqe.num] {
+		ret, err := r.c.hostcall(r.m, sqe.num, sqe.args)
+		if err == nil {
+			result = ret
+		}
+	}
+	r.complete(ringCQE{userData: sqe.userData, result: result})
+}
+
+// complete queues a completion and posts as many queued completions as fit
+// in the completion queue. Completions that do not fit are posted once the
+// guest consumes entries and enters the ring or another operation completes.
+func (r *hypRing) complete(cqe ringCQE) {
+	r.lock.Lock()
+	r.overflow = append(r.overflow, cqe)
+	r.lock.Unlock()
+	r.flushOverflow()
+}
+
+// post writes a completion entry if the completion queue has space. Must be
+// called with the lock held.
+func (r *hypRing) post(cqe ringCQE) bool {
+	if r.cqTail-r32(r.mem, ringCQHead) >= r.entries {
+		return false
+	}
+	e := r.mem[ringHdrSize+ringSQESize*r.entries+ringCQESize*(r.cqTail%r.entries):]
+	binary.LittleEndian.PutUint64(e[0:], cqe.userData)
+	binary.LittleEndian.PutUint64(e[8:], cqe.result)
+	r.cqTail++
+	w32(r.mem, ringCQTail, r.cqTail)
+	// the ring is written long after PhysSlice returned it, so the writes
+	// must be marked for dirty logging
+	r.m.MarkDirty(r.pa+uint64(len(r.mem)-len(e)), ringCQESize)
+	r.m.MarkDirty(r.pa, ringHdrSize)
+	return true
+}
+
+func (r *hypRing) flushOverflow() {
+	r.lock.Lock()
+	n := 0
+	for n < len(r.overflow) && r.post(r.overflow[n]) {
+		n++
+	}
+	r.overflow = r.overflow[n:]
+	r.lock.Unlock()
+	if n > 0 {
+		r.m.InjectIrq(r.irq, 1)
+	}
+}
+
+func r32(mem []byte, off int) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&mem[off])))
+}
+
+func w32(mem []byte, off int, v uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&mem[off])), v)
+}
@@ -0,0 +1,121 @@
+package revisor
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zyedidia/revisor/kvm"
+)
+
+func TestRingDoesNotBlockWhenBusy(t *testing.T) {
+	c := NewContainer(nil)
+	m, err := kvm.NewMachine("/dev/kvm", 1, 16<<20, c)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer m.Close()
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	fd, err := c.addFile(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ram, entries = 0x40000000, 2
+	ring := uint64(ram + 0x10000)
+	if ret, _ := c.Hypercall(m, 0, hypRingSetup, ring, entries, kvm.SignalIRQ+1, 0, 0, 0); ret != 0 {
+		t.Fatal("ring setup failed")
+	}
+	sqe := func(i int) []byte {
+		return m.Slice(ring+ringHdrSize+ringSQESize*uint64(i%entries), ring+ringHdrSize+ringSQESize*uint64(i%entries+1))
+	}
+	read := func(e []byte) {
+		binary.LittleEndian.PutUint64(e[0:], hypRead)
+		binary.LittleEndian.PutUint64(e[8:], fd)
+		binary.LittleEndian.PutUint64(e[16:], ram+0x20000)
+		binary.LittleEndian.PutUint64(e[24:], 1)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// reads from the empty pipe occupy every worker and then the queue
+		submitted := uint64(0)
+		for i := 0; i < ringWorkers+2*entries; i++ {
+			read(sqe(i))
+			binary.LittleEndian.PutUint32(m.Slice(ring+ringSQTail, ring+ringSQTail+4), uint32(i+1))
+			n, _ := c.Hypercall(m, 0, hypRingEnter, 0, 0, 0, 0, 0, 0)
+			submitted += n
+			time.Sleep(10 * time.Millisecond)
+		}
+		if max := uint64(ringWorkers + entries); submitted != max {
+			t.Errorf("submitted %d operations, want %d", submitted, max)
+		}
+
+		e := m.Slice(ram+0x30000, ram+0x30000+ringSQESize)
+		read(e)
+		for i := 0; i < entries; i++ {
+			if ret, _ := c.Hypercall(m, 0, hypAsync, ram+0x30000, 0, 0, 0, 0, 0); ret != hypPending {
+				t.Errorf("async %d returned %#x", i, ret)
+			}
+		}
+		if ret, _ := c.Hypercall(m, 0, hypAsync, ram+0x30000, 0, 0, 0, 0, 0); ret != hypBusy {
+			t.Errorf("async beyond the limit returned %#x", ret)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hypercall blocked")
+	}
+	// let the reads finish before the ring is unmapped
+	pw.Close()
+	r := c.ring
+	for {
+		r.lock.Lock()
+		n := r.cqTail + uint32(len(r.overflow))
+		r.lock.Unlock()
+		if n == ringWorkers+2*entries {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRingIRQ(t *testing.T) {
+	c := NewContainer(nil)
+	m, err := kvm.NewMachine("/dev/kvm", 1, 16<<20, c)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer m.Close()
+
+	const ring = 0x40010000
+	tests := []struct {
+		irq uint64
+		ok  bool
+	}{
+		// lines of emulated devices and lines the machine does not have
+		{kvm.SignalIRQ - 1, false},
+		{kvm.SignalIRQ + kvm.SignalIRQs, false},
+		{1 << 32, false},
+		{kvm.SignalIRQ + 1<<32, false},
+		{kvm.SignalIRQ + kvm.SignalIRQs - 1, true},
+	}
+	for _, tt := range tests {
+		if ret, _ := c.Hypercall(m, 0, hypClearSignal, tt.irq, 0, 0, 0, 0, 0); (ret == 0) != tt.ok {
+			t.Errorf("clearing irq %#x returned %#x", tt.irq, ret)
+		}
+		if ret, _ := c.Hypercall(m, 0, hypRingSetup, ring, 4, tt.irq, 0, 0, 0); (ret == 0) != tt.ok {
+			t.Errorf("ring setup with irq %#x returned %#x", tt.irq, ret)
+		}
+	}
+	if c.ring == nil || c.ring.irq != kvm.SignalIRQ+kvm.SignalIRQs-1 {
+		t.Error("ring not set up with a signal irq")
+	}
+}
@@ -0,0 +1,247 @@
+package revisor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/zyedidia/revisor/kvm"
+)
+
+// openFile is a file of the fd table as saved in a snapshot.
+type openFile struct {
+	fd     uint64
+	flags  uint64
+	offset int64
+	path   string
+}
+
+// SaveState implements kvm.StateSaver. Files are saved by path, open flags
+// and offset, and reopened when the snapshot is restored; the standard
+// streams are not saved. File mappings are saved by path, along with the
+// pages of copy-on-write mappings that the guest changed. Ring operations
+// still in progress are lost.
+func (c *Container) SaveState(w io.Writer) error {
+	files, nextfd, err := c.openFiles()
+	if err != nil {
+		return err
+	}
+
+	le := binary.LittleEndian
+	if err := binary.Write(w, le, nextfd); err != nil {
+		return err
+	}
+	if err := binary.Write(w, le, uint64(len(files))); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := binary.Write(w, le, []uint64{f.fd, f.flags, uint64(f.offset), uint64(len(f.path))}); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, f.path); err != nil {
+			return err
+		}
+	}
+
+	if err := c.saveRing(w); err != nil {
+		return err
+	}
+	return c.saveMappings(w)
+}
+
+func (c *Container) saveRing(w io.Writer) error {
+	le := binary.LittleEndian
+	r := c.ring
+	if r == nil {
+		return binary.Write(w, le, uint64(0))
+	}
+	r.lock.Lock()
+	overflow := append([]ringCQE(nil), r.overflow...)
+	r.lock.Unlock()
+	if err := binary.Write(w, le, []uint64{1, r.pa, uint64(r.entries), uint64(r.irq), uint64(len(overflow))}); err != nil {
+		return err
+	}
+	for _, cqe := range overflow {
+		if err := binary.Write(w, le, []uint64{cqe.userData, cqe.result}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreState implements kvm.StateSaver. It replaces the fd table with the
+// saved one and sets up the hypercall ring and the file mappings again.
+func (c *Container) RestoreState(m *kvm.Machine, r io.Reader) error {
+	le := binary.LittleEndian
+	var hdr [2]uint64
+	if err := binary.Read(r, le, &hdr); err != nil {
+		return err
+	}
+	nextfd, nfiles := hdr[0], hdr[1]
+	if nextfd > fdMax || nfiles > fdMax {
+		return fmt.Errorf("invalid fd table of %d files", nfiles)
+	}
+	fdtable := map[uint64]*os.File{
+		0: os.Stdin,
+		1: os.Stdout,
+		2: os.Stderr,
+	}
+	for i := uint64(0); i < nfiles; i++ {
+		var info [4]uint64
+		if err := binary.Read(r, le, &info); err != nil {
+			return err
+		}
+		if info[3] > 4096 {
+			return fmt.Errorf("invalid path length %d", info[3])
+		}
+		path := make([]byte, info[3])
+		if _, err := io.ReadFull(r, path); err != nil {
+			return err
+		}
+		f, err := c.reopen(string(path), int(info[1]), int64(info[2]))
+		if err != nil {
+			return fmt.Errorf("fd %d: %w", info[0], err)
+		}
+		fdtable[info[0]] = f
+	}
+
+	var ring [1]uint64
+	if err := binary.Read(r, le, &ring); err != nil {
+		return err
+	}
+	if ring[0] != 0 {
+		var cfg [4]uint64
+		if err := binary.Read(r, le, &cfg); err != nil {
+			return err
+		}
+		if cfg[3] > ringMaxEntries {
+			return fmt.Errorf("invalid ring overflow of %d entries", cfg[3])
+		}
+		overflow := make([]ringCQE, cfg[3])
+		for i := range overflow {
+			var e [2]uint64
+			if err := binary.Read(r, le, &e); err != nil {
+				return err
+			}
+			overflow[i] = ringCQE{userData: e[0], result: e[1]}
+		}
+		c.ring = nil
+		if ret, _ := c.ringSetup(m, cfg[0], cfg[1], cfg[2]); ret != 0 {
+			return fmt.Errorf("invalid ring at %#x", cfg[0])
+		}
+		c.ring.overflow = overflow
+	}
+
+	mappings, err := c.restoreMappings(m, r)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.fdtable = fdtable
+	c.nextfd = nextfd
+	c.mappings = mappings
+	c.lock.Unlock()
+	return nil
+}
+
+// Fork implements kvm.Forker. The child container exports the same
+// directories and has its own copy of the fd table, with each file reopened
+// at the same offset so that the child does not share offsets with the
+// parent. The standard streams are shared. Files mapped by the parent are
+// mapped into the child, including the changes to copy-on-write mappings.
+func (c *Container) Fork(m *kvm.Machine) (kvm.HypercallHandler, error) {
+	files, nextfd, err := c.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	child := NewContainer(append([]string(nil), c.dirs...))
+	child.rand = c.rand
+	child.nextfd = nextfd
+	for _, of := range files {
+		f, err := c.reopen(of.path, int(of.flags), of.offset)
+		if err != nil {
+			return nil, fmt.Errorf("fd %d: %w", of.fd, err)
+		}
+		child.fdtable[of.fd] = f
+	}
+	if r := c.ring; r != nil {
+		if ret, _ := child.ringSetup(m, r.pa, uint64(r.entries), uint64(r.irq)); ret != 0 {
+			return nil, fmt.Errorf("invalid ring at %#x", r.pa)
+		}
+		r.lock.Lock()
+		child.ring.overflow = append([]ringCQE(nil), r.overflow...)
+		r.lock.Unlock()
+	}
+	var mappings bytes.Buffer
+	if err := c.saveMappings(&mappings); err != nil {
+		return nil, err
+	}
+	if child.mappings, err = child.restoreMappings(m, &mappings); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+// openFiles returns the files of the fd table other than the standard
+// streams, and the next fd to allocate.
+func (c *Container) openFiles() ([]openFile, uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var files []openFile
+	for fd, f := range c.fdtable {
+		if f == os.Stdin || f == os.Stdout || f == os.Stderr {
+			continue
+		}
+		flags, err := fileFlags(f)
+		if err != nil {
+			return nil, 0, fmt.Errorf("fd %d: %w", fd, err)
+		}
+		// files that cannot seek, such as FIFOs, are reopened at offset 0
+		off, _ := f.Seek(0, io.SeekCurrent)
+		files = append(files, openFile{fd: fd, flags: flags, offset: off, path: f.Name()})
+	}
+	return files, c.nextfd, nil
+}
+
+// reopen opens a saved file again, subject to the same access check as the
+// open hypercall.
+func (c *Container) reopen(path string, flags int, offset int64) (*os.File, error) {
+	if !c.CanAccess(path) {
+		return nil, fmt.Errorf("access to %s is not allowed", path)
+	}
+	f, err := os.OpenFile(path, flags&^(os.O_CREATE|os.O_EXCL|os.O_TRUNC), 0)
+	if err != nil {
+		return nil, err
+	}
+	if offset != 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// fileFlags returns the status flags that f was opened with.
+func fileFlags(f *os.File) (uint64, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var flags uintptr
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		flags, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, fmt.Errorf("fcntl: %w", errno)
+	}
+	return uint64(flags), nil
+}
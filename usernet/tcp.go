@@ -0,0 +1,471 @@
+package usernet
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpFIN = 1 << 0
+	tcpSYN = 1 << 1
+	tcpRST = 1 << 2
+	tcpPSH = 1 << 3
+	tcpACK = 1 << 4
+
+	tcpHdrSize     = 20
+	tcpMSS         = mtu - ipHdrSize - tcpHdrSize
+	tcpWindow      = 65535
+	tcpRTO         = 200 * time.Millisecond
+	tcpPersistMax  = 60 * time.Second
+	tcpDialTimeout = 10 * time.Second
+	// maximum number of guest segments queued for writing to the host
+	tcpWriteQueue = 64
+)
+
+type tcpKey struct {
+	guest     addr
+	guestPort uint16
+	dst       addr
+	dstPort   uint16
+}
+
+type tcpState int
+
+const (
+	tcpDialing tcpState = iota
+	tcpSynRcvd
+	tcpEstablished
+)
+
+// tcpConn terminates a guest TCP connection and relays its data over a host
+// TCP connection. All fields are protected by the stack lock.
+type tcpConn struct {
+	s     *Stack
+	key   tcpKey
+	conn  net.Conn
+	state tcpState
+	cond  *sync.Cond
+	timer *time.Timer
+
+	iss    uint32
+	sndUna uint32
+	sndNxt uint32
+	sndWnd uint32
+	mss    int
+	rcvNxt uint32
+	// number of zero window probes sent since the window closed
+	probes int
+
+	// data sent to the guest starting at sndUna that has not been
+	// acknowledged yet
+	unacked []byte
+
+	writes       chan []byte
+	writesClosed bool
+	finSent      bool
+	finAcked     bool
+	guestFin     bool
+	closed       bool
+}
+
+type tcpSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            uint8
+	window           uint16
+	options          []byte
+	data             []byte
+}
+
+func parseTCP(pkt []byte) (tcpSegment, bool) {
+	if len(pkt) < tcpHdrSize {
+		return tcpSegment{}, false
+	}
+	off := int(pkt[12]>>4) * 4
+	if off < tcpHdrSize || off > len(pkt) {
+		return tcpSegment{}, false
+	}
+	return tcpSegment{
+		srcPort: binary.BigEndian.Uint16(pkt[0:]),
+		dstPort: binary.BigEndian.Uint16(pkt[2:]),
+		seq:     binary.BigEndian.Uint32(pkt[4:]),
+		ack:     binary.BigEndian.Uint32(pkt[8:]),
+		flags:   pkt[13],
+		window:  binary.BigEndian.Uint16(pkt[14:]),
+		options: pkt[tcpHdrSize:off],
+		data:    pkt[off:],
+	}, true
+}
+
+// mssOption returns the MSS option of a SYN segment, or the default MSS.
+func (seg *tcpSegment) mssOption() int {
+	const (
+		optEnd = 0
+		optNop = 1
+		optMSS = 2
+	)
+	opts := seg.options
+	for len(opts) > 0 {
+		switch opts[0] {
+		case optEnd:
+			return tcpMSS
+		case optNop:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if opts[0] == optMSS && opts[1] == 4 {
+			return min(int(binary.BigEndian.Uint16(opts[2:])), tcpMSS)
+		}
+		opts = opts[opts[1]:]
+	}
+	return tcpMSS
+}
+
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLEQ(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+func (s *Stack) tcpSegment(src, dst addr, pkt []byte) {
+	seg, ok := parseTCP(pkt)
+	if !ok {
+		return
+	}
+	key := tcpKey{
+		guest:     src,
+		guestPort: seg.srcPort,
+		dst:       dst,
+		dstPort:   seg.dstPort,
+	}
+	c, ok := s.tcp[key]
+	if !ok {
+		s.tcpListen(key, &seg)
+		return
+	}
+
+	if seg.flags&tcpRST != 0 {
+		c.close()
+		return
+	}
+	if seg.flags&tcpSYN != 0 {
+		// the guest retransmitted its SYN
+		if c.state == tcpSynRcvd {
+			c.sendSyn()
+		}
+		return
+	}
+	if seg.flags&tcpACK != 0 {
+		c.ack(seg.ack, seg.window)
+	}
+	if len(seg.data) > 0 || seg.flags&tcpFIN != 0 {
+		c.receive(&seg)
+	}
+	if c.guestFin && c.finAcked {
+		c.close()
+	}
+}
+
+// tcpListen handles a segment that does not belong to a connection. SYN
+// segments start a new connection; anything else is reset.
+func (s *Stack) tcpListen(key tcpKey, seg *tcpSegment) {
+	if seg.flags&tcpRST != 0 {
+		return
+	}
+	host, ok := s.hostAddr(key.dst, key.dstPort, "tcp")
+	if seg.flags&(tcpSYN|tcpACK) != tcpSYN || !ok {
+		s.sendReset(key, seg)
+		return
+	}
+	iss := rand.Uint32()
+	c := &tcpConn{
+		s:      s,
+		key:    key,
+		state:  tcpDialing,
+		cond:   sync.NewCond(&s.lock),
+		iss:    iss,
+		sndUna: iss,
+		sndNxt: iss,
+		sndWnd: uint32(seg.window),
+		mss:    seg.mssOption(),
+		rcvNxt: seg.seq + 1,
+		writes: make(chan []byte, tcpWriteQueue),
+	}
+	s.tcp[key] = c
+	go c.dial(host)
+}
+
+func (s *Stack) sendReset(key tcpKey, seg *tcpSegment) {
+	if seg.flags&tcpACK != 0 {
+		s.sendTCP(key, seg.ack, 0, tcpRST, nil, nil)
+		return
+	}
+	n := uint32(len(seg.data))
+	if seg.flags&tcpSYN != 0 {
+		n++
+	}
+	if seg.flags&tcpFIN != 0 {
+		n++
+	}
+	s.sendTCP(key, 0, seg.seq+n, tcpRST|tcpACK, nil, nil)
+}
+
+// sendTCP sends a segment from the remote end of key to the guest. Must be
+// called with the lock held.
+func (s *Stack) sendTCP(key tcpKey, seq, ack uint32, flags uint8, options, data []byte) {
+	hdrLen := tcpHdrSize + len(options)
+	pkt := make([]byte, hdrLen+len(data))
+	binary.BigEndian.PutUint16(pkt[0:], key.dstPort)
+	binary.BigEndian.PutUint16(pkt[2:], key.guestPort)
+	binary.BigEndian.PutUint32(pkt[4:], seq)
+	binary.BigEndian.PutUint32(pkt[8:], ack)
+	pkt[12] = byte(hdrLen/4) << 4
+	pkt[13] = flags
+	binary.BigEndian.PutUint16(pkt[14:], tcpWindow)
+	copy(pkt[tcpHdrSize:], options)
+	copy(pkt[hdrLen:], data)
+	binary.BigEndian.PutUint16(pkt[16:], checksum(pkt, pseudoSum(key.dst, key.guest, protoTCP, len(pkt))))
+	s.sendIP(protoTCP, key.dst, key.guest, pkt)
+}
+
+func (c *tcpConn) send(flags uint8, seq uint32, data []byte) {
+	c.s.sendTCP(c.key, seq, c.rcvNxt, flags, nil, data)
+}
+
+func (c *tcpConn) sendSyn() {
+	opts := []byte{2, 4, 0, 0}
+	binary.BigEndian.PutUint16(opts[2:], tcpMSS)
+	c.s.sendTCP(c.key, c.iss, c.rcvNxt, tcpSYN|tcpACK, opts, nil)
+}
+
+func (c *tcpConn) dial(host string) {
+	conn, err := net.DialTimeout("tcp4", host, tcpDialTimeout)
+
+	c.s.lock.Lock()
+	defer c.s.lock.Unlock()
+
+	if c.closed {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	if err != nil {
+		c.send(tcpRST|tcpACK, c.sndNxt, nil)
+		c.close()
+		return
+	}
+	c.conn = conn
+	c.state = tcpSynRcvd
+	c.sendSyn()
+	c.sndNxt = c.iss + 1
+	c.arm()
+	go c.writer()
+}
+
+// ack processes an acknowledgment and window update from the guest.
+func (c *tcpConn) ack(ack uint32, window uint16) {
+	c.sndWnd = uint32(window)
+	if c.state == tcpSynRcvd {
+		if ack != c.iss+1 {
+			return
+		}
+		c.state = tcpEstablished
+		c.sndUna = ack
+		c.disarm()
+		c.persist()
+		go c.reader()
+		return
+	}
+	if seqLT(c.sndUna, ack) && seqLEQ(ack, c.sndNxt) {
+		n := int(ack - c.sndUna)
+		if c.finSent && ack == c.sndNxt {
+			c.finAcked = true
+			n--
+		}
+		c.unacked = c.unacked[min(n, len(c.unacked)):]
+		c.sndUna = ack
+		if c.sndUna == c.sndNxt {
+			c.disarm()
+		} else {
+			c.arm()
+		}
+	}
+	c.persist()
+	c.cond.Broadcast()
+}
+
+// persist starts the persist timer when the guest closes its window while no
+// data is in flight, so that the connection does not stall if the guest's
+// window update is lost. Otherwise the retransmission timer probes the
+// window.
+func (c *tcpConn) persist() {
+	if c.sndWnd != 0 {
+		c.probes = 0
+		return
+	}
+	if c.probes == 0 && c.state == tcpEstablished && c.sndUna == c.sndNxt && !c.finSent {
+		c.probes = 1
+		c.arm()
+	}
+}
+
+// receive handles data and FIN segments from the guest.
+func (c *tcpConn) receive(seg *tcpSegment) {
+	if seg.seq != c.rcvNxt || c.guestFin {
+		// out of order or duplicate: acknowledge what we have
+		c.send(tcpACK, c.sndNxt, nil)
+		return
+	}
+	if len(seg.data) > 0 {
+		select {
+		case c.writes <- append([]byte(nil), seg.data...):
+			c.rcvNxt += uint32(len(seg.data))
+		default:
+			// the host is not keeping up; let the guest retransmit
+			return
+		}
+	}
+	if seg.flags&tcpFIN != 0 {
+		c.rcvNxt++
+		c.guestFin = true
+		c.closeWrites()
+	}
+	c.send(tcpACK, c.sndNxt, nil)
+}
+
+func (c *tcpConn) closeWrites() {
+	if !c.writesClosed {
+		c.writesClosed = true
+		close(c.writes)
+	}
+}
+
+// writer copies guest data to the host connection. When the guest closes its
+// side, the write side of the host connection is shut down.
+func (c *tcpConn) writer() {
+	for data := range c.writes {
+		if _, err := c.conn.Write(data); err != nil {
+			c.s.lock.Lock()
+			if !c.closed {
+				c.send(tcpRST|tcpACK, c.sndNxt, nil)
+				c.close()
+			}
+			c.s.lock.Unlock()
+			return
+		}
+	}
+	if tc, ok := c.conn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+}
+
+// reader copies host data to the guest, respecting the guest's receive
+// window, and sends a FIN when the host closes the connection.
+func (c *tcpConn) reader() {
+	buf := make([]byte, c.mss)
+	for {
+		c.s.lock.Lock()
+		for !c.closed && c.sndNxt-c.sndUna >= c.sndWnd {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.s.lock.Unlock()
+			return
+		}
+		room := min(int(c.sndWnd-(c.sndNxt-c.sndUna)), len(buf))
+		c.s.lock.Unlock()
+
+		n, err := c.conn.Read(buf[:room])
+
+		c.s.lock.Lock()
+		if c.closed {
+			c.s.lock.Unlock()
+			return
+		}
+		if n > 0 {
+			c.unacked = append(c.unacked, buf[:n]...)
+			c.send(tcpACK|tcpPSH, c.sndNxt, buf[:n])
+			c.sndNxt += uint32(n)
+			c.arm()
+		}
+		if err != nil {
+			c.send(tcpFIN|tcpACK, c.sndNxt, nil)
+			c.finSent = true
+			c.sndNxt++
+			c.arm()
+			c.s.lock.Unlock()
+			return
+		}
+		c.s.lock.Unlock()
+	}
+}
+
+func (c *tcpConn) arm() {
+	if c.timer == nil {
+		c.timer = time.AfterFunc(tcpRTO, c.retransmit)
+	} else {
+		c.timer.Reset(tcpRTO)
+	}
+}
+
+func (c *tcpConn) disarm() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// retransmit resends the oldest unacknowledged segment. The link to the
+// guest does not lose packets, but the guest may drop them when its receive
+// queue is full.
+func (c *tcpConn) retransmit() {
+	c.s.lock.Lock()
+	defer c.s.lock.Unlock()
+
+	if c.closed {
+		return
+	}
+	switch {
+	case c.state == tcpSynRcvd:
+		c.sendSyn()
+	case len(c.unacked) > 0:
+		c.send(tcpACK|tcpPSH, c.sndUna, c.unacked[:min(len(c.unacked), c.mss)])
+	case c.finSent && !c.finAcked:
+		c.send(tcpFIN|tcpACK, c.sndNxt-1, nil)
+	case c.probes > 0:
+		// an already acknowledged sequence number makes the guest reply
+		// with its current window
+		c.send(tcpACK, c.sndNxt-1, nil)
+		c.timer.Reset(min(tcpRTO<<min(c.probes, 16), tcpPersistMax))
+		c.probes++
+		return
+	default:
+		return
+	}
+	c.arm()
+}
+
+// close tears down the connection. Must be called with the lock held.
+func (c *tcpConn) close() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.disarm()
+	c.closeWrites()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	if c.s.tcp[c.key] == c {
+		delete(c.s.tcp, c.key)
+	}
+	c.cond.Broadcast()
+}
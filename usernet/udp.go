@@ -0,0 +1,95 @@
+package usernet
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	udpHdrSize     = 8
+	udpIdleTimeout = 2 * time.Minute
+)
+
+type udpKey struct {
+	guestPort uint16
+	dst       addr
+	dstPort   uint16
+}
+
+// udpFlow is a host UDP socket that relays datagrams for one guest flow.
+type udpFlow struct {
+	conn *net.UDPConn
+}
+
+func (s *Stack) udpPacket(src, dst addr, pkt []byte) {
+	if len(pkt) < udpHdrSize {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(pkt[4:]))
+	if length < udpHdrSize || length > len(pkt) {
+		return
+	}
+	key := udpKey{
+		guestPort: binary.BigEndian.Uint16(pkt[0:]),
+		dst:       dst,
+		dstPort:   binary.BigEndian.Uint16(pkt[2:]),
+	}
+	flow, ok := s.udp[key]
+	if !ok {
+		host, ok := s.hostAddr(dst, key.dstPort, "udp")
+		if !ok {
+			return
+		}
+		raddr, err := net.ResolveUDPAddr("udp4", host)
+		if err != nil {
+			return
+		}
+		conn, err := net.DialUDP("udp4", nil, raddr)
+		if err != nil {
+			return
+		}
+		flow = &udpFlow{conn: conn}
+		s.udp[key] = flow
+		go s.udpReceive(key, src, flow)
+	}
+	flow.conn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+	flow.conn.Write(pkt[udpHdrSize:length])
+}
+
+// udpReceive relays datagrams from the host socket back to the guest until
+// the flow is idle for udpIdleTimeout.
+func (s *Stack) udpReceive(key udpKey, guest addr, flow *udpFlow) {
+	buf := make([]byte, mtu-ipHdrSize-udpHdrSize)
+	for {
+		n, err := flow.conn.Read(buf)
+		if err != nil {
+			break
+		}
+		s.lock.Lock()
+		s.sendUDP(key.dst, key.dstPort, guest, key.guestPort, buf[:n])
+		s.lock.Unlock()
+	}
+	s.lock.Lock()
+	if s.udp[key] == flow {
+		delete(s.udp, key)
+	}
+	s.lock.Unlock()
+	flow.conn.Close()
+}
+
+// sendUDP sends a UDP datagram to the guest. Must be called with the lock
+// held.
+func (s *Stack) sendUDP(src addr, srcPort uint16, dst addr, dstPort uint16, data []byte) {
+	pkt := make([]byte, udpHdrSize+len(data))
+	binary.BigEndian.PutUint16(pkt[0:], srcPort)
+	binary.BigEndian.PutUint16(pkt[2:], dstPort)
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)))
+	copy(pkt[udpHdrSize:], data)
+	sum := checksum(pkt, pseudoSum(src, dst, protoUDP, len(pkt)))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(pkt[6:], sum)
+	s.sendIP(protoUDP, src, dst, pkt)
+}
@@ -0,0 +1,289 @@
+// Package usernet implements a small userspace NAT network stack that
+// connects a guest's Ethernet interface to the host's sockets, without
+// needing root privileges or tap devices.
+//
+// The guest sees a 10.0.2.0/24 network in which it owns GuestIP, the gateway
+// is GatewayIP and a DNS forwarder listens on DNSIP. Guests must configure
+// these addresses statically. Connections to the gateway address are
+// forwarded to the host's loopback interface, but only for the ports the
+// stack was created with.
+package usernet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	GatewayIP = net.IPv4(10, 0, 2, 2).To4()
+	DNSIP     = net.IPv4(10, 0, 2, 3).To4()
+	GuestIP   = net.IPv4(10, 0, 2, 15).To4()
+	Netmask   = net.IPv4Mask(255, 255, 255, 0)
+
+	GatewayMAC = net.HardwareAddr{0x52, 0x55, 0x0a, 0x00, 0x02, 0x02}
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+
+	protoICMP = 1
+	protoTCP  = 6
+	protoUDP  = 17
+
+	ethHdrSize = 14
+	ipHdrSize  = 20
+	mtu        = 1500
+)
+
+type addr [4]byte
+
+func toAddr(ip net.IP) addr {
+	var a addr
+	copy(a[:], ip.To4())
+	return a
+}
+
+func (a addr) IP() net.IP {
+	return net.IPv4(a[0], a[1], a[2], a[3])
+}
+
+// Stack is a userspace NAT. It implements kvm.NetBackend.
+type Stack struct {
+	lock     sync.Mutex
+	recv     func([]byte)
+	guestMAC net.HardwareAddr
+	ipID     uint16
+	dns      string
+	hostPort map[uint16]bool
+	udp      map[udpKey]*udpFlow
+	tcp      map[tcpKey]*tcpConn
+	closed   bool
+}
+
+// New creates a userspace NAT stack. DNS queries sent to DNSIP are forwarded
+// to the first nameserver in the host's /etc/resolv.conf. TCP connections
+// and UDP datagrams sent to GatewayIP on one of hostPorts are forwarded to
+// the same port on the host's loopback interface; the guest cannot reach
+// any other port on the host's loopback interface.
+func New(hostPorts []uint16) *Stack {
+	s := &Stack{
+		dns:      hostNameserver(),
+		hostPort: make(map[uint16]bool),
+		udp:      make(map[udpKey]*udpFlow),
+		tcp:      make(map[tcpKey]*tcpConn),
+	}
+	for _, port := range hostPorts {
+		s.hostPort[port] = true
+	}
+	return s
+}
+
+func hostNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+func (s *Stack) Attach(recv func([]byte)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.recv = recv
+}
+
+// Close closes all host sockets opened on behalf of the guest.
+func (s *Stack) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for _, f := range s.udp {
+		f.conn.Close()
+	}
+	for _, c := range s.tcp {
+		c.close()
+	}
+	return nil
+}
+
+// Send handles a frame sent by the guest.
+func (s *Stack) Send(frame []byte) error {
+	if len(frame) < ethHdrSize {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	if s.guestMAC == nil {
+		s.guestMAC = append(net.HardwareAddr(nil), frame[6:12]...)
+	}
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case etherTypeARP:
+		s.arp(frame[ethHdrSize:])
+	case etherTypeIPv4:
+		s.ipv4(frame[ethHdrSize:])
+	}
+	return nil
+}
+
+// deliver sends an Ethernet frame to the guest. Must be called with the lock
+// held.
+func (s *Stack) deliver(etherType uint16, payload []byte) {
+	if s.recv == nil || s.guestMAC == nil {
+		return
+	}
+	frame := make([]byte, ethHdrSize+len(payload))
+	copy(frame[0:], s.guestMAC)
+	copy(frame[6:], GatewayMAC)
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	copy(frame[ethHdrSize:], payload)
+	s.recv(frame)
+}
+
+func (s *Stack) arp(pkt []byte) {
+	const (
+		arpRequest = 1
+		arpReply   = 2
+	)
+	if len(pkt) < 28 || binary.BigEndian.Uint16(pkt[6:]) != arpRequest {
+		return
+	}
+	target := net.IP(pkt[24:28])
+	if !target.Mask(Netmask).Equal(GatewayIP.Mask(Netmask)) || target.Equal(GuestIP) {
+		return
+	}
+	reply := make([]byte, 28)
+	copy(reply, pkt[:6]) // htype, ptype, hlen, plen
+	binary.BigEndian.PutUint16(reply[6:], arpReply)
+	copy(reply[8:], GatewayMAC)
+	copy(reply[14:], target)
+	copy(reply[18:], pkt[8:14])
+	copy(reply[24:], pkt[14:18])
+	s.deliver(etherTypeARP, reply)
+}
+
+func (s *Stack) ipv4(pkt []byte) {
+	if len(pkt) < ipHdrSize || pkt[0]>>4 != 4 {
+		return
+	}
+	ihl := int(pkt[0]&0xf) * 4
+	total := int(binary.BigEndian.Uint16(pkt[2:]))
+	if ihl < ipHdrSize || total < ihl || total > len(pkt) {
+		return
+	}
+	// fragments are not supported
+	if binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+		return
+	}
+	src, dst := toAddr(pkt[12:16]), toAddr(pkt[16:20])
+	payload := pkt[ihl:total]
+	switch pkt[9] {
+	case protoICMP:
+		s.icmp(src, dst, payload)
+	case protoUDP:
+		s.udpPacket(src, dst, payload)
+	case protoTCP:
+		s.tcpSegment(src, dst, payload)
+	}
+}
+
+// sendIP sends an IPv4 packet to the guest. Must be called with the lock
+// held.
+func (s *Stack) sendIP(proto uint8, src, dst addr, payload []byte) {
+	pkt := make([]byte, ipHdrSize+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[4:], s.ipID)
+	s.ipID++
+	binary.BigEndian.PutUint16(pkt[6:], 0x4000) // don't fragment
+	pkt[8] = 64
+	pkt[9] = proto
+	copy(pkt[12:], src[:])
+	copy(pkt[16:], dst[:])
+	binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:ipHdrSize], 0))
+	copy(pkt[ipHdrSize:], payload)
+	s.deliver(etherTypeIPv4, pkt)
+}
+
+func (s *Stack) icmp(src, dst addr, pkt []byte) {
+	const (
+		echoReply   = 0
+		echoRequest = 8
+	)
+	if len(pkt) < 8 || pkt[0] != echoRequest {
+		return
+	}
+	if dst != toAddr(GatewayIP) && dst != toAddr(DNSIP) {
+		return
+	}
+	reply := append([]byte(nil), pkt...)
+	reply[0] = echoReply
+	reply[2], reply[3] = 0, 0
+	binary.BigEndian.PutUint16(reply[2:], checksum(reply, 0))
+	s.sendIP(protoICMP, dst, src, reply)
+}
+
+// hostAddr maps a guest destination to the host address to connect to.
+func (s *Stack) hostAddr(dst addr, port uint16, network string) (string, bool) {
+	switch dst {
+	case toAddr(GatewayIP):
+		if !s.hostPort[port] {
+			return "", false
+		}
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))), true
+	case toAddr(DNSIP):
+		if network != "udp" || port != 53 || s.dns == "" {
+			return "", false
+		}
+		return net.JoinHostPort(s.dns, "53"), true
+	}
+	// the host itself is only reachable through the gateway address
+	if ip := dst.IP(); ip.IsLoopback() || ip.IsUnspecified() {
+		return "", false
+	}
+	return net.JoinHostPort(dst.IP().String(), strconv.Itoa(int(port))), true
+}
+
+// checksum computes the Internet checksum of b, starting from the partial
+// sum initial.
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// pseudoSum returns the partial checksum of the TCP/UDP pseudo header.
+func pseudoSum(src, dst addr, proto uint8, length int) uint32 {
+	sum := uint32(src[0])<<8 | uint32(src[1])
+	sum += uint32(src[2])<<8 | uint32(src[3])
+	sum += uint32(dst[0])<<8 | uint32(dst[1])
+	sum += uint32(dst[2])<<8 | uint32(dst[3])
+	sum += uint32(proto)
+	sum += uint32(length)
+	return sum
+}
@@ -0,0 +1,344 @@
+package usernet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+var testGuestMAC = net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+
+// testGuest plays the guest side of a Stack, building the frames it sends
+// and parsing the ones it receives.
+type testGuest struct {
+	t      *testing.T
+	s      *Stack
+	frames chan []byte
+}
+
+func newTestGuest(t *testing.T, hostPorts ...uint16) *testGuest {
+	g := &testGuest{
+		t:      t,
+		s:      New(hostPorts),
+		frames: make(chan []byte, 1024),
+	}
+	g.s.Attach(func(frame []byte) {
+		g.frames <- append([]byte(nil), frame...)
+	})
+	t.Cleanup(func() { g.s.Close() })
+	return g
+}
+
+func (g *testGuest) sendIP(proto uint8, dst addr, payload []byte) {
+	frame := make([]byte, ethHdrSize+ipHdrSize+len(payload))
+	copy(frame[0:], GatewayMAC)
+	copy(frame[6:], testGuestMAC)
+	binary.BigEndian.PutUint16(frame[12:], etherTypeIPv4)
+	pkt := frame[ethHdrSize:]
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = proto
+	copy(pkt[12:], GuestIP)
+	copy(pkt[16:], dst[:])
+	binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:ipHdrSize], 0))
+	copy(pkt[ipHdrSize:], payload)
+	if err := g.s.Send(frame); err != nil {
+		g.t.Fatal(err)
+	}
+}
+
+func (g *testGuest) sendTCP(dst addr, dstPort uint16, seq, ack uint32, flags uint8, window uint16, data []byte) {
+	pkt := make([]byte, tcpHdrSize+len(data))
+	binary.BigEndian.PutUint16(pkt[0:], testGuestPort)
+	binary.BigEndian.PutUint16(pkt[2:], dstPort)
+	binary.BigEndian.PutUint32(pkt[4:], seq)
+	binary.BigEndian.PutUint32(pkt[8:], ack)
+	pkt[12] = tcpHdrSize / 4 << 4
+	pkt[13] = flags
+	binary.BigEndian.PutUint16(pkt[14:], window)
+	copy(pkt[tcpHdrSize:], data)
+	binary.BigEndian.PutUint16(pkt[16:], checksum(pkt, pseudoSum(toAddr(GuestIP), dst, protoTCP, len(pkt))))
+	g.sendIP(protoTCP, dst, pkt)
+}
+
+func (g *testGuest) sendUDP(dst addr, dstPort uint16, data []byte) {
+	pkt := make([]byte, udpHdrSize+len(data))
+	binary.BigEndian.PutUint16(pkt[0:], testGuestPort)
+	binary.BigEndian.PutUint16(pkt[2:], dstPort)
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)))
+	copy(pkt[udpHdrSize:], data)
+	g.sendIP(protoUDP, dst, pkt)
+}
+
+// recv returns the payload of the next IPv4 packet of the given protocol
+// sent to the guest, checking its headers and checksums, and the address it
+// came from.
+func (g *testGuest) recv(proto uint8) (addr, []byte) {
+	g.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		var frame []byte
+		select {
+		case frame = <-g.frames:
+		case <-timeout:
+			g.t.Fatal("timed out waiting for a packet")
+		}
+		if binary.BigEndian.Uint16(frame[12:]) != etherTypeIPv4 {
+			continue
+		}
+		pkt := frame[ethHdrSize:]
+		if pkt[9] != proto {
+			continue
+		}
+		if !bytes.Equal(frame[0:6], testGuestMAC) || checksum(pkt[:ipHdrSize], 0) != 0 {
+			g.t.Fatal("bad Ethernet or IP header")
+		}
+		src, dst := toAddr(pkt[12:16]), toAddr(pkt[16:20])
+		payload := pkt[ipHdrSize:binary.BigEndian.Uint16(pkt[2:])]
+		if dst != toAddr(GuestIP) || checksum(payload, pseudoSum(src, dst, proto, len(payload))) != 0 {
+			g.t.Fatal("bad packet to the guest")
+		}
+		return src, payload
+	}
+}
+
+// recvTCP returns the next TCP segment sent to the guest for which match
+// returns true, skipping others such as retransmissions.
+func (g *testGuest) recvTCP(match func(seg *tcpSegment) bool) tcpSegment {
+	g.t.Helper()
+	for {
+		_, pkt := g.recv(protoTCP)
+		seg, ok := parseTCP(pkt)
+		if !ok {
+			g.t.Fatal("bad TCP segment")
+		}
+		if seg.dstPort != testGuestPort {
+			g.t.Fatalf("segment to port %d", seg.dstPort)
+		}
+		if match(&seg) {
+			return seg
+		}
+	}
+}
+
+const testGuestPort = 40000
+
+func hasFlags(flags uint8) func(seg *tcpSegment) bool {
+	return func(seg *tcpSegment) bool {
+		return seg.flags == flags
+	}
+}
+
+func listenTCP(t *testing.T) (*net.TCPListener, uint16) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln, uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// testConn is an established connection between the test guest and a host
+// socket.
+type testConn struct {
+	g      *testGuest
+	host   *net.TCPConn
+	port   uint16
+	seq    uint32 // next guest sequence number
+	remote uint32 // next sequence number of the stack
+}
+
+// connect opens a connection from the guest to the host listener through
+// the gateway address.
+func connect(t *testing.T, g *testGuest, ln *net.TCPListener, port uint16, window uint16) *testConn {
+	const iss = 1000
+	gw := toAddr(GatewayIP)
+	g.sendTCP(gw, port, iss, 0, tcpSYN, window, nil)
+	synack := g.recvTCP(hasFlags(tcpSYN | tcpACK))
+	if synack.ack != iss+1 {
+		t.Fatalf("SYN-ACK acknowledges %d, want %d", synack.ack, iss+1)
+	}
+	host, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { host.Close() })
+	c := &testConn{g: g, host: host, port: port, seq: iss + 1, remote: synack.seq + 1}
+	g.sendTCP(gw, port, c.seq, c.remote, tcpACK, window, nil)
+	return c
+}
+
+func (c *testConn) send(flags uint8, window uint16, data []byte) {
+	c.g.sendTCP(toAddr(GatewayIP), c.port, c.seq, c.remote, flags, window, data)
+	c.seq += uint32(len(data))
+	if flags&tcpFIN != 0 {
+		c.seq++
+	}
+}
+
+func (c *testConn) conns() int {
+	c.g.s.lock.Lock()
+	defer c.g.s.lock.Unlock()
+	return len(c.g.s.tcp)
+}
+
+func readFull(t *testing.T, conn net.Conn, n int) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, n)
+	for i := 0; i < n; {
+		m, err := conn.Read(buf[i:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		i += m
+	}
+	return string(buf)
+}
+
+func TestTCPZeroWindowProbe(t *testing.T) {
+	ln, port := listenTCP(t)
+	g := newTestGuest(t, port)
+	c := connect(t, g, ln, port, 0)
+
+	// the guest's window is closed, so the stack probes it
+	probe := g.recvTCP(hasFlags(tcpACK))
+	if probe.seq != c.remote-1 || len(probe.data) != 0 {
+		t.Fatalf("probe has sequence number %d and %d bytes, want %d and none", probe.seq, len(probe.data), c.remote-1)
+	}
+	if _, err := c.host.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	// the reply to a probe opens the window
+	c.send(tcpACK, 65535, nil)
+	seg := g.recvTCP(func(seg *tcpSegment) bool { return len(seg.data) > 0 })
+	if seg.seq != c.remote || string(seg.data) != "data" {
+		t.Errorf("received %q at %d, want %q at %d", seg.data, seg.seq, "data", c.remote)
+	}
+}
+
+func TestTCPTransfer(t *testing.T) {
+	ln, port := listenTCP(t)
+	g := newTestGuest(t, port)
+	c := connect(t, g, ln, port, 65535)
+
+	c.send(tcpACK|tcpPSH, 65535, []byte("hello"))
+	ack := g.recvTCP(hasFlags(tcpACK))
+	if ack.ack != c.seq {
+		t.Errorf("stack acknowledged %d, want %d", ack.ack, c.seq)
+	}
+	if got := readFull(t, c.host, 5); got != "hello" {
+		t.Errorf("host received %q", got)
+	}
+
+	if _, err := c.host.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	seg := g.recvTCP(func(seg *tcpSegment) bool { return len(seg.data) > 0 })
+	if seg.seq != c.remote || string(seg.data) != "world" {
+		t.Fatalf("guest received %q at %d, want %q at %d", seg.data, seg.seq, "world", c.remote)
+	}
+	c.remote += uint32(len(seg.data))
+	c.send(tcpACK, 65535, nil)
+
+	// the host closes its side first
+	c.host.CloseWrite()
+	fin := g.recvTCP(func(seg *tcpSegment) bool { return seg.flags&tcpFIN != 0 })
+	if fin.seq != c.remote {
+		t.Fatalf("FIN at %d, want %d", fin.seq, c.remote)
+	}
+	c.remote++
+	c.send(tcpFIN|tcpACK, 65535, nil)
+	ack = g.recvTCP(hasFlags(tcpACK))
+	if ack.ack != c.seq {
+		t.Errorf("stack acknowledged the FIN with %d, want %d", ack.ack, c.seq)
+	}
+	c.host.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.host.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("host read %d bytes and %v after the guest's FIN", n, err)
+	}
+	if n := c.conns(); n != 0 {
+		t.Errorf("%d connections left after both sides closed", n)
+	}
+}
+
+func TestTCPGuestReset(t *testing.T) {
+	ln, port := listenTCP(t)
+	g := newTestGuest(t, port)
+	c := connect(t, g, ln, port, 65535)
+
+	c.send(tcpRST, 0, nil)
+	c.host.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.host.Read(make([]byte, 1)); err == nil {
+		t.Error("host connection still open after the guest reset it")
+	}
+	if n := c.conns(); n != 0 {
+		t.Errorf("%d connections left after a reset", n)
+	}
+}
+
+func TestTCPRefused(t *testing.T) {
+	_, port := listenTCP(t)
+	tests := []struct {
+		name string
+		dst  addr
+	}{
+		{"unlisted gateway port", toAddr(GatewayIP)},
+		{"host loopback", toAddr(net.IPv4(127, 0, 0, 1))},
+		{"unspecified", toAddr(net.IPv4zero)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGuest(t, port+1)
+			g.sendTCP(tt.dst, port, 1000, 0, tcpSYN, 65535, nil)
+			rst := g.recvTCP(func(seg *tcpSegment) bool { return true })
+			if rst.flags != tcpRST|tcpACK || rst.ack != 1001 {
+				t.Errorf("SYN answered with flags %#x and ack %d, want a reset", rst.flags, rst.ack)
+			}
+		})
+	}
+}
+
+func TestUDPRelay(t *testing.T) {
+	host, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	port := uint16(host.LocalAddr().(*net.UDPAddr).Port)
+	g := newTestGuest(t, port)
+
+	g.sendUDP(toAddr(GatewayIP), port, []byte("ping"))
+	host.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, from, err := host.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("host received %q", buf[:n])
+	}
+	if _, err := host.WriteToUDP([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	src, pkt := g.recv(protoUDP)
+	srcPort, dstPort := binary.BigEndian.Uint16(pkt[0:]), binary.BigEndian.Uint16(pkt[2:])
+	if src != toAddr(GatewayIP) || srcPort != port || dstPort != testGuestPort {
+		t.Errorf("reply from %v:%d to port %d", src.IP(), srcPort, dstPort)
+	}
+	if string(pkt[udpHdrSize:]) != "pong" {
+		t.Errorf("guest received %q", pkt[udpHdrSize:])
+	}
+
+	// datagrams to other host ports are dropped
+	g.sendUDP(toAddr(GatewayIP), port+1, []byte("ping"))
+	g.s.lock.Lock()
+	flows := len(g.s.udp)
+	g.s.lock.Unlock()
+	if flows != 1 {
+		t.Errorf("%d UDP flows, want only the allowed one", flows)
+	}
+}